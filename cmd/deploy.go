@@ -1,9 +1,12 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/linkalls/sailor/config"
 	"github.com/linkalls/sailor/internal"
@@ -15,6 +18,8 @@ import (
 var deployCmd = &cobra.Command{
 	Use:   "deploy",
 	Short: "現在のブランチをデプロイ",
+	// --force は値を省略できるため、--force unpushed のような指定が位置引数として無視されないよう引数を受け付けない
+	Args: cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		// カレントディレクトリの取得
 		wd, err := os.Getwd()
@@ -23,10 +28,15 @@ var deployCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		// Git状態のチェック
-		if status, err := internal.CheckGitStatus(); !status {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		ref, _ := cmd.Flags().GetString("ref")
+
+		// Git状態のチェック（dry-run時は警告のみ）。--ref 指定時は作業ツリーを使わないため確認しない
+		if status, err := internal.CheckGitStatus(); !status && ref == "" {
 			fmt.Println(err)
-			return
+			if !dryRun {
+				return
+			}
 		}
 
 		// 設定ファイル読み込み（カレントディレクトリからの相対パス）
@@ -37,43 +47,283 @@ var deployCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		// Git の現在のブランチが trigger_branch と一致しているか確認
-		if !internal.CheckGitBranch(conf.Deploy.TriggerBranch) {
-			fmt.Println("現在のブランチがトリガーブランチと一致しません。デプロイ中止。")
+		// ブランチ・プッシュ済みか・origin との差・タグを確認（--force で個別に無視できる）
+		force, _ := cmd.Flags().GetStringSlice("force")
+		if err := internal.ValidateForce(force); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		forced, blocking := internal.ApplyForce(internal.CheckGitGuards(context.Background(), conf, internal.NewLocalRunner(), ref), force)
+		for _, guard := range forced {
+			fmt.Printf("警告: --force によりガード %s を無視します\n", guard)
+		}
+		for _, failure := range blocking {
+			fmt.Println(failure.Message)
+		}
+		if len(blocking) > 0 && !dryRun {
+			fmt.Println("デプロイ中止。--force=<ガード名> で無視できます（ガード名: branch, unpushed, behind, tag）")
 			return
 		}
+		deployForced = forced
 
-		// Dockerイメージのビルド
-		if err := internal.BuildDockerImage(&conf); err != nil {
-			fmt.Printf("\nDockerイメージのビルドに失敗: %v\n", err)
-			return
+		if err := internal.ValidateBuildMode(conf); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := internal.ValidateAnnotate(conf); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
+		if err := internal.ValidateContainers(conf); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// コマンドの実行手段を決定（dry-run時は記録のみ）
+		local := internal.NewLocalRunner()
+		remote := internal.NewRemoteRunner(conf)
+		if dryRun {
+			recorder := internal.NewDryRunRecorder()
+			local, remote = recorder.Local(), recorder.Remote()
+			fmt.Println("dry-run モード: 以下のコマンドは実行されません")
+		}
+
+		// git の読み取り専用の問い合わせは dry-run でも実行し、実際のタグ・プロジェクト名でコマンドを表示する
+		query := internal.QueryRunner(local)
+
+		// project_name も compose の name: も無い場合はリポジトリ名をプロジェクト名にする
+		internal.ResolveProjectName(context.Background(), &conf, query)
+
+		// --ref 指定時は一時的な git worktree に移動してビルドする（作業ツリーには触れない）
+		if ref != "" {
+			config.HistoryPath = filepath.Join(wd, config.HistoryPath)
+			deployWorktree, err = internal.CheckoutRef(context.Background(), &conf, internal.NewLocalRunner(), ref)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer deployWorktree.Remove()
+			fmt.Printf("%s (%s) をデプロイします\n", ref, deployWorktree.Commit)
+		}
+		remoteBuild := internal.RemoteBuild(conf)
+
+		// --no-cache は設定ファイルの no_cache より優先する
+		if cmd.Flags().Changed("no-cache") {
+			conf.Docker.NoCache, _ = cmd.Flags().GetBool("no-cache")
+		}
+
+		// compose ファイルから転送するファイルとデプロイするサービスを収集
+		if conf.Docker.UseCompose {
+			warnings, err := internal.PrepareCompose(&conf)
+			if err != nil {
+				fmt.Println("composeファイルの解析に失敗:", err)
+				exitDeploy(1)
+			}
+			for _, w := range warnings {
+				fmt.Println("警告:", w)
+			}
+		}
+
+		// Ctrl-C / SIGTERM で実行中の処理を中断できるようにする
+		ctx, stop := interruptContext()
+		defer stop()
+
+		// ローカルとリモートで使う compose コマンド (docker compose / docker-compose) を決定
+		if conf.Docker.UseCompose {
+			if err := internal.ResolveComposeCommands(ctx, &conf, local, remote); err != nil {
+				fmt.Println(err)
+				exitDeploy(1)
+			}
+		}
+
+		// HEAD のコミットからイメージのタグと OCI ラベルを決定
+		if err := internal.ResolveImageTag(ctx, &conf, query, time.Now()); err != nil {
+			fmt.Println(err)
+			exitDeploy(1)
+		}
+
+		// build = "remote" の場合はロックを取得してからリモートでビルドする
+		if !remoteBuild {
+			// リモートサーバーのアーキテクチャを検出し、ローカルと異なれば buildx でビルドする
+			target, err := internal.ResolvePlatform(ctx, &conf, local, remote)
+			if err != nil {
+				fmt.Println("警告:", err)
+			}
 
-		// Dockerイメージの保存（圧縮）
-		if err := internal.SaveDockerImage(conf); err != nil {
-			fmt.Printf("\nDockerイメージの保存に失敗: %v\n", err)
+			// Dockerイメージのビルド
+			if err := internal.BuildDockerImage(ctx, conf, local); err != nil {
+				fmt.Printf("\nDockerイメージのビルドに失敗: %v\n", err)
+				abortDeploy(ctx, stop, conf, remote, nil)
+				return
+			}
+			for _, w := range internal.CheckImagePlatform(ctx, conf, local, target) {
+				fmt.Println("警告:", w)
+			}
+
+			// Dockerイメージの保存（圧縮）
+			if err := internal.SaveDockerImage(ctx, conf, local); err != nil {
+				fmt.Printf("\nDockerイメージの保存に失敗: %v\n", err)
+				abortDeploy(ctx, stop, conf, remote, nil)
+				return
+			}
+		}
+
+		// 同時に実行された別のデプロイと転送・コンテナの入れ替えが重ならないようにロックを取得
+		commit, _ := query.Output(ctx, "git", "rev-parse", "--short", "HEAD")
+		lockInfo := internal.NewLockInfo(commit)
+		if err := internal.AcquireDeployLock(ctx, conf, remote, lockInfo); err != nil {
+			fmt.Printf("\n%v\n", err)
+			if errors.Is(err, internal.ErrDeployLocked) {
+				fmt.Println("ロックの状態は sailor lock status で確認できます（強制解除: sailor unlock --force）")
+			}
+			abortDeploy(ctx, stop, conf, remote, nil)
 			return
 		}
+		// 転送やビルドが lock_ttl より長くかかっても古いロックとして解除されないよう、保持している間は更新し続ける
+		stopKeepLock := func() {}
+		if !dryRun {
+			stopKeepLock = internal.KeepDeployLock(ctx, conf, remote, lockInfo)
+		}
+		releaseLock := func() {
+			stopKeepLock()
+			cleanupCtx, cancel := internal.NewCleanupContext()
+			defer cancel()
+			if err := internal.ReleaseOwnDeployLock(cleanupCtx, conf, remote, lockInfo); err != nil {
+				fmt.Println("警告:", err)
+			}
+		}
+
+		// HEAD のソースを転送してリモートサーバーでビルド
+		if remoteBuild {
+			if err := internal.BuildRemoteImage(ctx, conf, local, remote); err != nil {
+				fmt.Printf("\nリモートでのDockerイメージのビルドに失敗: %v\n", err)
+				abortDeploy(ctx, stop, conf, remote, releaseLock)
+				releaseLock()
+				return
+			}
+		}
 
 		fmt.Println("\nリモートサーバーへの転送を開始します...")
 
 		// ローカルの圧縮ファイルをリモートサーバーに転送
-		if err := internal.TransferDockerImage(conf); err != nil {
+		if err := internal.TransferDockerImage(ctx, conf, remote); err != nil {
 			fmt.Printf("\nファイル転送に失敗: %v\n", err)
+			abortDeploy(ctx, stop, conf, remote, releaseLock)
+			releaseLock()
 			return
 		}
 
-		// リモートサーバーでコンテナを実行（既存コンテナは停止・削除してから）
-		if err := internal.RunRemoteContainer(conf); err != nil {
+		// 転送が終わったローカルの圧縮ファイルは不要なので削除する
+		if keepArtifacts, _ := cmd.Flags().GetBool("keep-artifacts"); !keepArtifacts && !dryRun {
+			internal.RemoveLocalArtifacts(conf)
+		}
+
+		// リモートサーバーでコンテナを実行（既存コンテナは停止・退避してから）
+		if err := internal.RunRemoteContainer(ctx, conf, remote); err != nil {
 			fmt.Printf("\nコンテナの実行に失敗: %v\n", err)
+			abortDeploy(ctx, stop, conf, remote, releaseLock)
+			releaseLock()
+			return
+		}
+
+		if dryRun {
+			releaseLock()
+			fmt.Println("\ndry-run 完了: デプロイ履歴は記録されません")
 			return
 		}
 
-		// デプロイ履歴を記録（TOML形式）
-		if err := config.RecordDeployHistory(conf); err != nil {
+		// デプロイ履歴をリモートとローカルに記録（TOML形式）。記録が終わるまでロックは保持する
+		entry := newDeployEntry(ctx, conf, internal.BuildRunner(conf, local, remote), config.DeployStatusSuccess)
+		if err := internal.RecordDeploy(ctx, conf, remote, entry); err != nil {
 			fmt.Println("デプロイ履歴の記録に失敗:", err)
 		}
 
+		// keep_releases を超えた古いリリースを削除（失敗してもデプロイ自体は成功として扱う）
+		if conf.Deploy.KeepReleases > 0 {
+			if plan, err := internal.PruneReleases(ctx, conf, remote, conf.Deploy.KeepReleases, false); err != nil {
+				fmt.Println("警告: 古いリリースの削除に失敗:", err)
+			} else if !plan.Empty() {
+				fmt.Printf("古いリリースを削除しました（約 %.1f MB）\n", float64(plan.Bytes)/1024/1024)
+			}
+		}
+		releaseLock()
+
+		// keep_local_images を超えたローカルのビルド済みイメージを削除
+		if conf.Docker.KeepLocalImages > 0 && !remoteBuild {
+			if removed, err := internal.PruneLocalImages(ctx, conf, local, conf.Docker.KeepLocalImages, false); err != nil {
+				fmt.Println("警告: ローカルイメージの削除に失敗:", err)
+			} else if len(removed) > 0 {
+				fmt.Printf("古いローカルイメージを %d 件削除しました\n", len(removed))
+			}
+		}
+
+		// デプロイしたコミットにタグ・ノートで記録を残す（失敗してもデプロイ自体は成功として扱う）
+		if err := internal.AnnotateDeploy(ctx, conf, internal.NewLocalRunner(), entry); err != nil {
+			fmt.Println("警告:", err)
+		}
+
 		fmt.Println("デプロイ完了！")
 	},
 }
+
+// abortDeploy は Ctrl-C などで中断されたデプロイの後始末を行う
+// 中断以外の失敗では何もしない。releaseLock が指定されている（ロックを保持している）場合だけリモートも片付け、最後にロックを解除する
+func abortDeploy(ctx context.Context, stop context.CancelFunc, conf config.Config, remote internal.RemoteRunner, releaseLock func()) {
+	if ctx.Err() == nil {
+		return
+	}
+	// 後始末の最中に再度 Ctrl-C が押された場合は即座に終了させる
+	stop()
+
+	fmt.Println("\nデプロイが中断されました。後始末を実行します...")
+	// ロックを取得する前に中断された場合はリモートの圧縮ファイル・履歴には触れない
+	// （ロックを保持している別のデプロイが転送したファイルを消してしまうため）
+	if releaseLock == nil {
+		internal.RemoveLocalArtifacts(conf)
+		if err := config.RecordAbortedDeploy(conf); err != nil {
+			fmt.Println("デプロイ履歴の記録に失敗:", err)
+		}
+		exitDeploy(130)
+		return
+	}
+
+	cleanupCtx, cancel := internal.NewCleanupContext()
+	defer cancel()
+	internal.CleanupAbortedDeploy(cleanupCtx, conf, remote)
+	if err := internal.RecordDeploy(cleanupCtx, conf, remote, newDeployEntry(cleanupCtx, conf, internal.NewLocalRunner(), config.DeployStatusAborted)); err != nil {
+		fmt.Println("デプロイ履歴の記録に失敗:", err)
+	}
+	releaseLock()
+	exitDeploy(130)
+}
+
+// deployWorktree は sailor deploy --ref でビルドに使っている git worktree（--ref 未指定なら nil）
+var deployWorktree *internal.Worktree
+
+// deployForced は --force で無視したガード（履歴に記録する）
+var deployForced []string
+
+// exitDeploy は worktree を削除してから終了する
+func exitDeploy(code int) {
+	deployWorktree.Remove()
+	os.Exit(code)
+}
+
+// newDeployEntry は今回のデプロイの履歴エントリを作成し、--ref で指定した ref を記録する
+func newDeployEntry(ctx context.Context, conf config.Config, local internal.LocalRunner, status string) config.DeployHistoryEntry {
+	entry := internal.NewDeployEntry(ctx, conf, local, status)
+	if deployWorktree != nil {
+		entry.Ref = deployWorktree.Ref
+	}
+	entry.ForcedGuards = deployForced
+	return entry
+}
+
+func init() {
+	deployCmd.Flags().Bool("dry-run", false, "実行するコマンドを表示するだけで、実際には実行しない")
+	deployCmd.Flags().Bool("keep-artifacts", false, "転送後もローカルの .sailor/ に圧縮ファイルを残す")
+	deployCmd.Flags().StringSlice("force", nil, "満たされなかったガードを無視してデプロイする（個別に指定する場合は --force=unpushed,tag のように = で指定）")
+	deployCmd.Flags().Lookup("force").NoOptDefVal = internal.ForceAll
+	deployCmd.Flags().String("ref", "", "作業ツリーの代わりにデプロイするタグ・ブランチ・コミット（一時的な git worktree でビルド）")
+	deployCmd.Flags().Bool("no-cache", false, "キャッシュを使わずにイメージをビルドする（[docker] no_cache より優先）")
+}
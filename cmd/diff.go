@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+	"github.com/linkalls/sailor/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// diffHead は sailor diff で作業ツリーの HEAD と現在の設定を指定する名前
+const diffHead = "HEAD"
+
+// diffCmd は diff コマンドの実装
+var diffCmd = &cobra.Command{
+	Use:   "diff [from] [to]",
+	Short: "デプロイ間のコミット・ファイル・設定の差分を表示",
+	Long: "2つのデプロイ（履歴のバージョン、または HEAD）の間のコミット・変更されたファイル・設定の差分を表示します。" +
+		"未指定の場合は現在デプロイされているバージョンと HEAD を比較します。",
+	Args: cobra.MaximumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		conf := loadConfigOrExit()
+
+		ctx, stop := interruptContext()
+		defer stop()
+
+		// リモートの履歴を正とし、取得できなければローカルの履歴を使う
+		history, current, err := internal.LoadDeployHistory(ctx, conf, internal.NewRemoteRunner(conf))
+		if err != nil {
+			fmt.Println("警告: リモートの履歴を取得できないため、ローカルの履歴を使用します:", err)
+			if history, err = config.LoadHistory(config.HistoryPath); err != nil {
+				fmt.Println("デプロイ履歴の読み込みに失敗:", err)
+				os.Exit(1)
+			}
+		}
+
+		from, to := current, diffHead
+		if len(args) > 0 {
+			from = args[0]
+		}
+		if len(args) > 1 {
+			to = args[1]
+		}
+		if from == "" {
+			fmt.Println("現在デプロイされているバージョンが不明です。比較するバージョンを指定してください（sailor rollback --list で一覧を確認できます）")
+			os.Exit(1)
+		}
+
+		var entries []config.DeployHistoryEntry
+		for _, version := range []string{from, to} {
+			if version == diffHead {
+				entries = append(entries, headEntry(conf))
+				continue
+			}
+			entry, ok := history[version]
+			if !ok {
+				fmt.Printf("バージョン %s が履歴に見つかりません\n", version)
+				os.Exit(1)
+			}
+			entries = append(entries, entry)
+		}
+
+		if err := internal.ShowDiff(ctx, internal.NewLocalRunner(), entries[0], entries[1]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+// headEntry は HEAD を現在の設定でデプロイした場合の履歴エントリを返す
+// ビルドしていないためイメージは記録しない
+func headEntry(conf config.Config) config.DeployHistoryEntry {
+	if conf.Docker.UseCompose {
+		if _, err := internal.PrepareCompose(&conf); err != nil {
+			fmt.Println("警告: composeファイルの解析に失敗:", err)
+		}
+	}
+	entry := config.NewDeployHistoryEntry(conf, "")
+	entry.Version = diffHead
+	entry.Image = ""
+	if len(conf.Compose.Services) > 0 {
+		entry.ComposeInfo.ServiceName = strings.Join(conf.Compose.Services, ",")
+	}
+	return entry
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+	"github.com/linkalls/sailor/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// doctorCmd はデプロイ前提条件のチェックコマンド
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "デプロイに必要な環境が整っているかを確認",
+	Long:  "ローカルのDocker/Compose、Gitの状態、SSH接続、リモートのscp・一時ディレクトリ・Docker・ディスク容量を確認し、結果と対処方法を表示します。",
+	Run: func(cmd *cobra.Command, args []string) {
+		wd, err := os.Getwd()
+		if err != nil {
+			fmt.Println("カレントディレクトリの取得に失敗:", err)
+			os.Exit(1)
+		}
+		configPath := filepath.Join(wd, "config/config.toml")
+		conf, err := config.LoadConfig(configPath)
+		if err != nil {
+			fmt.Println("設定ファイルの読み込みに失敗:", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("環境をチェック中...")
+		internal.ResolveProjectName(cmd.Context(), &conf, internal.NewLocalRunner())
+		results := internal.RunDoctor(cmd.Context(), conf)
+
+		failed, warned := 0, 0
+		for _, r := range results {
+			fmt.Printf("[%s] %s: %s\n", strings.ToUpper(r.Status), r.Name, r.Message)
+			if r.Hint != "" {
+				fmt.Printf("       対処: %s\n", r.Hint)
+			}
+			switch r.Status {
+			case internal.CheckFail:
+				failed++
+			case internal.CheckWarn:
+				warned++
+			}
+		}
+
+		fmt.Printf("\n%d 件のチェック: 失敗 %d / 警告 %d\n", len(results), failed, warned)
+		if failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
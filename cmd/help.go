@@ -12,10 +12,15 @@ var helpCmd = &cobra.Command{
     Short: "コマンドの一覧や使い方を表示",
     Run: func(cmd *cobra.Command, args []string) {
         fmt.Println("Sailor コマンド一覧:")
-        fmt.Println("  init         - 設定ファイルの雛形を生成")
+        fmt.Println("  init         - 設定ファイルの雛形を生成 (init -i で対話形式)")
         fmt.Println("  deploy       - デプロイ処理を実行")
         fmt.Println("  rollback     - ロールバック処理を実行 (rollback --list で一覧表示)")
         fmt.Println("  config       - 現在の設定ファイルの内容を表示")
+        fmt.Println("  doctor       - デプロイに必要な環境をチェック")
+        fmt.Println("  lock status  - リモートのデプロイロックの状態を表示")
+        fmt.Println("  unlock       - デプロイロックを解除 (unlock --force で強制解除)")
+        fmt.Println("  prune        - リモートの古いイメージ・リリースを削除 (prune --dry-run で確認のみ)")
+        fmt.Println("  diff         - デプロイ間のコミット・ファイル・設定の差分を表示 (diff [from] [to])")
         fmt.Println("  help         - コマンドの使い方を表示")
     },
 }
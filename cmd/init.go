@@ -1,11 +1,15 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/linkalls/sailor/config"
+	"github.com/linkalls/sailor/internal"
 
 	"github.com/spf13/cobra"
 )
@@ -26,11 +30,27 @@ var initCmd = &cobra.Command{
 			fmt.Println("設定ファイルは既に存在します。")
 			return
 		}
-		if err := config.GenerateDefaultConfig("config/config.toml"); err != nil {
-			fmt.Println("設定ファイルの生成に失敗:", err)
-			os.Exit(1)
+
+		interactive, _ := cmd.Flags().GetBool("interactive")
+		if interactive {
+			// 対話形式で設定を作成
+			conf, ok := runInitWizard(cmd.Context(), &prompter{reader: bufio.NewReader(os.Stdin)})
+			if !ok {
+				fmt.Println("設定ファイルの生成を中止しました。")
+				return
+			}
+			if err := config.SaveConfig("config/config.toml", conf); err != nil {
+				fmt.Println("設定ファイルの生成に失敗:", err)
+				os.Exit(1)
+			}
+			fmt.Println("設定ファイルを生成しました: config/config.toml")
+		} else {
+			if err := config.GenerateDefaultConfig("config/config.toml"); err != nil {
+				fmt.Println("設定ファイルの生成に失敗:", err)
+				os.Exit(1)
+			}
+			fmt.Println("デフォルトの設定ファイルを生成しました: config/config.toml")
 		}
-		fmt.Println("デフォルトの設定ファイルを生成しました: config/config.toml")
 
 		// Dockerfileの生成（存在しない場合のみ）
 		if _, err := os.Stat("Dockerfile"); os.IsNotExist(err) {
@@ -42,3 +62,81 @@ var initCmd = &cobra.Command{
 		}
 	},
 }
+
+// runInitWizard は対話形式で設定項目を入力させ、接続確認まで行う関数
+func runInitWizard(ctx context.Context, p *prompter) (config.Config, bool) {
+	var conf config.Config
+
+	fmt.Println("=== SSH接続の設定 ===")
+	conf.SSH.Host = p.ask("ホスト名", "")
+	conf.SSH.User = p.ask("ユーザー名", "deploy")
+	for {
+		port, err := strconv.Atoi(p.ask("ポート", "22"))
+		if err == nil && port > 0 {
+			conf.SSH.Port = port
+			break
+		}
+		fmt.Println("ポート番号は正の整数で入力してください。")
+	}
+	conf.SSH.AuthMethod = p.choose("認証方式", []string{"agent", "key", "password"}, "agent")
+	switch conf.SSH.AuthMethod {
+	case "key":
+		conf.SSH.PrivateKeyPath = p.ask("秘密鍵のパス", "~/.ssh/id_ed25519")
+	case "password":
+		conf.SSH.Password = p.askPassword("パスワード")
+	}
+
+	fmt.Println("\n=== Dockerの設定 ===")
+	conf.Docker.UseCompose = p.choose("デプロイ方式", []string{"compose", "dockerfile"}, "dockerfile") == "compose"
+	if conf.Docker.UseCompose {
+		conf.Docker.ComposeFile = p.ask("composeファイルのパス", "docker-compose.yml")
+		conf.Docker.ServiceName = p.ask("対象のサービス名", "app")
+		conf.Docker.ComposeEnvFile = p.ask("環境変数ファイル (不要なら空欄)", "")
+		conf.Compose.EnvFiles = p.askList("転送する環境変数ファイル", nil)
+		conf.Compose.ExtraFiles = p.askList("追加で転送するファイル", nil)
+	} else {
+		conf.Docker.Dockerfile = p.ask("Dockerfileのパス", "Dockerfile")
+		conf.Docker.Context = p.ask("ビルドコンテキスト", "./")
+		conf.Docker.ImageName = p.ask("イメージ名", currentDirName())
+		conf.Docker.Tag = "latest"
+		conf.Remote.ContainerName = p.ask("コンテナ名", conf.Docker.ImageName+"_container")
+		conf.Remote.Ports = p.askList("ポートマッピング", []string{"80:80"})
+		conf.Remote.Volumes = p.askList("ボリュームマウント", nil)
+	}
+
+	fmt.Println("\n=== デプロイの設定 ===")
+	conf.Deploy.TriggerBranch = p.ask("デプロイを許可するブランチ", "main")
+	conf.Deploy.CompressedFile = "deploy.tar.gz"
+	conf.Deploy.RemoteTempDir = p.ask("リモートの一時ディレクトリ", "~/tmp")
+
+	// 保存前にリモートへの接続とDockerの有無を確認
+	fmt.Println("\nSSH接続を確認中...")
+	if err := internal.CheckSSHConnection(ctx, conf); err != nil {
+		fmt.Println("SSH接続の確認に失敗:", err)
+		return conf, p.confirm("このまま設定を保存しますか？", false)
+	}
+	fmt.Println("SSH接続: OK")
+
+	fmt.Println("リモートのDockerを確認中...")
+	version, err := internal.CheckRemoteDocker(ctx, conf)
+	if err != nil {
+		fmt.Println(err)
+		return conf, p.confirm("このまま設定を保存しますか？", false)
+	}
+	fmt.Printf("リモートのDocker: OK (バージョン %s)\n", version)
+
+	return conf, true
+}
+
+// currentDirName はカレントディレクトリ名を返す。イメージ名のデフォルト値に使う
+func currentDirName() string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "app"
+	}
+	return filepath.Base(wd)
+}
+
+func init() {
+	initCmd.Flags().BoolP("interactive", "i", false, "対話形式で設定ファイルを作成")
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/linkalls/sailor/config"
+	"github.com/linkalls/sailor/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// lockCmd は lock コマンドの実装
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "リモートのデプロイロックを操作",
+}
+
+// lockStatusCmd は lock status コマンドの実装
+var lockStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "デプロイロックの状態を表示",
+	Run: func(cmd *cobra.Command, args []string) {
+		conf := loadConfigOrExit()
+		ttl, err := internal.LockTTL(conf)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		info, err := internal.ReadDeployLock(cmd.Context(), conf, internal.NewRemoteRunner(conf))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if info == nil {
+			fmt.Println("デプロイロックは取得されていません")
+			return
+		}
+
+		fmt.Println("デプロイロック:", info)
+		if info.IsStale(ttl, time.Now()) {
+			fmt.Printf("このロックは lock_ttl (%s) を過ぎています。次のデプロイで自動的に解除されます\n", ttl)
+		}
+	},
+}
+
+// unlockCmd は unlock コマンドの実装
+var unlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "デプロイロックを解除",
+	Long:  "自分が取得したロックや古いロックを解除します。他のユーザーが保持しているロックを解除するには --force を指定します。",
+	Run: func(cmd *cobra.Command, args []string) {
+		conf := loadConfigOrExit()
+		ttl, err := internal.LockTTL(conf)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		ctx := cmd.Context()
+		remote := internal.NewRemoteRunner(conf)
+		info, err := internal.ReadDeployLock(ctx, conf, remote)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if info == nil {
+			fmt.Println("デプロイロックは取得されていません")
+			return
+		}
+
+		force, _ := cmd.Flags().GetBool("force")
+		if !force && !info.OwnedBy(internal.NewLockInfo("")) && !info.IsStale(ttl, time.Now()) {
+			fmt.Println("他のユーザーが保持しているロックです:", info)
+			fmt.Println("デプロイが実行中でないことを確認してから --force を指定してください")
+			os.Exit(1)
+		}
+
+		if err := internal.ReleaseDeployLock(ctx, conf, remote); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("デプロイロックを解除しました:", info)
+	},
+}
+
+// loadConfigOrExit はカレントディレクトリの設定ファイルを読み込み、失敗した場合は終了する
+func loadConfigOrExit() config.Config {
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Println("カレントディレクトリの取得に失敗:", err)
+		os.Exit(1)
+	}
+	conf, err := config.LoadConfig(filepath.Join(wd, "config/config.toml"))
+	if err != nil {
+		fmt.Println("設定ファイルの読み込みに失敗:", err)
+		os.Exit(1)
+	}
+	// 状態ディレクトリ・ロックの場所をデプロイと揃えるため、compose のプロジェクト名を同じ規則で決める
+	internal.ResolveProjectName(context.Background(), &conf, internal.NewLocalRunner())
+	return conf
+}
+
+func init() {
+	lockCmd.AddCommand(lockStatusCmd)
+	unlockCmd.Flags().Bool("force", false, "他のユーザーが保持しているロックも強制的に解除する")
+}
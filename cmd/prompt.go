@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// prompter は対話的な入力を受け付けるためのヘルパー
+type prompter struct {
+	reader *bufio.Reader
+}
+
+// ask は質問を表示して入力を受け付ける。未入力の場合はデフォルト値を返す
+func (p *prompter) ask(label, defaultValue string) string {
+	if defaultValue != "" {
+		fmt.Printf("%s [%s]: ", label, defaultValue)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+	line, _ := p.reader.ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return defaultValue
+	}
+	return line
+}
+
+// askPassword は入力内容を画面に表示せずにパスワードを受け付ける
+// 標準入力が端末でない場合（パイプなど）は通常の入力として読み込む
+func (p *prompter) askPassword(label string) string {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return p.ask(label, "")
+	}
+	fmt.Printf("%s: ", label)
+	password, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return ""
+	}
+	return string(password)
+}
+
+// choose は選択肢の中から1つを選ばせる。選択肢外の入力は再入力を求める
+func (p *prompter) choose(label string, choices []string, defaultValue string) string {
+	for {
+		answer := p.ask(fmt.Sprintf("%s (%s)", label, strings.Join(choices, "/")), defaultValue)
+		for _, c := range choices {
+			if answer == c {
+				return answer
+			}
+		}
+		fmt.Println("選択肢の中から入力してください。")
+	}
+}
+
+// confirm は y/n の確認を行う
+func (p *prompter) confirm(label string, defaultYes bool) bool {
+	defaultValue := "n"
+	if defaultYes {
+		defaultValue = "y"
+	}
+	answer := strings.ToLower(p.ask(label+" (y/n)", defaultValue))
+	return answer == "y" || answer == "yes"
+}
+
+// askList はカンマ区切りの入力をリストとして受け付ける
+func (p *prompter) askList(label string, defaultValues []string) []string {
+	answer := p.ask(label+" (カンマ区切り)", strings.Join(defaultValues, ","))
+	var result []string
+	for _, v := range strings.Split(answer, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/linkalls/sailor/internal"
+
+	"github.com/spf13/cobra"
+)
+
+// pruneCmd は prune コマンドの実装
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "リモートの古いイメージ・リリースを削除",
+	Long: "直近 keep_releases 件の成功したデプロイ・現在のバージョン・pinned_versions を残し、" +
+		"それより古いリモートのイメージ・リリースディレクトリと圧縮ファイルを削除します。",
+	Run: func(cmd *cobra.Command, args []string) {
+		conf := loadConfigOrExit()
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		keep := conf.Deploy.KeepReleases
+		if cmd.Flags().Changed("keep") {
+			keep, _ = cmd.Flags().GetInt("keep")
+		}
+		if keep < 1 {
+			fmt.Println("残すリリース数を [deploy] keep_releases か --keep で1以上に指定してください")
+			os.Exit(1)
+		}
+
+		ctx, stop := interruptContext()
+		defer stop()
+		remote := internal.NewRemoteRunner(conf)
+
+		// 削除中にデプロイ・ロールバックが重ならないようロックを取得する
+		if !dryRun {
+			commit, _ := internal.NewLocalRunner().Output(ctx, "git", "rev-parse", "--short", "HEAD")
+			lockInfo := internal.NewLockInfo(commit)
+			if err := internal.AcquireDeployLock(ctx, conf, remote, lockInfo); err != nil {
+				fmt.Println("削除を中止:", err)
+				if errors.Is(err, internal.ErrDeployLocked) {
+					fmt.Println("ロックの状態は sailor lock status で確認できます（強制解除: sailor unlock --force）")
+				}
+				os.Exit(1)
+			}
+			defer func() {
+				cleanupCtx, cancel := internal.NewCleanupContext()
+				defer cancel()
+				if err := internal.ReleaseOwnDeployLock(cleanupCtx, conf, remote, lockInfo); err != nil {
+					fmt.Println("警告:", err)
+				}
+			}()
+		}
+
+		// keep_local_images が設定されていればローカルのビルド済みイメージも削除する
+		if conf.Docker.KeepLocalImages > 0 {
+			removed, err := internal.PruneLocalImages(ctx, conf, internal.NewLocalRunner(), conf.Docker.KeepLocalImages, dryRun)
+			if err != nil {
+				fmt.Println("警告: ローカルイメージの削除に失敗:", err)
+			}
+			for _, image := range removed {
+				fmt.Println("  ローカルイメージ:", image)
+			}
+		}
+
+		plan, err := internal.PruneReleases(ctx, conf, remote, keep, dryRun)
+		if err != nil {
+			fmt.Println("削除に失敗:", err)
+			return
+		}
+		if plan.Empty() {
+			fmt.Println("削除するリリースはありません")
+			return
+		}
+		if dryRun {
+			fmt.Printf("直近 %d 件を残して以下を削除します（dry-run のため削除していません）:\n", keep)
+		} else {
+			fmt.Printf("直近 %d 件を残して以下を削除しました:\n", keep)
+		}
+		plan.Print()
+	},
+}
+
+func init() {
+	pruneCmd.Flags().Bool("dry-run", false, "削除対象と解放される容量を表示するだけで、実際には削除しない")
+	pruneCmd.Flags().Int("keep", 0, "残すリリース数（未指定なら [deploy] keep_releases）")
+}
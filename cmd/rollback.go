@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -30,23 +31,39 @@ var rollbackCmd = &cobra.Command{
 			fmt.Println("設定ファイルの読み込みに失敗:", err)
 			os.Exit(1)
 		}
+		if err := internal.ValidateContainers(conf); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// Ctrl-C / SIGTERM で実行中の処理を中断できるようにする
+		// (中断時は RollbackToVersion が旧コンテナの復元を行う)
+		ctx, stop := interruptContext()
+		defer stop()
+
+		// 状態ディレクトリ・ロックの場所をデプロイと揃えるため、compose のプロジェクト名を同じ規則で決める
+		internal.ResolveProjectName(ctx, &conf, internal.NewLocalRunner())
+
+		// リモートの履歴を正とし、ローカルの履歴と統合して使う（dry-run時も読み込みは行う）
+		history, current, err := internal.LoadDeployHistory(ctx, conf, internal.NewRemoteRunner(conf))
+		if err != nil {
+			fmt.Println("警告: リモートの履歴を取得できないため、ローカルの履歴を使用します:", err)
+			if history, err = config.LoadHistory(config.HistoryPath); err != nil {
+				fmt.Println("デプロイ履歴の読み込みに失敗:", err)
+				return
+			}
+		}
 
 // --list オプションで履歴一覧を表示
 list, _ := cmd.Flags().GetBool("list")
 if list {
-if _, err := config.ShowDeployHistory(); err != nil {
-fmt.Println("デプロイ履歴の表示に失敗:", err)
-}
+config.PrintDeployHistory(history, current)
 return
 }
 
 // バージョン識別子が未指定なら対話的に選択
 if len(args) < 1 {
-versions, err := config.ShowDeployHistory()
-if err != nil {
-fmt.Println("デプロイ履歴の表示に失敗:", err)
-return
-}
+versions := config.PrintDeployHistory(history, current)
 
 if len(versions) == 0 {
 fmt.Println("ロールバック可能なバージョンがありません。")
@@ -75,15 +92,69 @@ return
 args = []string{input}
 }
 		version := args[0]
+
+		// dry-run時はコマンドを記録するだけ
+		remote := internal.NewRemoteRunner(conf)
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		if dryRun {
+			remote = internal.NewDryRunRecorder().Remote()
+			fmt.Println("dry-run モード: 以下のコマンドは実行されません")
+		}
+
+		// リモートで使う compose コマンド (docker compose / docker-compose) を決定
+		if conf.Docker.UseCompose {
+			if err := internal.ResolveComposeCommands(ctx, &conf, internal.NewLocalRunner(), remote); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		// 中断時の終了コードはロックを解除してから返す
+		exitCode := 0
+		defer func() {
+			if exitCode != 0 {
+				os.Exit(exitCode)
+			}
+		}()
+
+		// デプロイと同じロックを取得し、実行中のデプロイとコンテナの入れ替えが重ならないようにする
+		commit, _ := internal.NewLocalRunner().Output(ctx, "git", "rev-parse", "--short", "HEAD")
+		lockInfo := internal.NewLockInfo(commit)
+		if err := internal.AcquireDeployLock(ctx, conf, remote, lockInfo); err != nil {
+			fmt.Println("ロールバックを中止:", err)
+			if errors.Is(err, internal.ErrDeployLocked) {
+				fmt.Println("ロックの状態は sailor lock status で確認できます（強制解除: sailor unlock --force）")
+			}
+			return
+		}
+		defer func() {
+			cleanupCtx, cancel := internal.NewCleanupContext()
+			defer cancel()
+			if err := internal.ReleaseOwnDeployLock(cleanupCtx, conf, remote, lockInfo); err != nil {
+				fmt.Println("警告:", err)
+			}
+		}()
+
 		fmt.Printf("バージョン %s へのロールバックを実行中...\n", version)
-		if err := internal.RollbackToVersion(conf, version); err != nil {
+		if err := internal.RollbackToVersion(ctx, conf, history, version, remote); err != nil {
 			fmt.Println("ロールバックに失敗:", err)
+			if ctx.Err() != nil {
+				exitCode = 130
+			}
 			return
 		}
+		if dryRun {
+			fmt.Println("dry-run 完了")
+			return
+		}
+		if err := internal.SetCurrentVersion(ctx, conf, remote, version); err != nil {
+			fmt.Println("警告:", err)
+		}
 		fmt.Println("ロールバック完了！")
 	},
 }
 
 func init() {
 	rollbackCmd.Flags().BoolP("list", "l", false, "ロールバック可能なバージョンの一覧を表示")
+	rollbackCmd.Flags().Bool("dry-run", false, "実行するコマンドを表示するだけで、実際には実行しない")
 }
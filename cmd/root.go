@@ -22,5 +22,10 @@ func init() {
     rootCmd.AddCommand(rollbackCmd)
     rootCmd.AddCommand(initCmd)
     rootCmd.AddCommand(configCmd)
+    rootCmd.AddCommand(doctorCmd)
+    rootCmd.AddCommand(lockCmd)
+    rootCmd.AddCommand(unlockCmd)
+    rootCmd.AddCommand(pruneCmd)
+    rootCmd.AddCommand(diffCmd)
     rootCmd.AddCommand(helpCmd)
 }
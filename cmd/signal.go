@@ -0,0 +1,14 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interruptContext は Ctrl-C (SIGINT) / SIGTERM を受け取るとキャンセルされるコンテキストを返す
+// 返される関数を呼ぶとシグナルの捕捉をやめ、以降の Ctrl-C で即座に終了するようになる
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
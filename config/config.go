@@ -1,6 +1,8 @@
 package config
 
 import (
+"crypto/sha256"
+"encoding/hex"
 "fmt"
 "os"
 "os/exec"
@@ -20,32 +22,80 @@ User           string `toml:"user"`
 Port           int    `toml:"port"`
 PrivateKeyPath string `toml:"private_key_path"`
 Password       string `toml:"password"`
+AuthMethod     string `toml:"auth_method"`      // 認証方式 (agent / key / password)。空なら従来通り自動判定
+KnownHostsPath string `toml:"known_hosts_path"` // ホストキー検証に使う known_hosts のパス
 } `toml:"ssh"`
 Docker struct {
 Dockerfile     string `toml:"dockerfile"`
 ImageName      string `toml:"image_name"`
 Tag           string `toml:"tag"`
+TagTemplate   string `toml:"tag_template"` // デプロイするイメージのタグ ({{.Commit}} {{.Branch}} {{.Timestamp}} {{.Version}})。未指定なら {{.Timestamp}}
 Context       string `toml:"context"`
 UseCompose    bool   `toml:"use_compose"`    // Docker Compose使用フラグ
 ComposeFile   string `toml:"compose_file"`   // docker-compose.ymlのパス
 ServiceName   string `toml:"service_name"`   // 対象のサービス名
 ComposeEnvFile string `toml:"compose_env_file"` // 環境変数ファイル
+ComposeCommand string `toml:"compose_command"` // "docker compose" または "docker-compose"。空なら自動検出
+KeepLocalImages int   `toml:"keep_local_images"` // ローカルに残す sailor がビルドしたイメージの数（0 なら削除しない）
+NoCache       bool              `toml:"no_cache"`   // キャッシュを使わずにビルドする
+BuildArgs     map[string]string `toml:"build_args"` // --build-arg に渡す値（${VAR} で環境変数を展開）
+Target        string            `toml:"target"`     // マルチステージビルドの対象ステージ
+Labels        map[string]string `toml:"labels"`     // イメージに付けるラベル
+Secrets       []string          `toml:"secrets"`    // BuildKit の --secret (例: "id=npmrc,src=.npmrc")
+SSH           []string          `toml:"ssh"`        // BuildKit の --ssh (例: "default")
+Platform      string            `toml:"platform"`   // ビルドするプラットフォーム (例: "linux/arm64")。空ならリモートから自動検出
 } `toml:"docker"`
 Remote struct {
 ContainerName string            `toml:"container_name"`
 Ports         []string          `toml:"ports"`
 Environment   map[string]string `toml:"environment"`
 Volumes       []string          `toml:"volumes"`
+ComposeCommand string           `toml:"compose_command"` // リモートだけ別の compose コマンドを使う場合に指定
+AppDir        string            `toml:"app_dir"`         // compose のリリースを配置するディレクトリ（releases/<リリース名> と current を作成）
+Release       string            `toml:"-"`               // 今回のデプロイのリリース名（デプロイ時に決定する。設定ファイルでは指定しない）
+Restart       string            `toml:"restart"`         // 再起動ポリシー (例: unless-stopped)
+Networks      []string          `toml:"networks"`        // 接続するネットワーク（先頭以外は起動後に接続）
+Memory        string            `toml:"memory"`          // メモリ上限 (例: 512m)
+CPUs          string            `toml:"cpus"`            // CPU 上限 (例: 1.5)
+User          string            `toml:"user"`            // コンテナを実行するユーザー (例: 1000:1000)
+Labels        map[string]string `toml:"labels"`
+LogDriver     string            `toml:"log_driver"`
+LogOptions    map[string]string `toml:"log_options"`
+ExtraHosts    []string          `toml:"extra_hosts"`     // "host:ip" 形式
+Devices       []string          `toml:"devices"`         // "/dev/ttyUSB0:/dev/ttyUSB0" 形式
+Command       string            `toml:"command"`         // イメージの CMD を上書きする
+Entrypoint    string            `toml:"entrypoint"`      // イメージの ENTRYPOINT を上書きする
+Containers    []RemoteContainer `toml:"containers"`      // 同じイメージから起動する複数のコンテナ（指定時は container_name の代わりに起動する）
+Healthcheck   struct {
+Cmd         string `toml:"cmd"`
+Interval    string `toml:"interval"`
+Timeout     string `toml:"timeout"`
+Retries     int    `toml:"retries"`
+StartPeriod string `toml:"start_period"`
+} `toml:"healthcheck"`
 } `toml:"remote"`
 Deploy struct {
 TriggerBranch  string `toml:"trigger_branch"`
 CompressedFile string `toml:"compressed_file"`
 RemoteTempDir  string `toml:"remote_temp_dir"`
+StateDir       string `toml:"state_dir"` // リモートでロックや状態を保存するディレクトリ (デフォルト: ~/.sailor)
+LockTTL        string `toml:"lock_ttl"`  // この時間を過ぎたデプロイロックを古いとみなす (デフォルト: 30m)
+KeepReleases   int      `toml:"keep_releases"`   // リモートに残す直近のリリース数（0 なら自動で削除しない）
+PinnedVersions []string `toml:"pinned_versions"` // keep_releases に関係なく削除しないバージョン
+Build          string   `toml:"build"`           // イメージをビルドする場所: "local"（デフォルト）または "remote"
+AllowedBranches []string `toml:"allowed_branches"`  // デプロイを許可するブランチ（"release/*" などのパターン可）。未指定なら trigger_branch のみ
+RequirePushed   bool     `toml:"require_pushed"`    // HEAD が追跡ブランチにプッシュ済みであることを必須にする
+RequireUpToDate bool     `toml:"require_up_to_date"` // ブランチが origin より遅れていないことを必須にする
+RequireTag      bool     `toml:"require_tag"`       // HEAD にタグが付いていることを必須にする
+Annotate        string   `toml:"annotate"`          // デプロイ成功後にコミットへ記録する方法: "tag"（deploy/<環境>/<バージョン>）または "note"
+AnnotateRemote  string   `toml:"annotate_remote"`   // タグ・ノートをプッシュするリモート (デフォルト: origin)
 } `toml:"deploy"`
 Compose struct {
 EnvFiles    []string `toml:"env_files"`    // 環境変数ファイル群
 ExtraFiles  []string `toml:"extra_files"`  // 追加で転送が必要なファイル
 TargetEnv   string   `toml:"target_env"`   // ビルド/デプロイ時の環境指定
+Services    []string `toml:"services"`     // デプロイするサービス群（未指定なら service_name、それも無ければ build: を持つ全サービス）
+ProjectName string   `toml:"project_name"` // compose のプロジェクト名（未指定なら compose ファイルの name:、それも無ければリポジトリ名）
 } `toml:"compose"`
 }
 
@@ -68,6 +118,8 @@ defaultConfig := `
 host = "example.com"
 user = "deploy"
 port = 22
+# auth_method = "agent"      # agent / key / password (未指定なら設定内容から判定)
+# known_hosts_path = "~/.ssh/known_hosts"
 # private_key_path = "/path/to/private/key"
 password = "your_password"  # パスワード認証を使う場合はこちら
 
@@ -76,23 +128,68 @@ use_compose = false        # Docker Compose使用フラグ
 compose_file = "docker-compose.yml"
 service_name = "app"      # 対象のサービス名
 compose_env_file = ".env" # 環境変数ファイル
+# compose_command = "docker compose"  # 未指定なら docker compose / docker-compose を自動検出
+# keep_local_images = 3   # デプロイ成功後、ローカルに残すビルド済みイメージの数
+# no_cache = false         # キャッシュを使わずにビルドする（sailor deploy --no-cache でも指定可能）
+# build_args = { APP_VERSION = "${SAILOR_TAG}", NPM_TOKEN = "${NPM_TOKEN}" }
+# target = "production"
+# labels = { "org.example.team" = "web" }
+# secrets = ["id=npmrc,src=.npmrc"]
+# ssh = ["default"]
+# platform = "linux/arm64" # 未指定ならリモートの uname -m から検出し、ローカルと異なれば buildx でビルド
 
 # Docker Compose未使用時の設定
 dockerfile = "Dockerfile"
 image_name = "myapp"
 context = "./"
 tag = "latest"
+# tag_template = "{{.Branch}}-{{.Commit}}"  # デプロイするイメージのタグ（未指定なら {{.Timestamp}}）
 
 [remote]
 container_name = "myapp_container"
 ports = ["80:80"]
 environment = { DATABASE_URL = "your_database_url", API_KEY = "your_api_key" }
 volumes = ["/data:/app/data"]
+# app_dir = "~/apps/myapp"  # compose のリリースを releases/<リリース名> に配置し current で切り替える
+# restart = "unless-stopped"
+# networks = ["backend"]
+# memory = "512m"
+# cpus = "1.5"
+# user = "1000:1000"
+# labels = { team = "web" }
+# log_driver = "json-file"
+# log_options = { max-size = "10m", max-file = "3" }
+# extra_hosts = ["db.internal:10.0.0.5"]
+# devices = ["/dev/ttyUSB0:/dev/ttyUSB0"]
+# command = "bundle exec puma"
+# entrypoint = "/docker-entrypoint.sh"
+# healthcheck = { cmd = "curl -f http://localhost/health", interval = "30s", timeout = "5s", retries = 3 }
+
+# 同じイメージから複数のコンテナを起動する場合（記述順に起動）
+# [[remote.containers]]
+# name = "myapp_web"
+# ports = ["80:80"]
+#
+# [[remote.containers]]
+# name = "myapp_worker"
+# command = "bundle exec sidekiq"
+# replicas = 2
 
 [deploy]
 trigger_branch = "main"
 compressed_file = "deploy.tar.gz"
 remote_temp_dir = "~/tmp"
+# state_dir = "~/.sailor"   # デプロイロックなどを保存するリモートのディレクトリ
+# lock_ttl = "30m"          # この時間を過ぎたロックは古いものとして扱う
+# keep_releases = 5         # デプロイ成功後、直近5件より古いリモートのイメージ・リリースを削除する
+# pinned_versions = ["1700000000"]  # 削除しないバージョン
+# build = "remote"          # ソースを転送してリモートサーバーでビルドする（デフォルト: "local"）
+# allowed_branches = ["main", "release/*"]  # デプロイを許可するブランチ（未指定なら trigger_branch のみ）
+# require_pushed = true     # プッシュされていないコミットはデプロイしない
+# require_up_to_date = true # origin より遅れているブランチからはデプロイしない
+# require_tag = false       # タグが付いていないコミットはデプロイしない
+# annotate = "tag"          # デプロイ成功後に deploy/production/<バージョン> タグ（"note" なら git note）を作成してプッシュする
+# annotate_remote = "origin"
 
 [compose]
 env_files = [".env", ".env.prod"]  # 環境変数ファイル群
@@ -101,9 +198,11 @@ extra_files = [                    # 追加で転送が必要なファイル
     "mysql/init.sql"
 ]
 target_env = "production"          # ビルド/デプロイ時の環境指定
+# services = ["web", "worker"]     # 複数のサービスをデプロイする場合（service_name より優先）
+# project_name = "myapp"         # compose のプロジェクト名（未指定なら name:、それも無ければリポジトリ名）
 `
 // configディレクトリを作成
-if err := os.MkdirAll("config", 0755); err != nil {
+if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 return fmt.Errorf("configディレクトリの作成に失敗: %w", err)
 }
 
@@ -117,22 +216,116 @@ _, err = file.WriteString(defaultConfig)
 return err
 }
 
+// SaveConfig は設定内容を TOML 形式でファイルに書き出す関数
+// SSH のパスワードを含むことがあるため、所有者だけが読み書きできるファイルとして作成する
+func SaveConfig(path string, conf Config) error {
+if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+return fmt.Errorf("configディレクトリの作成に失敗: %w", err)
+}
+
+file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+if err != nil {
+return fmt.Errorf("設定ファイルの作成に失敗: %w", err)
+}
+defer file.Close()
+
+return toml.NewEncoder(file).Encode(conf)
+}
+
+// デプロイ履歴エントリの状態
+const (
+DeployStatusSuccess = "success" // 正常に完了したデプロイ（旧形式の履歴では空）
+DeployStatusAborted = "aborted" // Ctrl-C などで中断されたデプロイ
+)
+
 // DeployHistoryEntry はデプロイ履歴のエントリ
 type DeployHistoryEntry struct {
 Version       string    `toml:"version"`
+Status        string    `toml:"status,omitempty"`
 CommitHash    string    `toml:"commit_hash"`
 CommitMessage string    `toml:"commit_message"`
 Image         string    `toml:"image"`
 Timestamp     time.Time `toml:"timestamp"`
 TimestampTag  string    `toml:"timestamp_tag"`
+Ref           string    `toml:"ref,omitempty"`     // sailor deploy --ref で指定した ref
+ForcedGuards  []string  `toml:"forced_guards,omitempty"` // --force で無視したガード
+Settings      DeploySettings `toml:"settings,omitempty"` // sailor diff で比較するデプロイ時の設定
+Release       string    `toml:"release,omitempty"` // app_dir 使用時のリリースディレクトリ (例: releases/20240101000000)
+Pruned        bool      `toml:"pruned,omitempty"`  // sailor prune でリモートのイメージを削除済み
 ComposeInfo   struct {
 ServiceName string            `toml:"service_name,omitempty"`
 EnvFiles    []string         `toml:"env_files,omitempty"`
 ExtraFiles  []string         `toml:"extra_files,omitempty"`
 Config      map[string]any   `toml:"config,omitempty"`
+Services    map[string]ComposeServiceImage `toml:"services,omitempty"` // サービスごとにデプロイしたイメージ
 } `toml:"compose_info,omitempty"`
 }
 
+// RemoteContainer は単一コンテナモードで同じイメージから起動するコンテナの1つ
+// ports / environment / volumes 以外の実行オプションは [remote] の設定を共有する
+type RemoteContainer struct {
+Name        string            `toml:"name"`
+Command     string            `toml:"command"`     // 未指定なら [remote] command、それも無ければイメージの CMD
+Ports       []string          `toml:"ports"`
+Environment map[string]string `toml:"environment"` // [remote] environment に追加・上書きする
+Volumes     []string          `toml:"volumes"`     // [remote] volumes に追加する
+Replicas    int               `toml:"replicas"`    // 2以上なら name-1, name-2... として起動する（ports にホスト側のポートは指定できない）
+}
+
+// DeploySettings はデプロイ時のコンテナの設定と転送したファイル
+// 環境変数の値やファイルの内容は秘密情報を含むため、SHA-256 の先頭12文字だけを記録する
+type DeploySettings struct {
+Environment map[string]string `toml:"environment,omitempty"` // 環境変数名 → 値のハッシュ
+Ports       []string          `toml:"ports,omitempty"`
+Volumes     []string          `toml:"volumes,omitempty"`
+Files       map[string]string `toml:"files,omitempty"` // compose ファイル・環境変数ファイル・追加ファイル → 内容のハッシュ
+}
+
+// Empty は設定が記録されていない（古い履歴の）場合に true を返す
+func (s DeploySettings) Empty() bool {
+return len(s.Environment) == 0 && len(s.Ports) == 0 && len(s.Volumes) == 0 && len(s.Files) == 0
+}
+
+// settingHash は値の SHA-256 の先頭12文字を返す
+func settingHash(value []byte) string {
+sum := sha256.Sum256(value)
+return hex.EncodeToString(sum[:])[:12]
+}
+
+// NewDeploySettings は現在の設定と転送するファイルからデプロイ時の設定を作成する関数
+func NewDeploySettings(conf Config) DeploySettings {
+settings := DeploySettings{
+Ports:   conf.Remote.Ports,
+Volumes: conf.Remote.Volumes,
+}
+if len(conf.Remote.Environment) > 0 {
+settings.Environment = make(map[string]string, len(conf.Remote.Environment))
+for key, value := range conf.Remote.Environment {
+settings.Environment[key] = settingHash([]byte(value))
+}
+}
+if conf.Docker.UseCompose {
+files := append([]string{conf.Docker.ComposeFile}, conf.Compose.EnvFiles...)
+if conf.Docker.ComposeEnvFile != "" {
+files = append(files, conf.Docker.ComposeEnvFile)
+}
+files = append(files, conf.Compose.ExtraFiles...)
+settings.Files = make(map[string]string, len(files))
+for _, file := range files {
+if content, err := os.ReadFile(file); err == nil {
+settings.Files[file] = settingHash(content)
+}
+}
+}
+return settings
+}
+
+// ComposeServiceImage は compose のサービスにデプロイしたイメージ
+type ComposeServiceImage struct {
+Image   string `toml:"image"`              // イメージのタグ付き参照 (例: web_web:20240101000000)
+ImageID string `toml:"image_id,omitempty"` // ビルド時のイメージID
+}
+
 // History はバージョン識別子をキーとしたデプロイ履歴のマップ
 type History map[string]DeployHistoryEntry
 
@@ -149,13 +342,61 @@ return nil, err
 return history, nil
 }
 
+// HistoryPath はローカルのデプロイ履歴ファイルのパス
+// sailor deploy --ref では worktree に移動する前に作業ツリーの絶対パスに置き換える
+var HistoryPath = "config/history.toml"
+
+// SaveHistory は履歴を TOML ファイルに書き出す関数
+func SaveHistory(path string, history History) error {
+if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+return err
+}
+file, err := os.Create(path)
+if err != nil {
+return err
+}
+defer file.Close()
+
+enc := toml.NewEncoder(file)
+return enc.Encode(history)
+}
+
+// MergeHistory は2つの履歴を統合した新しい履歴を返す関数
+// 同じバージョンのエントリが両方にある場合は override の内容を優先する
+func MergeHistory(base, override History) History {
+merged := make(History, len(base)+len(override))
+for version, entry := range base {
+merged[version] = entry
+}
+for version, entry := range override {
+merged[version] = entry
+}
+return merged
+}
+
 // RecordDeployHistory は新たなデプロイ履歴エントリを記録する関数
 func RecordDeployHistory(conf Config) error {
-historyPath := "config/history.toml"
-history, err := LoadHistory(historyPath)
+return recordDeployHistory(conf, DeployStatusSuccess)
+}
+
+// RecordAbortedDeploy は中断されたデプロイを履歴に記録する関数
+func RecordAbortedDeploy(conf Config) error {
+return recordDeployHistory(conf, DeployStatusAborted)
+}
+
+// recordDeployHistory は指定した状態でデプロイ履歴エントリを記録する関数
+func recordDeployHistory(conf Config, status string) error {
+history, err := LoadHistory(HistoryPath)
 if err != nil {
 return err
 }
+entry := NewDeployHistoryEntry(conf, status)
+history[entry.Version] = entry
+return SaveHistory(HistoryPath, history)
+}
+
+// NewDeployHistoryEntry は現在の設定と Git の状態からデプロイ履歴エントリを作成する関数
+func NewDeployHistoryEntry(conf Config, status string) DeployHistoryEntry {
 // タイムスタンプベースのバージョン識別子を生成
 now := time.Now()
 version := fmt.Sprintf("%d", now.Unix())
@@ -176,11 +417,13 @@ commitMsg = string(commitMsgBytes)
 
 entry := DeployHistoryEntry{
 Version:       version,
+Status:        status,
 CommitHash:    commitHash,
 CommitMessage: commitMsg,
 Image:         fmt.Sprintf("%s:%s", conf.Docker.ImageName, conf.Docker.Tag),
 Timestamp:     now,
 TimestampTag:  conf.Docker.Tag,
+Settings:      NewDeploySettings(conf),
 }
 
 // Docker Compose使用時は追加情報を記録
@@ -191,33 +434,30 @@ entry.ComposeInfo.ExtraFiles = conf.Compose.ExtraFiles
 entry.ComposeInfo.Config = map[string]any{
 "target_env": conf.Compose.TargetEnv,
 }
+if conf.Compose.ProjectName != "" {
+entry.ComposeInfo.Config["project_name"] = conf.Compose.ProjectName
 }
-
-history[version] = entry
-
-// 履歴を TOML ファイルに書き出す
-file, err := os.Create(historyPath)
-if err != nil {
-return err
 }
-defer file.Close()
-
-enc := toml.NewEncoder(file)
-return enc.Encode(history)
+return entry
 }
 
-// ShowDeployHistory は履歴を表示する関数
+// ShowDeployHistory はローカルの履歴を表示する関数
 func ShowDeployHistory() ([]string, error) {
 wd, err := os.Getwd()
 if err != nil {
 return nil, err
 }
-historyPath := filepath.Join(wd, "config/history.toml")
+historyPath := filepath.Join(wd, HistoryPath)
 history, err := LoadHistory(historyPath)
 if err != nil {
 return nil, err
 }
+return PrintDeployHistory(history, ""), nil
+}
 
+// PrintDeployHistory は履歴を新しい順に表示し、表示したバージョンの一覧を返す関数
+// current には現在デプロイされているバージョンを指定する（不明な場合は空）
+func PrintDeployHistory(history History, current string) []string {
 // バージョンのリストを作成
 versions := make([]string, 0, len(history))
 for version := range history {
@@ -227,17 +467,32 @@ versions = append(versions, version)
 // バージョンを時系列順にソート（新しい順）
 sort.Sort(sort.Reverse(sort.StringSlice(versions)))
 
-fmt.Println("\n============= Deploy History =============\n")
+fmt.Print("\n============= Deploy History =============\n\n")
 
 // 各バージョンの情報を表示
 for _, version := range versions {
 entry := history[version]
+if version == current {
+fmt.Printf("[Version] %s (現在デプロイ中)\n", version)
+} else {
 fmt.Printf("[Version] %s\n", version)
+}
 fmt.Println("┌─────────────┬──────────────────────────────────┐")
 fmt.Printf("│ Commit Hash │ %-30s │\n", entry.CommitHash)
+if entry.Ref != "" {
+fmt.Printf("│ Ref         │ %-30s │\n", entry.Ref)
+}
+if len(entry.ForcedGuards) > 0 {
+fmt.Printf("│ Forced      │ %-30s │\n", strings.Join(entry.ForcedGuards, ","))
+}
 fmt.Printf("│ Message     │ %-30s │\n", truncateString(entry.CommitMessage, 30))
 fmt.Printf("│ Image       │ %-30s │\n", entry.Image)
 fmt.Printf("│ Time        │ %-30s │\n", entry.Timestamp.Format("2006-01-02 15:04:05 MST"))
+if entry.Status == DeployStatusAborted {
+fmt.Printf("│ Status      │ %-30s │\n", "中断 (ロールバック不可)")
+} else if entry.Pruned {
+fmt.Printf("│ Status      │ %-30s │\n", "削除済み (ロールバック不可)")
+}
 
 // Docker Compose情報がある場合は表示
 if entry.ComposeInfo.ServiceName != "" {
@@ -246,6 +501,9 @@ fmt.Printf("│ Env Files   │ %-30s │\n", truncateString(strings.Join(entry.
 if targetEnv, ok := entry.ComposeInfo.Config["target_env"]; ok {
 fmt.Printf("│ Target Env  │ %-30s │\n", targetEnv)
 }
+if projectName, ok := entry.ComposeInfo.Config["project_name"]; ok {
+fmt.Printf("│ Project     │ %-30s │\n", projectName)
+}
 }
 
 fmt.Println("└─────────────┴──────────────────────────────────┘")
@@ -253,7 +511,7 @@ fmt.Println()
 }
 
 fmt.Println("=========================================")
-return versions, nil
+return versions
 }
 
 // truncateString は文字列を指定した表示幅に切り詰める関数
@@ -156,6 +156,7 @@ func TestShowDeployHistory(t *testing.T) {
 				EnvFiles    []string       `toml:"env_files,omitempty"`
 				ExtraFiles  []string       `toml:"extra_files,omitempty"`
 				Config      map[string]any `toml:"config,omitempty"`
+				Services    map[string]ComposeServiceImage `toml:"services,omitempty"`
 			}{
 				ServiceName: "web",
 				EnvFiles:    []string{".env"},
@@ -209,31 +210,13 @@ func TestRecordDeployHistory(t *testing.T) {
 	}
 
 	// テスト用の設定
-	conf := Config{
-		Docker: struct {
-			Dockerfile     string `toml:"dockerfile"`
-			ImageName      string `toml:"image_name"`
-			Tag           string `toml:"tag"`
-			Context       string `toml:"context"`
-			UseCompose    bool   `toml:"use_compose"`
-			ComposeFile   string `toml:"compose_file"`
-			ServiceName   string `toml:"service_name"`
-			ComposeEnvFile string `toml:"compose_env_file"`
-		}{
-			ImageName:   "test-app",
-			Tag:        "latest",
-			UseCompose: true,
-			ServiceName: "web",
-		},
-		Compose: struct {
-			EnvFiles    []string `toml:"env_files"`
-			ExtraFiles  []string `toml:"extra_files"`
-			TargetEnv   string   `toml:"target_env"`
-		}{
-			EnvFiles:  []string{".env"},
-			TargetEnv: "production",
-		},
-	}
+	var conf Config
+	conf.Docker.ImageName = "test-app"
+	conf.Docker.Tag = "latest"
+	conf.Docker.UseCompose = true
+	conf.Docker.ServiceName = "web"
+	conf.Compose.EnvFiles = []string{".env"}
+	conf.Compose.TargetEnv = "production"
 
 	// デプロイ履歴を記録
 	if err := RecordDeployHistory(conf); err != nil {
@@ -265,3 +248,29 @@ func TestRecordDeployHistory(t *testing.T) {
 		t.Errorf("サービス名: want web, got %s", entry.ComposeInfo.ServiceName)
 	}
 }
+
+func TestSaveConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config", "config.toml")
+	var conf Config
+	conf.SSH.Host = "example.com"
+	conf.SSH.Password = "secret"
+	if err := SaveConfig(path, conf); err != nil {
+		t.Fatalf("SaveConfig() error = %v", err)
+	}
+
+	// パスワードを含むため他のユーザーからは読めないようにする
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("パーミッション = %o, want 600", mode)
+	}
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.SSH.Password != "secret" {
+		t.Errorf("Password = %q, want secret", loaded.SSH.Password)
+	}
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// デプロイしたコミットへの記録方法 ([deploy] annotate)
+const (
+	AnnotateTag  = "tag"  // deploy/<環境>/<バージョン> の注釈付きタグを作成してプッシュする
+	AnnotateNote = "note" // refs/notes/sailor に git note を追記してプッシュする
+)
+
+// annotateNotesRef はデプロイの記録を追記する git notes の ref
+const annotateNotesRef = "sailor"
+
+// annotateRemoteNotesRef はリモートの git notes を取り込むための ref
+const annotateRemoteNotesRef = "refs/notes/sailor-remote"
+
+// ValidateAnnotate は [deploy] annotate の値を確認する関数
+func ValidateAnnotate(conf config.Config) error {
+	switch conf.Deploy.Annotate {
+	case "", AnnotateTag, AnnotateNote:
+		return nil
+	}
+	return fmt.Errorf("[deploy] annotate の値が不正です: %q（tag または note を指定してください）", conf.Deploy.Annotate)
+}
+
+// annotateRemote はタグ・ノートをプッシュするリモートを返す
+func annotateRemote(conf config.Config) string {
+	if conf.Deploy.AnnotateRemote != "" {
+		return conf.Deploy.AnnotateRemote
+	}
+	return "origin"
+}
+
+// DeployTagName はデプロイを記録するタグの名前を返す (例: deploy/production/1700000000)
+func DeployTagName(conf config.Config, version string) string {
+	env := conf.Compose.TargetEnv
+	if env == "" {
+		env = "production"
+	}
+	return "deploy/" + env + "/" + version
+}
+
+// deployer はデプロイを実行したユーザーを返す（git の user.name / user.email、無ければ OS のユーザー名）
+func deployer(ctx context.Context, local LocalRunner) string {
+	name, _ := local.Output(ctx, "git", "config", "user.name")
+	email, _ := local.Output(ctx, "git", "config", "user.email")
+	name, email = strings.TrimSpace(name), strings.TrimSpace(email)
+	switch {
+	case name != "" && email != "":
+		return fmt.Sprintf("%s <%s>", name, email)
+	case name != "":
+		return name
+	case email != "":
+		return email
+	}
+	return os.Getenv("USER")
+}
+
+// deployAnnotation はタグ・ノートに記録するデプロイの内容を返す
+func deployAnnotation(conf config.Config, entry config.DeployHistoryEntry, user string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "sailor deploy %s\n\n", entry.Version)
+	fmt.Fprintf(&b, "Version: %s\n", entry.Version)
+	fmt.Fprintf(&b, "Commit:  %s\n", entry.CommitHash)
+	if entry.Ref != "" {
+		fmt.Fprintf(&b, "Ref:     %s\n", entry.Ref)
+	}
+	for _, image := range historyImages(entry) {
+		fmt.Fprintf(&b, "Image:   %s\n", image)
+	}
+	fmt.Fprintf(&b, "Host:    %s@%s\n", conf.SSH.User, conf.SSH.Host)
+	fmt.Fprintf(&b, "User:    %s\n", user)
+	fmt.Fprintf(&b, "Time:    %s\n", entry.Timestamp.UTC().Format(time.RFC3339))
+	if len(entry.ForcedGuards) > 0 {
+		fmt.Fprintf(&b, "Forced:  %s\n", strings.Join(entry.ForcedGuards, ", "))
+	}
+	return b.String()
+}
+
+// mergeRemoteNotes はリモートにプッシュされている git notes を取得し、ローカルの git notes に取り込む
+// 他のマシンが追記したノートを取り込まずにプッシュすると non-fast-forward で拒否される
+func mergeRemoteNotes(ctx context.Context, local LocalRunner, remote string) error {
+	ref := "refs/notes/" + annotateNotesRef
+	out, err := local.Output(ctx, "git", "ls-remote", remote, ref)
+	if err != nil {
+		return fmt.Errorf("リモートの git note の確認に失敗: %w", err)
+	}
+	if strings.TrimSpace(out) == "" {
+		return nil
+	}
+	if err := local.Run(ctx, "git", "fetch", "--quiet", remote, "+"+ref+":"+annotateRemoteNotesRef); err != nil {
+		return fmt.Errorf("リモートの git note の取得に失敗: %w", err)
+	}
+	// 同じコミットに両方で追記していた場合は両方の記録を残す
+	// （cat_sort_uniq は行を並べ替えるため、デプロイごとの記録が混ざってしまう）
+	if err := local.Run(ctx, "git", "notes", "--ref="+annotateNotesRef, "merge", "--quiet", "-s", "union", annotateRemoteNotesRef); err != nil {
+		return fmt.Errorf("リモートの git note の取り込みに失敗: %w", err)
+	}
+	return nil
+}
+
+// AnnotateDeploy はデプロイしたコミットに [deploy] annotate の方法でデプロイの記録を残し、リモートにプッシュする関数
+func AnnotateDeploy(ctx context.Context, conf config.Config, local LocalRunner, entry config.DeployHistoryEntry) error {
+	if conf.Deploy.Annotate == "" || entry.CommitHash == "" || entry.CommitHash == "unknown" {
+		return nil
+	}
+	message := deployAnnotation(conf, entry, deployer(ctx, local))
+	remote := annotateRemote(conf)
+
+	switch conf.Deploy.Annotate {
+	case AnnotateTag:
+		tag := DeployTagName(conf, entry.Version)
+		if err := local.Run(ctx, "git", "tag", "-a", tag, "-m", message, entry.CommitHash); err != nil {
+			return fmt.Errorf("タグ %s の作成に失敗: %w", tag, err)
+		}
+		if err := local.Run(ctx, "git", "push", "--quiet", remote, "refs/tags/"+tag); err != nil {
+			return fmt.Errorf("タグ %s のプッシュに失敗: %w", tag, err)
+		}
+		fmt.Printf("デプロイをタグ %s として記録しました\n", tag)
+	case AnnotateNote:
+		if err := mergeRemoteNotes(ctx, local, remote); err != nil {
+			return err
+		}
+		// 同じコミットを複数回デプロイした場合も記録が残るよう追記する
+		if err := local.Run(ctx, "git", "notes", "--ref="+annotateNotesRef, "append", "-m", message, entry.CommitHash); err != nil {
+			return fmt.Errorf("git note の追加に失敗: %w", err)
+		}
+		if err := local.Run(ctx, "git", "push", "--quiet", remote, "refs/notes/"+annotateNotesRef); err != nil {
+			return fmt.Errorf("git note のプッシュに失敗: %w", err)
+		}
+		fmt.Printf("デプロイを git note (refs/notes/%s) として記録しました\n", annotateNotesRef)
+	}
+	return nil
+}
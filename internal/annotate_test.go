@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkalls/sailor/config"
+)
+
+func newAnnotateEntry() config.DeployHistoryEntry {
+	return config.DeployHistoryEntry{
+		Version:      "1700000000",
+		CommitHash:   "abc1234",
+		Image:        "myapp:abc1234",
+		Timestamp:    time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC),
+		Ref:          "v1.4.2",
+		ForcedGuards: []string{GuardUnpushed},
+	}
+}
+
+func TestAnnotateDeploy(t *testing.T) {
+	t.Run("タグ", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.SSH.User = "deploy"
+		conf.SSH.Host = "example.com"
+		conf.Deploy.Annotate = AnnotateTag
+		local := &fakeLocal{}
+		local.on("git config user.name", "Alice\n", nil)
+		local.on("git config user.email", "alice@example.com\n", nil)
+
+		if err := AnnotateDeploy(context.Background(), conf, local, newAnnotateEntry()); err != nil {
+			t.Fatalf("AnnotateDeploy() error = %v", err)
+		}
+		message := "sailor deploy 1700000000\n\n" +
+			"Version: 1700000000\n" +
+			"Commit:  abc1234\n" +
+			"Ref:     v1.4.2\n" +
+			"Image:   myapp:abc1234\n" +
+			"Host:    deploy@example.com\n" +
+			"User:    Alice <alice@example.com>\n" +
+			"Time:    2023-11-14T22:13:20Z\n" +
+			"Forced:  unpushed\n"
+		assertCommands(t, local.commands[2:], []string{
+			"git tag -a deploy/production/1700000000 -m " + message + " abc1234",
+			"git push --quiet origin refs/tags/deploy/production/1700000000",
+		})
+	})
+
+	t.Run("ノート", func(t *testing.T) {
+		conf := newTestComposeConfig()
+		conf.Deploy.Annotate = AnnotateNote
+		conf.Deploy.AnnotateRemote = "upstream"
+		local := &fakeLocal{}
+		if err := AnnotateDeploy(context.Background(), conf, local, newAnnotateEntry()); err != nil {
+			t.Fatalf("AnnotateDeploy() error = %v", err)
+		}
+		last := local.commands[len(local.commands)-2:]
+		if !strings.HasPrefix(last[0], "git notes --ref=sailor append -m sailor deploy 1700000000") || !strings.HasSuffix(last[0], " abc1234") {
+			t.Errorf("git notes のコマンドが不正です: %s", last[0])
+		}
+		if last[1] != "git push --quiet upstream refs/notes/sailor" {
+			t.Errorf("git push のコマンドが不正です: %s", last[1])
+		}
+	})
+
+	t.Run("リモートにノートがある", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Deploy.Annotate = AnnotateNote
+		local := &fakeLocal{}
+		local.on("git config", "", errors.New("exit status 1"))
+		local.on("git ls-remote origin refs/notes/sailor", "9db3607deadcd3c7501bd09882f482b2a5806868\trefs/notes/sailor\n", nil)
+		if err := AnnotateDeploy(context.Background(), conf, local, newAnnotateEntry()); err != nil {
+			t.Fatalf("AnnotateDeploy() error = %v", err)
+		}
+		// 追記する前にリモートのノートを取り込む
+		assertCommands(t, local.commands[2:5], []string{
+			"git ls-remote origin refs/notes/sailor",
+			"git fetch --quiet origin +refs/notes/sailor:refs/notes/sailor-remote",
+			"git notes --ref=sailor merge --quiet -s union refs/notes/sailor-remote",
+		})
+		if !strings.HasPrefix(local.commands[5], "git notes --ref=sailor append") {
+			t.Errorf("取り込んだ後に追記されていません: %v", local.commands[5:])
+		}
+	})
+
+	t.Run("プッシュの失敗", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Deploy.Annotate = AnnotateTag
+		local := &fakeLocal{}
+		local.on("git push", "", errors.New("rejected"))
+		if err := AnnotateDeploy(context.Background(), conf, local, newAnnotateEntry()); err == nil {
+			t.Error("プッシュの失敗でエラーが返されていません")
+		}
+	})
+
+	t.Run("未指定なら何もしない", func(t *testing.T) {
+		local := &fakeLocal{}
+		if err := AnnotateDeploy(context.Background(), newTestConfig(), local, newAnnotateEntry()); err != nil || len(local.commands) != 0 {
+			t.Errorf("err = %v, commands = %v", err, local.commands)
+		}
+	})
+}
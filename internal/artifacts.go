@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// ArtifactDir はデプロイ中にローカルで作成するファイルを置くディレクトリ
+const ArtifactDir = ".sailor"
+
+// LocalArtifactPath はローカルに保存するイメージの圧縮ファイルのパスを返す
+func LocalArtifactPath(conf config.Config) string {
+	return filepath.Join(ArtifactDir, filepath.Base(conf.Deploy.CompressedFile))
+}
+
+// remoteArtifactPath はリモートに転送するイメージの圧縮ファイルのパスを返す
+func remoteArtifactPath(conf config.Config) string {
+	return remoteWorkDir(conf) + "/" + filepath.Base(conf.Deploy.CompressedFile)
+}
+
+// remoteWorkDir はリモートで圧縮ファイルや（app_dir 未指定時の）compose ファイルを置くディレクトリを返す
+// 同じサーバーにデプロイする他のプロジェクトと衝突しないよう remote_temp_dir の下をプロジェクト名で分ける
+func remoteWorkDir(conf config.Config) string {
+	if name := ProjectName(conf); name != "" {
+		return conf.Deploy.RemoteTempDir + "/" + name
+	}
+	return conf.Deploy.RemoteTempDir
+}
+
+// prepareArtifactDir は .sailor ディレクトリを作成する関数
+// 誤ってコミットされないよう、ディレクトリ内に全ファイルを無視する .gitignore を置く
+func prepareArtifactDir() error {
+	if err := os.MkdirAll(ArtifactDir, 0755); err != nil {
+		return fmt.Errorf("%s の作成に失敗: %w", ArtifactDir, err)
+	}
+	gitignore := filepath.Join(ArtifactDir, ".gitignore")
+	if _, err := os.Stat(gitignore); os.IsNotExist(err) {
+		if err := os.WriteFile(gitignore, []byte("*\n"), 0644); err != nil {
+			return fmt.Errorf("%s の作成に失敗: %w", gitignore, err)
+		}
+	}
+	return nil
+}
+
+// RemoveLocalArtifacts は転送が終わったローカルの圧縮ファイル（イメージ・ソース）を削除する関数
+func RemoveLocalArtifacts(conf config.Config) {
+	for _, path := range []string{LocalArtifactPath(conf), filepath.Join(ArtifactDir, sourceArchive)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("警告: ローカルの %s の削除に失敗しました: %v\n", path, err)
+		}
+	}
+}
+
+// localImageRepositories は sailor がビルドするローカルイメージのリポジトリ名を返す
+func localImageRepositories(conf config.Config) []string {
+	if !conf.Docker.UseCompose {
+		return []string{conf.Docker.ImageName}
+	}
+	var repositories []string
+	for _, service := range composeServices(conf) {
+		repositories = appendMissing(repositories, imageRepository(composeImageRef(conf, service)))
+	}
+	return repositories
+}
+
+// PruneLocalImages は sailor がビルドしたローカルのイメージのうち、リポジトリごとに新しい keep 件より古いものを削除する関数
+// デプロイ履歴に記録されたイメージだけを対象にし、手動でタグ付けしたイメージは削除しない
+// dryRun の場合は削除対象を返すだけで削除しない
+func PruneLocalImages(ctx context.Context, conf config.Config, local LocalRunner, keep int, dryRun bool) ([]string, error) {
+	history, err := config.LoadHistory(config.HistoryPath)
+	if err != nil {
+		return nil, err
+	}
+	built := make(map[string]bool)
+	for _, entry := range history {
+		for _, image := range historyImages(entry) {
+			built[image] = true
+		}
+	}
+
+	var removed []string
+	for _, repository := range localImageRepositories(conf) {
+		// docker image ls は新しい順に並ぶ
+		out, err := local.Output(ctx, "docker", "image", "ls", repository, "--format", "{{.Repository}}:{{.Tag}}")
+		if err != nil {
+			return removed, fmt.Errorf("ローカルイメージの一覧の取得に失敗: %w", err)
+		}
+		kept := 0
+		for _, image := range strings.Fields(out) {
+			if !built[image] {
+				continue
+			}
+			if kept < keep {
+				kept++
+				continue
+			}
+			if !dryRun {
+				if err := local.Run(ctx, "docker", "image", "rm", image); err != nil {
+					fmt.Printf("警告: ローカルイメージ %s の削除に失敗しました: %v\n", image, err)
+					continue
+				}
+			}
+			removed = append(removed, image)
+		}
+	}
+	return removed, nil
+}
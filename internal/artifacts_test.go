@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/linkalls/sailor/config"
+)
+
+func TestPruneLocalImages(t *testing.T) {
+	history := make(config.History)
+	for i, tag := range []string{"20240101000000", "20240102000000", "20240103000000"} {
+		version := "170000000" + string(rune('0'+i))
+		history[version] = config.DeployHistoryEntry{Version: version, Image: "myapp:" + tag, Timestamp: time.Unix(int64(i), 0)}
+	}
+	// docker image ls は新しい順。myapp:manual は sailor がビルドしたものではない
+	const images = "myapp:20240103000000\nmyapp:manual\nmyapp:20240102000000\nmyapp:20240101000000\n"
+
+	t.Run("新しい keep 件を残して削除", func(t *testing.T) {
+		chdirWithHistory(t, history)
+		local := &fakeLocal{}
+		local.on("docker image ls", images, nil)
+		local.on("docker image rm myapp:20240101000000", "", errors.New("image is being used"))
+		removed, err := PruneLocalImages(context.Background(), newTestConfig(), local, 1, false)
+		if err != nil {
+			t.Fatalf("PruneLocalImages() error = %v", err)
+		}
+		assertCommands(t, local.commands, []string{
+			"docker image ls myapp --format {{.Repository}}:{{.Tag}}",
+			"docker image rm myapp:20240102000000",
+			"docker image rm myapp:20240101000000",
+		})
+		if want := []string{"myapp:20240102000000"}; !reflect.DeepEqual(removed, want) {
+			t.Errorf("removed = %v, want %v", removed, want)
+		}
+	})
+
+	t.Run("dry-run は削除しない", func(t *testing.T) {
+		chdirWithHistory(t, history)
+		local := &fakeLocal{}
+		local.on("docker image ls", images, nil)
+		removed, err := PruneLocalImages(context.Background(), newTestConfig(), local, 2, true)
+		if err != nil {
+			t.Fatalf("PruneLocalImages() error = %v", err)
+		}
+		if want := []string{"myapp:20240101000000"}; !reflect.DeepEqual(removed, want) {
+			t.Errorf("removed = %v, want %v", removed, want)
+		}
+		if len(local.commands) != 1 {
+			t.Errorf("dry-run でイメージが削除されています: %v", local.commands)
+		}
+	})
+}
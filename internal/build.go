@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// expandBuildArg は build_args の値に含まれる ${VAR} / $VAR を展開する関数
+// SAILOR_TAG はデプロイのタグ、それ以外は環境変数に置き換える。未設定の環境変数はエラーにする
+func expandBuildArg(conf config.Config, key, value string) (string, error) {
+	var missing string
+	expanded := os.Expand(value, func(name string) string {
+		if name == "SAILOR_TAG" {
+			return conf.Docker.Tag
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("build_args の %s で参照している環境変数 %s が設定されていません", key, missing)
+	}
+	return expanded, nil
+}
+
+// buildArgFlags は build_args を --build-arg の引数に変換する
+func buildArgFlags(conf config.Config) ([]string, error) {
+	var args []string
+	for _, key := range sortedStringKeys(conf.Docker.BuildArgs) {
+		value, err := expandBuildArg(conf, key, conf.Docker.BuildArgs[key])
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--build-arg", key+"="+value)
+	}
+	return args, nil
+}
+
+// dockerBuildArgs は Dockerfile でビルドする docker build の引数を返す
+func dockerBuildArgs(conf config.Config, image string) ([]string, error) {
+	args := []string{"build", "-t", image}
+	if conf.Docker.Platform != "" {
+		// 別アーキテクチャ向けのイメージは buildx でビルドし、ローカルの Docker に読み込む
+		args = []string{"buildx", "build", "--platform", conf.Docker.Platform, "--load", "-t", image}
+	}
+	if conf.Docker.Dockerfile != "" {
+		args = append(args, "-f", dockerfilePath(conf))
+	}
+	if conf.Docker.NoCache {
+		args = append(args, "--no-cache")
+	}
+	if conf.Docker.Target != "" {
+		args = append(args, "--target", conf.Docker.Target)
+	}
+	buildArgs, err := buildArgFlags(conf)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, buildArgs...)
+	for _, key := range sortedStringKeys(conf.Docker.Labels) {
+		args = append(args, "--label", key+"="+conf.Docker.Labels[key])
+	}
+	for _, secret := range conf.Docker.Secrets {
+		args = append(args, "--secret", secret)
+	}
+	for _, ssh := range conf.Docker.SSH {
+		args = append(args, "--ssh", ssh)
+	}
+	return append(args, conf.Docker.Context), nil
+}
+
+// dockerfilePath は docker build -f に渡す Dockerfile のパスを返す
+// docker build は -f の相対パスをカレントディレクトリから解決するため、
+// カレントディレクトリに見つからずコンテキストからの相対パスに存在する場合はそちらを使う
+func dockerfilePath(conf config.Config) string {
+	path := conf.Docker.Dockerfile
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if conf.Docker.Context == "" {
+		return path
+	}
+	inContext := filepath.Join(conf.Docker.Context, path)
+	if _, err := os.Stat(inContext); err == nil {
+		return inContext
+	}
+	return path
+}
+
+// composeLabelsFile はビルドするサービスにラベルを付ける compose のオーバーライドファイル名
+const composeLabelsFile = "docker-compose.labels.yml"
+
+// renderComposeBuildLabels は各サービスのビルドにラベルを付ける compose ファイルの内容を返す
+func renderComposeBuildLabels(services []string, labels map[string]string) string {
+	var b strings.Builder
+	b.WriteString("# sailor が生成したファイルです。ビルドのたびに上書きされます\n")
+	b.WriteString("services:\n")
+	for _, service := range services {
+		fmt.Fprintf(&b, "  %s:\n    build:\n      labels:\n", service)
+		for _, key := range sortedStringKeys(labels) {
+			fmt.Fprintf(&b, "        %s: %s\n", strconv.Quote(key), strconv.Quote(labels[key]))
+		}
+	}
+	return b.String()
+}
+
+// composeBuildArgs は compose build の引数を返す
+// target・secrets は compose ファイルの build: に記述する
+func composeBuildArgs(conf config.Config) ([]string, error) {
+	args := []string{"build"}
+	if conf.Docker.NoCache {
+		args = append(args, "--no-cache")
+	}
+	buildArgs, err := buildArgFlags(conf)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, buildArgs...)
+	for _, ssh := range conf.Docker.SSH {
+		args = append(args, "--ssh", ssh)
+	}
+	return append(args, composeServices(conf)...), nil
+}
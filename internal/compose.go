@@ -0,0 +1,368 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// ComposeOverrideFile は sailor がサービスのイメージを固定するために生成する compose ファイル名
+const ComposeOverrideFile = "docker-compose.sailor.yml"
+
+// compose コマンドの種類
+const (
+	composeV2 = "docker compose" // Docker CLI プラグイン
+	composeV1 = "docker-compose" // 旧来のスタンドアロン版
+)
+
+// localComposeCommand はローカルで使う compose コマンドを返す
+func localComposeCommand(conf config.Config) string {
+	if conf.Docker.ComposeCommand != "" {
+		return conf.Docker.ComposeCommand
+	}
+	return composeV2
+}
+
+// remoteComposeCommand はリモートで使う compose コマンドを返す
+func remoteComposeCommand(conf config.Config) string {
+	if conf.Remote.ComposeCommand != "" {
+		return conf.Remote.ComposeCommand
+	}
+	return localComposeCommand(conf)
+}
+
+// ResolveComposeCommands は compose_command が未指定の場合に、ローカルとリモートで使える compose コマンドを検出して設定に反映する関数
+// docker compose (v2) を優先し、無ければ docker-compose (v1) を使う
+func ResolveComposeCommands(ctx context.Context, conf *config.Config, local LocalRunner, remote RemoteRunner) error {
+	if conf.Docker.ComposeCommand == "" {
+		switch {
+		case runs(local.Output(ctx, "docker", "compose", "version", "--short")):
+			conf.Docker.ComposeCommand = composeV2
+		case runs(local.Output(ctx, "docker-compose", "version", "--short")):
+			conf.Docker.ComposeCommand = composeV1
+		default:
+			return fmt.Errorf("ローカルに docker compose / docker-compose が見つかりません")
+		}
+
+		// compose_command を明示していない場合はリモートも個別に検出する
+		if conf.Remote.ComposeCommand == "" {
+			switch {
+			case runs(remote.Output(ctx, "docker compose version --short")):
+				conf.Remote.ComposeCommand = composeV2
+			case runs(remote.Output(ctx, "docker-compose version --short")):
+				conf.Remote.ComposeCommand = composeV1
+			default:
+				return fmt.Errorf("リモートに docker compose / docker-compose が見つかりません")
+			}
+		}
+	}
+	return nil
+}
+
+// runs はコマンドが成功したかどうかを返す
+func runs(_ string, err error) bool {
+	return err == nil
+}
+
+// composeProjectName は compose に -p で渡すプロジェクト名を返す
+// [compose] project_name、compose ファイルの name:、compose ファイルのあるディレクトリ名の順に決める
+// リポジトリ名を使う場合は事前に ResolveProjectName で project_name に固定しておく
+func composeProjectName(conf config.Config, project *ComposeProject) string {
+	name := conf.Compose.ProjectName
+	if name == "" && project != nil {
+		name = project.Name
+	}
+	if name == "" {
+		dir, err := filepath.Abs(filepath.Dir(conf.Docker.ComposeFile))
+		if err == nil {
+			name = filepath.Base(dir)
+		}
+	}
+	return normalizeProjectName(name)
+}
+
+// ResolveProjectName は compose のプロジェクト名を決定して [compose] project_name に固定する関数
+// project_name と compose ファイルの name: がどちらも無い場合はリポジトリ名を使う
+// 以降の ProjectName・PrepareCompose は git を実行せずに同じ名前を返す
+func ResolveProjectName(ctx context.Context, conf *config.Config, local LocalRunner) {
+	if !conf.Docker.UseCompose || conf.Compose.ProjectName != "" {
+		return
+	}
+	project, _ := ParseComposeFile(conf.Docker.ComposeFile)
+	if project == nil || project.Name == "" {
+		if out, err := local.Output(ctx, "git", "rev-parse", "--show-toplevel"); err == nil && strings.TrimSpace(out) != "" {
+			conf.Compose.ProjectName = normalizeProjectName(filepath.Base(strings.TrimSpace(out)))
+			return
+		}
+	}
+	conf.Compose.ProjectName = composeProjectName(*conf, project)
+}
+
+// ProjectName はリモートで sailor の状態を分けるためのプロジェクト名を返す関数
+// compose 使用時は compose のプロジェクト名、それ以外はコンテナ名（未指定なら [[remote.containers]] の先頭の名前）を使う
+func ProjectName(conf config.Config) string {
+	if !conf.Docker.UseCompose {
+		if conf.Remote.ContainerName == "" && len(conf.Remote.Containers) > 0 {
+			return conf.Remote.Containers[0].Name
+		}
+		return conf.Remote.ContainerName
+	}
+	if conf.Compose.ProjectName != "" {
+		return normalizeProjectName(conf.Compose.ProjectName)
+	}
+	project, _ := ParseComposeFile(conf.Docker.ComposeFile)
+	return composeProjectName(conf, project)
+}
+
+// normalizeProjectName は compose と同じ規則でプロジェクト名を正規化する（小文字・英数字と - _ のみ）
+func normalizeProjectName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || ((r == '-' || r == '_') && b.Len() > 0) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// imageRepository はイメージ参照からタグを除いたリポジトリ名を返す
+func imageRepository(image string) string {
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
+
+// composeBuiltImage は compose がサービスのビルド結果に付けるイメージ名を返す
+// image: があればその名前、無ければ v2 は "プロジェクト-サービス"、v1 は "プロジェクト_サービス" になる
+func composeBuiltImage(conf config.Config, project *ComposeProject, service string, v1 bool) string {
+	if project != nil {
+		if image := project.Services[service].Image; image != "" {
+			if imageRepository(image) == image {
+				image += ":latest"
+			}
+			return image
+		}
+	}
+	separator := "-"
+	if v1 {
+		separator = "_"
+	}
+	return composeProjectName(conf, project) + separator + service + ":latest"
+}
+
+// composeImageRef はデプロイ用にタグ付けしたサービスのイメージ参照を返す
+// image: があればそのリポジトリ、無ければ "プロジェクト-サービス" にデプロイのタグを付ける
+func composeImageRef(conf config.Config, service string) string {
+	project, _ := ParseComposeFile(conf.Docker.ComposeFile)
+	return imageRepository(composeBuiltImage(conf, project, service, false)) + ":" + conf.Docker.Tag
+}
+
+// TagComposeImages は compose でビルドした各サービスのイメージにデプロイ用のタグを付ける関数
+func TagComposeImages(ctx context.Context, conf config.Config, local LocalRunner) error {
+	project, _ := ParseComposeFile(conf.Docker.ComposeFile)
+
+	// docker-compose v1 はイメージ名の区切りに _ を使う（v2 のスタンドアロン版は - を使う）
+	v1 := false
+	if localComposeCommand(conf) != composeV2 {
+		fields := strings.Fields(localComposeCommand(conf))
+		version, err := local.Output(ctx, fields[0], append(fields[1:], "version", "--short")...)
+		v1 = err == nil && strings.HasPrefix(strings.TrimPrefix(strings.TrimSpace(version), "v"), "1.")
+	}
+
+	for _, service := range composeServices(conf) {
+		built := composeBuiltImage(conf, project, service, v1)
+		if err := local.Run(ctx, "docker", "tag", built, composeImageRef(conf, service)); err != nil {
+			return fmt.Errorf("サービス %s のイメージ %s のタグ付けに失敗: %w", service, built, err)
+		}
+	}
+	return nil
+}
+
+// composeServices はデプロイ対象の compose サービスの一覧を返す
+// 全サービスを対象にする場合は PrepareCompose で [compose] services に展開しておく
+func composeServices(conf config.Config) []string {
+	if len(conf.Compose.Services) > 0 {
+		return conf.Compose.Services
+	}
+	return []string{conf.Docker.ServiceName}
+}
+
+// CollectComposeImages はビルドした各サービスのイメージ参照とイメージIDを取得する関数
+// イメージIDが取得できない場合も参照だけは記録する
+func CollectComposeImages(ctx context.Context, conf config.Config, local LocalRunner) map[string]config.ComposeServiceImage {
+	images := make(map[string]config.ComposeServiceImage)
+	for _, service := range composeServices(conf) {
+		image := config.ComposeServiceImage{Image: composeImageRef(conf, service)}
+		if id, err := local.Output(ctx, "docker", "image", "inspect", "--format", "{{.Id}}", image.Image); err == nil {
+			image.ImageID = strings.TrimSpace(id)
+		}
+		images[service] = image
+	}
+	return images
+}
+
+// NewDeployEntry は今回のデプロイの履歴エントリを作成する関数
+// compose 使用時は実際にビルド・転送したサービスごとのイメージを記録する
+func NewDeployEntry(ctx context.Context, conf config.Config, local LocalRunner, status string) config.DeployHistoryEntry {
+	entry := config.NewDeployHistoryEntry(conf, status)
+	if conf.Docker.UseCompose {
+		services := composeServices(conf)
+		entry.ComposeInfo.ServiceName = strings.Join(services, ",")
+		entry.ComposeInfo.Services = CollectComposeImages(ctx, conf, local)
+		entry.Image = composeImageRef(conf, services[0])
+		if conf.Remote.AppDir != "" {
+			entry.Release = releasePath(conf)
+		}
+	}
+	return entry
+}
+
+// entryComposeImages は履歴エントリに記録されたサービスごとのイメージ参照を返す
+// サービスごとの記録がない旧形式の履歴では、対象サービスに Image を割り当てる
+func entryComposeImages(entry config.DeployHistoryEntry) map[string]string {
+	images := make(map[string]string)
+	for service, image := range entry.ComposeInfo.Services {
+		images[service] = image.Image
+	}
+	if len(images) == 0 {
+		images[entry.ComposeInfo.ServiceName] = entry.Image
+	}
+	return images
+}
+
+// renderComposeOverride は各サービスのイメージを固定する compose ファイルの内容を返す
+func renderComposeOverride(images map[string]string) string {
+	services := make([]string, 0, len(images))
+	for service := range images {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	var b strings.Builder
+	b.WriteString("# sailor が生成したファイルです。デプロイ・ロールバックのたびに上書きされます\n")
+	b.WriteString("services:\n")
+	for _, service := range services {
+		fmt.Fprintf(&b, "  %s:\n    image: %s\n", service, images[service])
+	}
+	return b.String()
+}
+
+// writeComposeOverride はリモートの dir に docker-compose.sailor.yml を書き出す関数
+func writeComposeOverride(ctx context.Context, remote RemoteRunner, dir string, images map[string]string) error {
+	cmd := fmt.Sprintf("cd %s && printf '%%s' %s > %s", dir, shellQuote(renderComposeOverride(images)), ComposeOverrideFile)
+	if err := remote.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("%s の作成に失敗: %w", ComposeOverrideFile, err)
+	}
+	return nil
+}
+
+// remoteCompose はリモートで使う compose コマンドにプロジェクト名を付けて返す
+func remoteCompose(conf config.Config) string {
+	if name := ProjectName(conf); name != "" {
+		return fmt.Sprintf("%s -p %s", remoteComposeCommand(conf), name)
+	}
+	return remoteComposeCommand(conf)
+}
+
+// composeUpCmd は dir のユーザーの compose ファイルに sailor のオーバーライドを重ねてサービスを起動するコマンドを返す
+func composeUpCmd(conf config.Config, dir string) string {
+	return fmt.Sprintf("cd %s && %s -f %s -f %s up -d",
+		dir, remoteCompose(conf), conf.Docker.ComposeFile, ComposeOverrideFile)
+}
+
+// composeDownCmd は dir の compose ファイルでリモートのサービスを停止するコマンドを返す
+func composeDownCmd(conf config.Config, dir string) string {
+	return fmt.Sprintf("cd %s && %s -f %s down", dir, remoteCompose(conf), conf.Docker.ComposeFile)
+}
+
+// legacyComposeDownCmd は project_name 導入前に remote_temp_dir のディレクトリ名をプロジェクト名として起動したサービスを停止するコマンドを返す
+// 停止するサービスがない場合は何もしない
+func legacyComposeDownCmd(conf config.Config) string {
+	dir := conf.Deploy.RemoteTempDir
+	return fmt.Sprintf("if [ -f %s/%s ]; then cd %s && %s -f %s down; fi",
+		dir, conf.Docker.ComposeFile, dir, remoteComposeCommand(conf), conf.Docker.ComposeFile)
+}
+
+// releasePath は今回のデプロイのリリースディレクトリを app_dir からの相対パスで返す
+// リリース名は ResolveImageTag で決定する（未決定ならタグを使う）
+func releasePath(conf config.Config) string {
+	if conf.Remote.Release != "" {
+		return "releases/" + conf.Remote.Release
+	}
+	return "releases/" + conf.Docker.Tag
+}
+
+// currentReleaseDir は app_dir で現在のリリースを指すシンボリックリンクのパスを返す
+func currentReleaseDir(conf config.Config) string {
+	return conf.Remote.AppDir + "/current"
+}
+
+// composeReleaseDir は今回のデプロイで compose ファイル群を配置するリモートのディレクトリを返す
+// app_dir が未指定の場合は remote_temp_dir/<プロジェクト名> を使う
+func composeReleaseDir(conf config.Config) string {
+	if conf.Remote.AppDir == "" {
+		return remoteWorkDir(conf)
+	}
+	return conf.Remote.AppDir + "/" + releasePath(conf)
+}
+
+// activateRelease は app_dir の current を release に切り替えてサービスを起動し直す関数
+// images を指定した場合は、切り替える前にリリースディレクトリへイメージを固定するオーバーライドを書き出す
+// 起動に失敗した場合や中断された場合は current を元のリリースに戻して起動し直す
+func activateRelease(ctx context.Context, conf config.Config, remote RemoteRunner, release string, images map[string]string) error {
+	current := currentReleaseDir(conf)
+	releaseDir := conf.Remote.AppDir + "/" + release
+
+	if images != nil {
+		if err := writeComposeOverride(ctx, remote, releaseDir, images); err != nil {
+			return err
+		}
+	} else if err := remote.Run(ctx, "test -d "+releaseDir); err != nil {
+		return fmt.Errorf("リリース %s がリモートに見つかりません: %w", release, err)
+	}
+
+	previous, err := remote.Output(ctx, fmt.Sprintf("readlink %s || true", current))
+	if err != nil {
+		return fmt.Errorf("現在のリリースの確認に失敗: %w", err)
+	}
+	previous = strings.TrimSpace(previous)
+
+	downCmd := composeDownCmd(conf, current)
+	if previous == "" {
+		// app_dir を使い始める前に remote_temp_dir から起動していたサービスを停止する
+		downCmd = legacyComposeDownCmd(conf)
+	}
+	if err := remote.Run(ctx, downCmd); err != nil {
+		fmt.Printf("警告: 既存サービスの停止に失敗しました: %v\n", err)
+	}
+	if err := remote.Run(ctx, fmt.Sprintf("ln -sfn %s %s", release, current)); err != nil {
+		return fmt.Errorf("current の切り替えに失敗: %w", err)
+	}
+	if err := remote.Run(ctx, composeUpCmd(conf, current)); err != nil {
+		if previous != "" && previous != release {
+			restorePreviousRelease(conf, remote, previous)
+		}
+		return fmt.Errorf("Docker Composeサービスの起動に失敗: %w", err)
+	}
+	return nil
+}
+
+// restorePreviousRelease は current を元のリリースに戻してサービスを起動し直す関数
+func restorePreviousRelease(conf config.Config, remote RemoteRunner, previous string) {
+	ctx, cancel := NewCleanupContext()
+	defer cancel()
+
+	current := currentReleaseDir(conf)
+	fmt.Printf("リリース %s に戻しています...\n", previous)
+	restoreCmd := fmt.Sprintf("ln -sfn %s %s && %s", previous, current, composeUpCmd(conf, current))
+	if err := remote.Run(ctx, restoreCmd); err != nil {
+		fmt.Printf("警告: 元のリリースの復元に失敗しました: %v\n", err)
+		return
+	}
+	fmt.Println("元のリリースでサービスを再起動しました")
+}
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/linkalls/sailor/config"
+)
+
+func TestNewDeployEntry(t *testing.T) {
+	t.Run("Docker Compose", func(t *testing.T) {
+		chdirComposeProject(t)
+		local := &fakeLocal{}
+		local.on("docker image inspect", "sha256:abc\n", nil)
+		entry := NewDeployEntry(context.Background(), newTestComposeConfig(), local, config.DeployStatusSuccess)
+		if entry.Image != "myapp-web:20240101000000" {
+			t.Errorf("Image = %s, want myapp-web:20240101000000", entry.Image)
+		}
+		want := config.ComposeServiceImage{Image: "myapp-web:20240101000000", ImageID: "sha256:abc"}
+		if got := entry.ComposeInfo.Services["web"]; got != want {
+			t.Errorf("Services[web] = %+v, want %+v", got, want)
+		}
+		assertCommands(t, local.commands, []string{
+			"docker image inspect --format {{.Id}} myapp-web:20240101000000",
+		})
+	})
+
+	t.Run("app_dir 使用時はリリースを記録", func(t *testing.T) {
+		chdirComposeProject(t)
+		conf := newTestComposeConfig()
+		conf.Remote.AppDir = "~/apps/myapp"
+		entry := NewDeployEntry(context.Background(), conf, &fakeLocal{}, config.DeployStatusSuccess)
+		if entry.Release != "releases/20240101000000" {
+			t.Errorf("Release = %q, want releases/20240101000000", entry.Release)
+		}
+	})
+
+	t.Run("イメージIDが取得できない場合", func(t *testing.T) {
+		chdirComposeProject(t)
+		local := &fakeLocal{}
+		local.on("docker image inspect", "", errors.New("no such image"))
+		entry := NewDeployEntry(context.Background(), newTestComposeConfig(), local, config.DeployStatusSuccess)
+		if got := entry.ComposeInfo.Services["web"]; got.Image != "myapp-web:20240101000000" || got.ImageID != "" {
+			t.Errorf("Services[web] = %+v", got)
+		}
+	})
+
+	t.Run("Dockerfile", func(t *testing.T) {
+		local := &fakeLocal{}
+		entry := NewDeployEntry(context.Background(), newTestConfig(), local, config.DeployStatusSuccess)
+		if entry.Image != "myapp:20240101000000" || entry.ComposeInfo.Services != nil {
+			t.Errorf("単一コンテナのエントリが想定と異なります: %+v", entry)
+		}
+		if len(local.commands) != 0 {
+			t.Errorf("ローカルコマンドが実行されています: %v", local.commands)
+		}
+	})
+}
+
+func TestEntryComposeImages(t *testing.T) {
+	// サービスごとの記録がない旧形式の履歴
+	var entry config.DeployHistoryEntry
+	entry.Image = "web_web:20231114000001"
+	entry.ComposeInfo.ServiceName = "web"
+	images := entryComposeImages(entry)
+	if len(images) != 1 || images["web"] != "web_web:20231114000001" {
+		t.Errorf("entryComposeImages() = %v", images)
+	}
+}
+
+func TestResolveComposeCommands(t *testing.T) {
+	t.Run("ローカル v2 / リモート v1", func(t *testing.T) {
+		var conf config.Config
+		local := &fakeLocal{}
+		remote := &fakeRemote{}
+		remote.on("docker compose", "", errors.New("docker: 'compose' is not a docker command"))
+		if err := ResolveComposeCommands(context.Background(), &conf, local, remote); err != nil {
+			t.Fatalf("ResolveComposeCommands() error = %v", err)
+		}
+		if conf.Docker.ComposeCommand != "docker compose" || conf.Remote.ComposeCommand != "docker-compose" {
+			t.Errorf("検出結果 = %q / %q", conf.Docker.ComposeCommand, conf.Remote.ComposeCommand)
+		}
+		conf.Deploy.RemoteTempDir = "~/tmp"
+		conf.Docker.ComposeFile = "docker-compose.yml"
+		if got, want := composeDownCmd(conf, "~/tmp"), "cd ~/tmp && docker-compose -f docker-compose.yml down"; got != want {
+			t.Errorf("composeDownCmd() = %s, want %s", got, want)
+		}
+	})
+
+	t.Run("compose_command 指定時は検出しない", func(t *testing.T) {
+		var conf config.Config
+		conf.Docker.ComposeCommand = "docker-compose"
+		local := &fakeLocal{}
+		remote := &fakeRemote{}
+		if err := ResolveComposeCommands(context.Background(), &conf, local, remote); err != nil {
+			t.Fatalf("ResolveComposeCommands() error = %v", err)
+		}
+		if len(local.commands)+len(remote.commands) != 0 {
+			t.Errorf("検出コマンドが実行されています: %v %v", local.commands, remote.commands)
+		}
+		if got := remoteComposeCommand(conf); got != "docker-compose" {
+			t.Errorf("remoteComposeCommand() = %s, want docker-compose", got)
+		}
+	})
+
+	t.Run("リモートに compose がない", func(t *testing.T) {
+		var conf config.Config
+		remote := &fakeRemote{}
+		remote.on("docker", "", errors.New("command not found"))
+		if err := ResolveComposeCommands(context.Background(), &conf, &fakeLocal{}, remote); err == nil {
+			t.Error("リモートに compose がない場合にエラーが返されていません")
+		}
+	})
+}
+
+func TestComposeProjectName(t *testing.T) {
+	chdirComposeProject(t)
+	conf := newTestComposeConfig()
+	conf.Compose.ProjectName = ""
+	project, err := ParseComposeFile(conf.Docker.ComposeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := composeProjectName(conf, project); got != "myapp" {
+		t.Errorf("name: を使ったプロジェクト名 = %s, want myapp", got)
+	}
+
+	conf.Compose.ProjectName = "shop"
+	if got := composeProjectName(conf, project); got != "shop" {
+		t.Errorf("project_name を使ったプロジェクト名 = %s, want shop", got)
+	}
+	if got, want := composeUpCmd(conf, "~/apps/shop/current"),
+		"cd ~/apps/shop/current && docker-compose -p shop -f docker-compose.yml -f docker-compose.sailor.yml up -d"; got != want {
+		t.Errorf("composeUpCmd() = %s, want %s", got, want)
+	}
+}
+
+func TestResolveProjectName(t *testing.T) {
+	t.Run("リポジトリ名", func(t *testing.T) {
+		chdirWithFiles(t, map[string]string{"docker-compose.yml": "services:\n  web:\n    build: .\n"})
+		conf := newTestComposeConfig()
+		conf.Compose.ProjectName = ""
+		local := &fakeLocal{}
+		local.on("git rev-parse --show-toplevel", "/home/dev/My Shop\n", nil)
+		ResolveProjectName(context.Background(), &conf, local)
+		if conf.Compose.ProjectName != "myshop" {
+			t.Errorf("ProjectName = %s, want myshop", conf.Compose.ProjectName)
+		}
+	})
+
+	t.Run("name: があれば git を実行しない", func(t *testing.T) {
+		chdirComposeProject(t)
+		conf := newTestComposeConfig()
+		conf.Compose.ProjectName = ""
+		local := &fakeLocal{}
+		ResolveProjectName(context.Background(), &conf, local)
+		if conf.Compose.ProjectName != "myapp" || len(local.commands) != 0 {
+			t.Errorf("ProjectName = %s, commands = %v", conf.Compose.ProjectName, local.commands)
+		}
+	})
+
+	t.Run("リポジトリ外ではディレクトリ名", func(t *testing.T) {
+		chdirWithFiles(t, map[string]string{"deploy/docker-compose.yml": "services:\n  web:\n    build: .\n"})
+		conf := newTestComposeConfig()
+		conf.Compose.ProjectName = ""
+		conf.Docker.ComposeFile = "deploy/docker-compose.yml"
+		local := &fakeLocal{}
+		local.on("git", "", errors.New("not a git repository"))
+		ResolveProjectName(context.Background(), &conf, local)
+		if conf.Compose.ProjectName != "deploy" {
+			t.Errorf("ProjectName = %s, want deploy", conf.Compose.ProjectName)
+		}
+	})
+}
+
+func TestNormalizeProjectName(t *testing.T) {
+	tests := map[string]string{
+		"MyApp":        "myapp",
+		"my app.v2":    "myappv2",
+		"_sailor-test": "sailor-test",
+	}
+	for in, want := range tests {
+		if got := normalizeProjectName(in); got != want {
+			t.Errorf("normalizeProjectName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package internal
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+	"gopkg.in/yaml.v3"
+)
+
+// ComposeProject は compose ファイルを解析した結果
+type ComposeProject struct {
+	Name       string                    // トップレベルの name:（未指定なら空）
+	Files      []string                  // 読み込んだ compose ファイル（include / extends で参照されたものを含む）
+	Services   map[string]ComposeService // サービス名をキーとしたサービス定義
+	EnvFiles   []string                  // サービスの env_file で参照されているファイル
+	LocalFiles []string                  // バインドマウント・configs・secrets で参照されているファイル
+	Warnings   []string                  // 自動で転送できないパスなどの警告
+}
+
+// ComposeService は compose のサービス定義のうち sailor が使う情報
+type ComposeService struct {
+	Name  string
+	Image string // image: の値（未指定なら空）
+	Build bool   // build: を持つ（extends 元を含む）かどうか
+}
+
+// BuildServices は build: を持つサービス名を名前順に返す
+func (p *ComposeProject) BuildServices() []string {
+	var services []string
+	for name, svc := range p.Services {
+		if svc.Build {
+			services = append(services, name)
+		}
+	}
+	sort.Strings(services)
+	return services
+}
+
+// composeParser は compose ファイルを再帰的に読み込む
+type composeParser struct {
+	project *ComposeProject
+	docs    map[string]map[string]any // 読み込み済みの compose ファイル
+	files   map[string]bool           // 収集済みのファイル
+}
+
+// ParseComposeFile は compose ファイルを解析し、サービスと転送が必要なローカルファイルを収集する関数
+// パスはカレントディレクトリからの相対パスで返す
+func ParseComposeFile(path string) (*ComposeProject, error) {
+	p := &composeParser{
+		project: &ComposeProject{Services: make(map[string]ComposeService)},
+		docs:    make(map[string]map[string]any),
+		files:   make(map[string]bool),
+	}
+	path = filepath.Clean(path)
+	if err := p.parseFile(path); err != nil {
+		return nil, err
+	}
+	p.project.Name, _ = p.docs[path]["name"].(string)
+	sort.Strings(p.project.EnvFiles)
+	sort.Strings(p.project.LocalFiles)
+	return p.project, nil
+}
+
+// load は compose ファイルを読み込む。同じファイルは一度だけ読み込む
+func (p *composeParser) load(path string) (map[string]any, error) {
+	if doc, ok := p.docs[path]; ok {
+		return doc, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("composeファイル %s の読み込みに失敗: %w", path, err)
+	}
+	doc := make(map[string]any)
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("composeファイル %s の解析に失敗: %w", path, err)
+	}
+	p.docs[path] = doc
+	p.files[path] = true
+	p.project.Files = append(p.project.Files, path)
+	return doc, nil
+}
+
+// parseFile は compose ファイルとその include を読み込み、サービスを登録する
+func (p *composeParser) parseFile(path string) error {
+	if _, ok := p.docs[path]; ok {
+		return nil
+	}
+	doc, err := p.load(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+
+	// include はそれぞれ独立した compose ファイルとしてサービスを取り込む
+	for _, item := range asList(doc["include"]) {
+		var paths []string
+		switch v := item.(type) {
+		case string:
+			paths = []string{v}
+		case map[string]any:
+			paths = asStrings(v["path"])
+			for _, envFile := range asStrings(v["env_file"]) {
+				p.addEnvFile(dir, envFile, "include の env_file")
+			}
+		}
+		for _, include := range paths {
+			resolved, ok := p.resolve(dir, include, "include")
+			if !ok {
+				continue
+			}
+			if err := p.parseFile(resolved); err != nil {
+				return err
+			}
+		}
+	}
+
+	services := asMap(doc["services"])
+	for _, name := range sortedKeys(services) {
+		svc := asMap(services[name])
+		build, err := p.collectService(path, name, svc, 0)
+		if err != nil {
+			return err
+		}
+		image, _ := svc["image"].(string)
+		p.project.Services[name] = ComposeService{Name: name, Image: image, Build: build}
+	}
+
+	// トップレベルの configs / secrets のうちファイルから作成するもの
+	for _, key := range []string{"configs", "secrets"} {
+		entries := asMap(doc[key])
+		for _, name := range sortedKeys(entries) {
+			if file, ok := asMap(entries[name])["file"].(string); ok {
+				p.addLocalFile(dir, file, key+" "+name)
+			}
+		}
+	}
+	return nil
+}
+
+// collectService はサービスが参照するファイルを収集し、build: を持つかどうかを返す
+// extends で参照されたサービスも再帰的にたどる
+func (p *composeParser) collectService(path, name string, svc map[string]any, depth int) (bool, error) {
+	if depth > 10 {
+		return false, fmt.Errorf("サービス %s の extends が深すぎます（循環している可能性があります）", name)
+	}
+	dir := filepath.Dir(path)
+	_, build := svc["build"]
+
+	for _, item := range asList(svc["env_file"]) {
+		switch v := item.(type) {
+		case string:
+			p.addEnvFile(dir, v, "サービス "+name+" の env_file")
+		case map[string]any:
+			if envFile, ok := v["path"].(string); ok {
+				p.addEnvFile(dir, envFile, "サービス "+name+" の env_file")
+			}
+		}
+	}
+
+	for _, item := range asList(svc["volumes"]) {
+		switch v := item.(type) {
+		case string:
+			source, _, found := strings.Cut(v, ":")
+			if found && isBindSource(source) {
+				p.addLocalFile(dir, source, "サービス "+name+" のバインドマウント")
+			}
+		case map[string]any:
+			if v["type"] == "bind" {
+				if source, ok := v["source"].(string); ok {
+					p.addLocalFile(dir, source, "サービス "+name+" のバインドマウント")
+				}
+			}
+		}
+	}
+
+	// extends: "service" は同じファイル、extends: {file, service} は別ファイルのサービスを継承する
+	var basePath, baseName string
+	switch v := svc["extends"].(type) {
+	case string:
+		basePath, baseName = path, v
+	case map[string]any:
+		baseName, _ = v["service"].(string)
+		basePath = path
+		if file, ok := v["file"].(string); ok {
+			resolved, ok := p.resolve(dir, file, "サービス "+name+" の extends")
+			if !ok {
+				return build, nil
+			}
+			basePath = resolved
+		}
+	default:
+		return build, nil
+	}
+
+	doc, err := p.load(basePath)
+	if err != nil {
+		return false, err
+	}
+	base, ok := asMap(doc["services"])[baseName].(map[string]any)
+	if !ok {
+		return false, fmt.Errorf("サービス %s の extends 先 %s が %s に見つかりません", name, baseName, basePath)
+	}
+	baseBuild, err := p.collectService(basePath, baseName, base, depth+1)
+	return build || baseBuild, err
+}
+
+// resolve は compose ファイルからの相対パスをカレントディレクトリからの相対パスに変換する
+// 自動で転送できないパスの場合は警告を記録して false を返す
+func (p *composeParser) resolve(dir, path, kind string) (string, bool) {
+	switch {
+	case strings.Contains(path, "$"):
+		p.warn("%s のパス %s は変数を含むため自動で転送できません", kind, path)
+		return "", false
+	case filepath.IsAbs(path) || strings.HasPrefix(path, "~"):
+		p.warn("%s の絶対パス %s は転送されません。リモートサーバー上にも同じパスで存在する必要があります", kind, path)
+		return "", false
+	}
+	resolved := filepath.Join(dir, path)
+	if resolved == ".." || strings.HasPrefix(resolved, ".."+string(filepath.Separator)) {
+		p.warn("%s のパス %s はプロジェクトの外にあるため転送されません", kind, path)
+		return "", false
+	}
+	return resolved, true
+}
+
+// addEnvFile は env_file で参照されたファイルを収集する
+func (p *composeParser) addEnvFile(dir, path, kind string) {
+	resolved, ok := p.resolve(dir, path, kind)
+	if !ok || p.files[resolved] {
+		return
+	}
+	if _, err := os.Stat(resolved); err != nil {
+		p.warn("%s %s が見つかりません", kind, resolved)
+		return
+	}
+	p.files[resolved] = true
+	p.project.EnvFiles = append(p.project.EnvFiles, resolved)
+}
+
+// addLocalFile はファイルまたはディレクトリ配下のファイルを収集する
+func (p *composeParser) addLocalFile(dir, path, kind string) {
+	resolved, ok := p.resolve(dir, path, kind)
+	if !ok {
+		return
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		p.warn("%s %s が見つかりません", kind, resolved)
+		return
+	}
+	if !info.IsDir() {
+		if !p.files[resolved] {
+			p.files[resolved] = true
+			p.project.LocalFiles = append(p.project.LocalFiles, resolved)
+		}
+		return
+	}
+	// .:/app のようなプロジェクト全体のマウントはリポジトリ全体を転送することになるため対象にしない
+	if resolved == "." {
+		p.warn("%s %s はプロジェクト全体のため転送されません。必要なファイルは [compose] extra_files に指定してください", kind, path)
+		return
+	}
+	filepath.WalkDir(resolved, func(file string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && (d.Name() == ".git" || file == ArtifactDir) {
+			return filepath.SkipDir
+		}
+		if err != nil || !d.Type().IsRegular() || p.files[file] {
+			return nil
+		}
+		p.files[file] = true
+		p.project.LocalFiles = append(p.project.LocalFiles, file)
+		return nil
+	})
+}
+
+func (p *composeParser) warn(format string, args ...any) {
+	p.project.Warnings = append(p.project.Warnings, fmt.Sprintf(format, args...))
+}
+
+// isBindSource はボリュームの短縮記法のソースがホストのパスかどうかを返す（名前付きボリュームは false）
+func isBindSource(source string) bool {
+	return strings.HasPrefix(source, ".") || strings.HasPrefix(source, "/") || strings.HasPrefix(source, "~")
+}
+
+// asList は単一の値またはリストをリストとして返す
+func asList(v any) []any {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []any:
+		return v
+	default:
+		return []any{v}
+	}
+}
+
+// asStrings は文字列または文字列のリストを返す
+func asStrings(v any) []string {
+	var result []string
+	for _, item := range asList(v) {
+		if s, ok := item.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func asMap(v any) map[string]any {
+	m, _ := v.(map[string]any)
+	return m
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// PrepareCompose は compose ファイルを解析し、転送するファイルとデプロイ対象のサービスを設定に反映する関数
+// [compose] services と [docker] service_name がどちらも未指定の場合は build: を持つ全サービスを対象にする
+func PrepareCompose(conf *config.Config) ([]string, error) {
+	project, err := ParseComposeFile(conf.Docker.ComposeFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// 以降のローカル・リモートの compose コマンドで同じプロジェクト名を使う
+	conf.Compose.ProjectName = composeProjectName(*conf, project)
+	conf.Compose.EnvFiles = appendMissing(conf.Compose.EnvFiles, project.EnvFiles...)
+	conf.Compose.ExtraFiles = appendMissing(conf.Compose.ExtraFiles, project.Files[1:]...)
+	conf.Compose.ExtraFiles = appendMissing(conf.Compose.ExtraFiles, project.LocalFiles...)
+
+	if len(conf.Compose.Services) == 0 && conf.Docker.ServiceName == "" {
+		conf.Compose.Services = project.BuildServices()
+		if len(conf.Compose.Services) == 0 {
+			return nil, fmt.Errorf("%s に build: を持つサービスがありません", conf.Docker.ComposeFile)
+		}
+	}
+	for _, service := range composeServices(*conf) {
+		if _, ok := project.Services[service]; !ok {
+			return nil, fmt.Errorf("サービス %s が %s に見つかりません", service, conf.Docker.ComposeFile)
+		}
+	}
+	return project.Warnings, nil
+}
+
+// appendMissing は list に含まれていない要素だけを追加する
+func appendMissing(list []string, items ...string) []string {
+	seen := make(map[string]bool, len(list))
+	for _, item := range list {
+		seen[filepath.Clean(item)] = true
+	}
+	for _, item := range items {
+		if !seen[item] {
+			seen[item] = true
+			list = append(list, item)
+		}
+	}
+	return list
+}
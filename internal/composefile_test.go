@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// chdirWithFiles は一時ディレクトリにファイルを作成し、カレントディレクトリを移動する
+func chdirWithFiles(t *testing.T, files map[string]string) {
+	t.Helper()
+	tempDir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(tempDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	originalWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tempDir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(originalWd) })
+}
+
+const testComposeFile = `
+include:
+  - db/compose.yml
+services:
+  web:
+    build: .
+    env_file:
+      - .env
+      - path: .env.local
+        required: false
+    volumes:
+      - ./nginx.conf:/etc/nginx/nginx.conf:ro
+      - ./static:/usr/share/static
+      - data:/var/lib/data
+      - /var/log/app:/logs
+      - type: bind
+        source: ./certs/server.pem
+        target: /certs/server.pem
+  worker:
+    extends:
+      file: common.yml
+      service: base
+    command: worker
+  cache:
+    image: redis:7
+configs:
+  app_config:
+    file: ./config/app.toml
+secrets:
+  token:
+    file: ${HOME}/token
+volumes:
+  data:
+`
+
+func TestParseComposeFile(t *testing.T) {
+	chdirWithFiles(t, map[string]string{
+		"docker-compose.yml": testComposeFile,
+		"common.yml":         "services:\n  base:\n    build: ./worker\n    env_file: worker.env\n",
+		"db/compose.yml":     "services:\n  db:\n    image: postgres:16\n    volumes:\n      - ./init.sql:/docker-entrypoint-initdb.d/init.sql\n",
+		"db/init.sql":        "create table t (id int);",
+		".env":               "A=1",
+		"worker.env":         "B=2",
+		"nginx.conf":         "events {}",
+		"static/index.html":  "<html></html>",
+		"static/css/app.css": "body {}",
+		"certs/server.pem":   "pem",
+		"config/app.toml":    "x = 1",
+	})
+
+	project, err := ParseComposeFile("docker-compose.yml")
+	if err != nil {
+		t.Fatalf("ParseComposeFile() error = %v", err)
+	}
+
+	if want := []string{"docker-compose.yml", "db/compose.yml", "common.yml"}; !reflect.DeepEqual(project.Files, want) {
+		t.Errorf("Files = %v, want %v", project.Files, want)
+	}
+	if want := []string{".env", "worker.env"}; !reflect.DeepEqual(project.EnvFiles, want) {
+		t.Errorf("EnvFiles = %v, want %v", project.EnvFiles, want)
+	}
+	wantFiles := []string{"certs/server.pem", "config/app.toml", "db/init.sql", "nginx.conf", "static/css/app.css", "static/index.html"}
+	if !reflect.DeepEqual(project.LocalFiles, wantFiles) {
+		t.Errorf("LocalFiles = %v, want %v", project.LocalFiles, wantFiles)
+	}
+	if want := []string{"web", "worker"}; !reflect.DeepEqual(project.BuildServices(), want) {
+		t.Errorf("BuildServices() = %v, want %v", project.BuildServices(), want)
+	}
+	if got := project.Services["db"].Image; got != "postgres:16" {
+		t.Errorf("include したサービスのイメージ = %q, want postgres:16", got)
+	}
+
+	warnings := strings.Join(project.Warnings, "\n")
+	for _, want := range []string{"/var/log/app", "${HOME}/token", ".env.local"} {
+		if !strings.Contains(warnings, want) {
+			t.Errorf("警告に %s が含まれていません:\n%s", want, warnings)
+		}
+	}
+	if strings.Contains(warnings, "data") {
+		t.Errorf("名前付きボリュームが警告されています:\n%s", warnings)
+	}
+}
+
+func TestParseComposeFileProjectMount(t *testing.T) {
+	chdirWithFiles(t, map[string]string{
+		"docker-compose.yml":    "services:\n  web:\n    build: .\n    volumes:\n      - .:/app\n      - ./src:/src\n",
+		".git/HEAD":             "ref: refs/heads/main\n",
+		".sailor/deploy.tar.gz": "image",
+		"node_modules/a/b.js":   "x",
+		"src/main.js":           "x",
+		"src/.git/HEAD":         "ref: refs/heads/main\n",
+	})
+	project, err := ParseComposeFile("docker-compose.yml")
+	if err != nil {
+		t.Fatalf("ParseComposeFile() error = %v", err)
+	}
+	// プロジェクト全体のマウントは転送せず、サブディレクトリの .git も除く
+	if want := []string{"src/main.js"}; !reflect.DeepEqual(project.LocalFiles, want) {
+		t.Errorf("LocalFiles = %v, want %v", project.LocalFiles, want)
+	}
+	if warnings := strings.Join(project.Warnings, "\n"); !strings.Contains(warnings, "プロジェクト全体") {
+		t.Errorf("プロジェクト全体のマウントの警告がありません:\n%s", warnings)
+	}
+}
+
+func TestParseComposeFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		compose string
+		want    string
+	}{
+		{"YAMLの構文エラー", "services: [", "解析に失敗"},
+		{"存在しない extends 先", "services:\n  web:\n    extends: base\n", "extends 先 base"},
+		{"循環した extends", "services:\n  a:\n    extends: b\n  b:\n    extends: a\n", "extends が深すぎます"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chdirWithFiles(t, map[string]string{"docker-compose.yml": tt.compose})
+			_, err := ParseComposeFile("docker-compose.yml")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseComposeFile() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("ファイルが存在しない", func(t *testing.T) {
+		chdirWithFiles(t, nil)
+		if _, err := ParseComposeFile("docker-compose.yml"); err == nil {
+			t.Error("存在しないファイルでエラーが返されていません")
+		}
+	})
+}
+
+func TestPrepareCompose(t *testing.T) {
+	files := map[string]string{
+		"docker-compose.yml": "services:\n  web:\n    build: .\n    env_file: .env.prod\n  worker:\n    build: ./worker\n  db:\n    image: postgres:16\n",
+		".env.prod":          "A=1",
+	}
+
+	t.Run("build: を持つ全サービス", func(t *testing.T) {
+		chdirWithFiles(t, files)
+		conf := newTestComposeConfig()
+		conf.Docker.ServiceName = ""
+		if _, err := PrepareCompose(&conf); err != nil {
+			t.Fatalf("PrepareCompose() error = %v", err)
+		}
+		if want := []string{"web", "worker"}; !reflect.DeepEqual(conf.Compose.Services, want) {
+			t.Errorf("Services = %v, want %v", conf.Compose.Services, want)
+		}
+		// 設定済みの .env.prod は重複して追加しない
+		if want := []string{".env", ".env.prod"}; !reflect.DeepEqual(conf.Compose.EnvFiles, want) {
+			t.Errorf("EnvFiles = %v, want %v", conf.Compose.EnvFiles, want)
+		}
+	})
+
+	t.Run("service_name 指定", func(t *testing.T) {
+		chdirWithFiles(t, files)
+		conf := newTestComposeConfig()
+		if _, err := PrepareCompose(&conf); err != nil {
+			t.Fatalf("PrepareCompose() error = %v", err)
+		}
+		if len(conf.Compose.Services) != 0 {
+			t.Errorf("service_name 指定時にサービスが展開されています: %v", conf.Compose.Services)
+		}
+	})
+
+	t.Run("存在しないサービス", func(t *testing.T) {
+		chdirWithFiles(t, files)
+		conf := newTestComposeConfig()
+		conf.Compose.Services = []string{"web", "api"}
+		if _, err := PrepareCompose(&conf); err == nil || !strings.Contains(err.Error(), "api") {
+			t.Errorf("存在しないサービスでエラーが返されていません: %v", err)
+		}
+	})
+}
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// ContainerSpec は単一コンテナモードで起動するコンテナの設定
+// デプロイとロールバックで同じ docker run コマンドを組み立てるために使う
+type ContainerSpec struct {
+	Name        string
+	Image       string
+	Ports       []string
+	Environment map[string]string
+	Volumes     []string
+	Restart     string
+	Networks    []string
+	Memory      string
+	CPUs        string
+	User        string
+	Labels      map[string]string
+	LogDriver   string
+	LogOptions  map[string]string
+	ExtraHosts  []string
+	Devices     []string
+	Command     string
+	Entrypoint  string
+
+	HealthCmd         string
+	HealthInterval    string
+	HealthTimeout     string
+	HealthRetries     int
+	HealthStartPeriod string
+}
+
+// NewContainerSpec は [remote] の設定から image を起動するコンテナの設定を作成する関数
+func NewContainerSpec(conf config.Config, image string) ContainerSpec {
+	r := conf.Remote
+	return ContainerSpec{
+		Name:              r.ContainerName,
+		Image:             image,
+		Ports:             r.Ports,
+		Environment:       r.Environment,
+		Volumes:           r.Volumes,
+		Restart:           r.Restart,
+		Networks:          r.Networks,
+		Memory:            r.Memory,
+		CPUs:              r.CPUs,
+		User:              r.User,
+		Labels:            r.Labels,
+		LogDriver:         r.LogDriver,
+		LogOptions:        r.LogOptions,
+		ExtraHosts:        r.ExtraHosts,
+		Devices:           r.Devices,
+		Command:           r.Command,
+		Entrypoint:        r.Entrypoint,
+		HealthCmd:         r.Healthcheck.Cmd,
+		HealthInterval:    r.Healthcheck.Interval,
+		HealthTimeout:     r.Healthcheck.Timeout,
+		HealthRetries:     r.Healthcheck.Retries,
+		HealthStartPeriod: r.Healthcheck.StartPeriod,
+	}
+}
+
+// containerGroupLabel は [[remote.containers]] で起動したコンテナに付けるラベル（値はプロジェクト名）
+const containerGroupLabel = "sailor.group"
+
+// ContainerSpecs はデプロイで起動するコンテナの設定を起動順に返す関数
+// [[remote.containers]] が無い場合は container_name の1つだけを返す
+func ContainerSpecs(conf config.Config, image string) []ContainerSpec {
+	if len(conf.Remote.Containers) == 0 {
+		return []ContainerSpec{NewContainerSpec(conf, image)}
+	}
+
+	var specs []ContainerSpec
+	for _, c := range conf.Remote.Containers {
+		spec := NewContainerSpec(conf, image)
+		spec.Ports = c.Ports
+		spec.Volumes = append(append([]string{}, conf.Remote.Volumes...), c.Volumes...)
+		spec.Environment = make(map[string]string, len(conf.Remote.Environment)+len(c.Environment))
+		for key, value := range conf.Remote.Environment {
+			spec.Environment[key] = value
+		}
+		for key, value := range c.Environment {
+			spec.Environment[key] = value
+		}
+		if c.Command != "" {
+			spec.Command = c.Command
+		}
+		spec.Labels = make(map[string]string, len(conf.Remote.Labels)+1)
+		for key, value := range conf.Remote.Labels {
+			spec.Labels[key] = value
+		}
+		spec.Labels[containerGroupLabel] = ProjectName(conf)
+
+		if c.Replicas <= 1 {
+			spec.Name = c.Name
+			specs = append(specs, spec)
+			continue
+		}
+		for i := 1; i <= c.Replicas; i++ {
+			replica := spec
+			replica.Name = fmt.Sprintf("%s-%d", c.Name, i)
+			specs = append(specs, replica)
+		}
+	}
+	return specs
+}
+
+// ValidateContainers は [[remote.containers]] の設定を確認する関数
+// replicas が 2 以上のコンテナはすべて同じ ports で起動するため、ホスト側のポートを指定していると 2 つ目以降の起動に失敗する
+func ValidateContainers(conf config.Config) error {
+	for _, c := range conf.Remote.Containers {
+		if c.Replicas <= 1 {
+			continue
+		}
+		for _, port := range c.Ports {
+			if publishesHostPort(port) {
+				return fmt.Errorf("[[remote.containers]] %s は replicas = %d のため、ホスト側のポートを指定した ports %q は使えません（%q のようにコンテナ側のポートだけを指定してください）",
+					c.Name, c.Replicas, port, containerPort(port))
+			}
+		}
+	}
+	return nil
+}
+
+// publishesHostPort は -p の値がホスト側のポートを固定しているかどうかを返す
+// "80" や "127.0.0.1::80" のようにホスト側を省略した場合は Docker が空いているポートを割り当てる
+func publishesHostPort(port string) bool {
+	if strings.HasPrefix(port, "[") {
+		// [::1]:8080:80 のような IPv6 アドレスは先に取り除く
+		if _, rest, ok := strings.Cut(port, "]:"); ok {
+			port = "ip:" + rest
+		}
+	}
+	parts := strings.Split(port, ":")
+	switch len(parts) {
+	case 2:
+		return parts[0] != ""
+	case 3:
+		return parts[1] != ""
+	}
+	return false
+}
+
+// containerPort は -p の値のコンテナ側のポートを返す
+func containerPort(port string) string {
+	return port[strings.LastIndex(port, ":")+1:]
+}
+
+// RunArgs は docker run の引数を返す（値はリモートのシェル向けにクォート済み）
+func (s ContainerSpec) RunArgs() []string {
+	args := []string{"docker", "run", "-d", "--name", s.Name}
+	flag := func(name, value string) {
+		if value != "" {
+			args = append(args, name, shellArg(value))
+		}
+	}
+
+	flag("--restart", s.Restart)
+	flag("--user", s.User)
+	flag("--memory", s.Memory)
+	flag("--cpus", s.CPUs)
+	for _, p := range s.Ports {
+		flag("-p", p)
+	}
+	for _, key := range sortedStringKeys(s.Environment) {
+		flag("-e", key+"="+s.Environment[key])
+	}
+	for _, v := range s.Volumes {
+		flag("-v", v)
+	}
+	// docker run で指定できるネットワークは1つだけなので、残りは起動後に接続する
+	if len(s.Networks) > 0 {
+		flag("--network", s.Networks[0])
+	}
+	for _, host := range s.ExtraHosts {
+		flag("--add-host", host)
+	}
+	for _, device := range s.Devices {
+		flag("--device", device)
+	}
+	for _, key := range sortedStringKeys(s.Labels) {
+		flag("--label", key+"="+s.Labels[key])
+	}
+	flag("--log-driver", s.LogDriver)
+	for _, key := range sortedStringKeys(s.LogOptions) {
+		flag("--log-opt", key+"="+s.LogOptions[key])
+	}
+	flag("--health-cmd", s.HealthCmd)
+	flag("--health-interval", s.HealthInterval)
+	flag("--health-timeout", s.HealthTimeout)
+	if s.HealthRetries > 0 {
+		flag("--health-retries", strconv.Itoa(s.HealthRetries))
+	}
+	flag("--health-start-period", s.HealthStartPeriod)
+	flag("--entrypoint", s.Entrypoint)
+
+	args = append(args, shellArg(s.Image))
+	// command はシェルの単語分割に任せて引数として渡す
+	if s.Command != "" {
+		args = append(args, s.Command)
+	}
+	return args
+}
+
+// RunCommand はコンテナを起動し、追加のネットワークに接続するリモートコマンドを返す
+func (s ContainerSpec) RunCommand() string {
+	cmd := strings.Join(s.RunArgs(), " ")
+	for i := 1; i < len(s.Networks); i++ {
+		cmd += fmt.Sprintf(" && docker network connect %s %s", shellArg(s.Networks[i]), s.Name)
+	}
+	return cmd
+}
+
+// shellArg は値がシェルで分割・展開されないよう、必要な場合だけクォートして返す
+func shellArg(s string) string {
+	if s == "" {
+		return "''"
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@,+%~", r)) {
+			return shellQuote(s)
+		}
+	}
+	return s
+}
+
+// sortedStringKeys は実行するコマンドが毎回同じになるようキーを名前順に返す
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/linkalls/sailor/config"
+)
+
+func TestContainerSpecRunCommand(t *testing.T) {
+	t.Run("全オプション", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Remote.Restart = "unless-stopped"
+		conf.Remote.Networks = []string{"frontend", "backend"}
+		conf.Remote.Memory = "512m"
+		conf.Remote.CPUs = "1.5"
+		conf.Remote.User = "1000:1000"
+		conf.Remote.Labels = map[string]string{"team": "web", "owner": "ops team"}
+		conf.Remote.LogDriver = "json-file"
+		conf.Remote.LogOptions = map[string]string{"max-size": "10m"}
+		conf.Remote.ExtraHosts = []string{"db.internal:10.0.0.5"}
+		conf.Remote.Devices = []string{"/dev/ttyUSB0:/dev/ttyUSB0"}
+		conf.Remote.Command = "bundle exec puma"
+		conf.Remote.Entrypoint = "/docker-entrypoint.sh"
+		conf.Remote.Healthcheck.Cmd = "curl -f http://localhost/health"
+		conf.Remote.Healthcheck.Interval = "30s"
+		conf.Remote.Healthcheck.Retries = 3
+
+		want := "docker run -d --name myapp_container --restart unless-stopped --user 1000:1000 --memory 512m --cpus 1.5" +
+			" -p 80:80 -e A=1 -e B=2 -v /data:/app/data --network frontend --add-host db.internal:10.0.0.5" +
+			" --device /dev/ttyUSB0:/dev/ttyUSB0 --label 'owner=ops team' --label team=web" +
+			" --log-driver json-file --log-opt max-size=10m" +
+			" --health-cmd 'curl -f http://localhost/health' --health-interval 30s --health-retries 3" +
+			" --entrypoint /docker-entrypoint.sh myapp:20240101000000 bundle exec puma" +
+			" && docker network connect backend myapp_container"
+		if got := NewContainerSpec(conf, "myapp:20240101000000").RunCommand(); got != want {
+			t.Errorf("RunCommand()\ngot:  %s\nwant: %s", got, want)
+		}
+	})
+
+	t.Run("値のクォート", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Remote.Environment = map[string]string{"GREETING": "hello world", "QUOTE": "it's"}
+		want := "docker run -d --name myapp_container -p 80:80 -e 'GREETING=hello world' -e 'QUOTE=it'\\''s' -v /data:/app/data myapp:1"
+		if got := NewContainerSpec(conf, "myapp:1").RunCommand(); got != want {
+			t.Errorf("RunCommand()\ngot:  %s\nwant: %s", got, want)
+		}
+	})
+}
+
+func newTestGroupConfig() config.Config {
+	conf := newTestConfig()
+	conf.Remote.Ports = nil
+	conf.Remote.Containers = []config.RemoteContainer{
+		{Name: "myapp_web", Ports: []string{"80:80"}},
+		{Name: "myapp_worker", Command: "bin/worker", Environment: map[string]string{"B": "3"}, Replicas: 2},
+	}
+	return conf
+}
+
+func TestContainerSpecs(t *testing.T) {
+	specs := ContainerSpecs(newTestGroupConfig(), "myapp:1")
+	var names []string
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+	}
+	if want := []string{"myapp_web", "myapp_worker-1", "myapp_worker-2"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("コンテナ名 = %v, want %v", names, want)
+	}
+
+	want := "docker run -d --name myapp_worker-2 -e A=1 -e B=3 -v /data:/app/data --label sailor.group=myapp_container myapp:1 bin/worker"
+	if got := specs[2].RunCommand(); got != want {
+		t.Errorf("RunCommand()\ngot:  %s\nwant: %s", got, want)
+	}
+	// [remote] environment を共有していても他のコンテナの上書きが混ざらない
+	if specs[0].Environment["B"] != "2" {
+		t.Errorf("web の環境変数 B = %s, want 2", specs[0].Environment["B"])
+	}
+}
+
+func TestValidateContainers(t *testing.T) {
+	if err := ValidateContainers(newTestGroupConfig()); err != nil {
+		t.Errorf("replicas = 1 のホストポートでエラーになっています: %v", err)
+	}
+
+	for _, port := range []string{"80", "127.0.0.1::80", "80/udp"} {
+		conf := newTestGroupConfig()
+		conf.Remote.Containers[1].Ports = []string{port}
+		if err := ValidateContainers(conf); err != nil {
+			t.Errorf("ports %q: ホスト側のポートを指定していないのにエラーになっています: %v", port, err)
+		}
+	}
+
+	for _, port := range []string{"8080:80", "127.0.0.1:8080:80", "[::1]:8080:80", "8080:80/udp"} {
+		conf := newTestGroupConfig()
+		conf.Remote.Containers[1].Ports = []string{port}
+		err := ValidateContainers(conf)
+		if err == nil || !strings.Contains(err.Error(), "myapp_worker") {
+			t.Errorf("ports %q: replicas とホストポートの組み合わせでエラーが返されていません: %v", port, err)
+		}
+	}
+}
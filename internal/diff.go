@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// diffLists は2つのリストで追加・削除された要素を表示用の行で返す
+func diffLists(label string, from, to []string) []string {
+	var lines []string
+	for _, item := range to {
+		if !containsString(from, item) {
+			lines = append(lines, fmt.Sprintf("%s: + %s", label, item))
+		}
+	}
+	for _, item := range from {
+		if !containsString(to, item) {
+			lines = append(lines, fmt.Sprintf("%s: - %s", label, item))
+		}
+	}
+	return lines
+}
+
+// diffHashes は名前 → ハッシュのマップで追加・削除・変更された名前を表示用の行で返す
+func diffHashes(label, changed string, from, to map[string]string) []string {
+	names := make(map[string]bool)
+	for name := range from {
+		names[name] = true
+	}
+	for name := range to {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var lines []string
+	for _, name := range sorted {
+		before, inFrom := from[name]
+		after, inTo := to[name]
+		switch {
+		case !inFrom:
+			lines = append(lines, fmt.Sprintf("%s: + %s", label, name))
+		case !inTo:
+			lines = append(lines, fmt.Sprintf("%s: - %s", label, name))
+		case before != after:
+			lines = append(lines, fmt.Sprintf("%s: ~ %s（%s）", label, name, changed))
+		}
+	}
+	return lines
+}
+
+// ConfigDiff は2つの履歴エントリのイメージ・環境変数・ポート・ボリューム・compose のファイルの差分を表示用の行で返す関数
+// 環境変数の値とファイルの内容はハッシュで比較するため、変更されたかどうかだけを表示する
+func ConfigDiff(from, to config.DeployHistoryEntry) []string {
+	var lines []string
+
+	// イメージはビルドした結果が記録されている場合だけ比較する（HEAD はビルドしていない）
+	if from.Image != "" && to.Image != "" {
+		lines = append(lines, diffLists("イメージ", historyImages(from), historyImages(to))...)
+	}
+
+	for _, key := range []string{"target_env", "project_name"} {
+		before, after := from.ComposeInfo.Config[key], to.ComposeInfo.Config[key]
+		if fmt.Sprint(before) != fmt.Sprint(after) {
+			lines = append(lines, fmt.Sprintf("%s: %v → %v", key, valueOrNone(before), valueOrNone(after)))
+		}
+	}
+	lines = append(lines, diffLists("サービス", splitServices(from.ComposeInfo.ServiceName), splitServices(to.ComposeInfo.ServiceName))...)
+
+	if from.Settings.Empty() || to.Settings.Empty() {
+		return append(lines, "（設定が記録されていない古い履歴のため、環境変数・ポート・ファイルは比較できません）")
+	}
+	lines = append(lines, diffHashes("環境変数", "値が変更されています", from.Settings.Environment, to.Settings.Environment)...)
+	lines = append(lines, diffLists("ポート", from.Settings.Ports, to.Settings.Ports)...)
+	lines = append(lines, diffLists("ボリューム", from.Settings.Volumes, to.Settings.Volumes)...)
+	lines = append(lines, diffHashes("ファイル", "内容が変更されています", from.Settings.Files, to.Settings.Files)...)
+	return lines
+}
+
+// valueOrNone は値が無い場合に "(なし)" を返す
+func valueOrNone(v any) any {
+	if v == nil || v == "" {
+		return "(なし)"
+	}
+	return v
+}
+
+// splitServices は "web,worker" 形式のサービス名を分割する
+func splitServices(services string) []string {
+	if services == "" {
+		return nil
+	}
+	return strings.Split(services, ",")
+}
+
+// ShowDiff は2つのデプロイの間のコミット・変更されたファイル・設定の差分を表示する関数
+// to が from より古い場合（ロールバック）は取り消されるコミットを表示する
+func ShowDiff(ctx context.Context, local LocalRunner, from, to config.DeployHistoryEntry) error {
+	for _, entry := range []config.DeployHistoryEntry{from, to} {
+		if entry.CommitHash == "" || entry.CommitHash == "unknown" {
+			return fmt.Errorf("バージョン %s のコミットが記録されていません", entry.Version)
+		}
+		if err := local.Run(ctx, "git", "cat-file", "-e", entry.CommitHash+"^{commit}"); err != nil {
+			return fmt.Errorf("コミット %s が見つかりません（git fetch が必要かもしれません）", entry.CommitHash)
+		}
+	}
+	fmt.Printf("%s (%s) → %s (%s)\n", from.Version, from.CommitHash, to.Version, to.CommitHash)
+
+	// to が from の祖先ならロールバックなので、取り消されるコミットを表示する
+	commits := from.CommitHash + ".." + to.CommitHash
+	fmt.Println("\n=== コミット ===")
+	if from.CommitHash != to.CommitHash && local.Run(ctx, "git", "merge-base", "--is-ancestor", to.CommitHash, from.CommitHash) == nil {
+		commits = to.CommitHash + ".." + from.CommitHash
+		fmt.Println("（ロールバックで取り消されるコミット）")
+	}
+	if err := local.Run(ctx, "git", "--no-pager", "log", "--oneline", "--no-decorate", commits); err != nil {
+		return fmt.Errorf("git log の実行に失敗: %w", err)
+	}
+
+	fmt.Println("\n=== 変更されたファイル ===")
+	if err := local.Run(ctx, "git", "--no-pager", "diff", "--stat", from.CommitHash, to.CommitHash); err != nil {
+		return fmt.Errorf("git diff の実行に失敗: %w", err)
+	}
+
+	fmt.Println("\n=== 設定の差分 ===")
+	lines := ConfigDiff(from, to)
+	if len(lines) == 0 {
+		fmt.Println("設定の変更はありません")
+	}
+	for _, line := range lines {
+		fmt.Println("  " + line)
+	}
+	return nil
+}
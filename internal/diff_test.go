@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/linkalls/sailor/config"
+)
+
+func TestConfigDiff(t *testing.T) {
+	from := config.DeployHistoryEntry{
+		Version:    "1700000000",
+		CommitHash: "aaa1111",
+		Image:      "myapp:aaa1111",
+		Settings: config.DeploySettings{
+			Environment: map[string]string{"A": "hash-a", "B": "hash-b", "OLD": "hash-old"},
+			Ports:       []string{"80:80"},
+			Volumes:     []string{"/data:/app/data"},
+		},
+	}
+	to := config.DeployHistoryEntry{
+		Version:    "1700000001",
+		CommitHash: "bbb2222",
+		Image:      "myapp:bbb2222",
+		Settings: config.DeploySettings{
+			Environment: map[string]string{"A": "hash-a", "B": "hash-b2", "NEW": "hash-new"},
+			Ports:       []string{"8080:80"},
+			Volumes:     []string{"/data:/app/data"},
+		},
+	}
+
+	want := []string{
+		"イメージ: + myapp:bbb2222",
+		"イメージ: - myapp:aaa1111",
+		"環境変数: ~ B（値が変更されています）",
+		"環境変数: + NEW",
+		"環境変数: - OLD",
+		"ポート: + 8080:80",
+		"ポート: - 80:80",
+	}
+	if got := ConfigDiff(from, to); !reflect.DeepEqual(got, want) {
+		t.Errorf("ConfigDiff()\ngot:  %q\nwant: %q", got, want)
+	}
+
+	// HEAD（イメージ無し）や設定が記録されていない古い履歴との比較
+	to.Image = ""
+	from.Settings = config.DeploySettings{}
+	want = []string{"（設定が記録されていない古い履歴のため、環境変数・ポート・ファイルは比較できません）"}
+	if got := ConfigDiff(from, to); !reflect.DeepEqual(got, want) {
+		t.Errorf("ConfigDiff()\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestConfigDiffCompose(t *testing.T) {
+	from := config.DeployHistoryEntry{Image: "myapp-web:1"}
+	from.ComposeInfo.ServiceName = "web"
+	from.ComposeInfo.Config = map[string]any{"target_env": "staging"}
+	from.Settings.Files = map[string]string{"docker-compose.yml": "1", ".env": "1"}
+	to := config.DeployHistoryEntry{Image: "myapp-web:2"}
+	to.ComposeInfo.ServiceName = "web,worker"
+	to.ComposeInfo.Config = map[string]any{"target_env": "production"}
+	to.ComposeInfo.Services = map[string]config.ComposeServiceImage{"web": {Image: "myapp-web:2"}, "worker": {Image: "myapp-worker:2"}}
+	to.Settings.Files = map[string]string{"docker-compose.yml": "1", ".env": "2", "nginx.conf": "1"}
+
+	want := []string{
+		"イメージ: + myapp-web:2",
+		"イメージ: + myapp-worker:2",
+		"イメージ: - myapp-web:1",
+		"target_env: staging → production",
+		"サービス: + worker",
+		"ファイル: ~ .env（内容が変更されています）",
+		"ファイル: + nginx.conf",
+	}
+	if got := ConfigDiff(from, to); !reflect.DeepEqual(got, want) {
+		t.Errorf("ConfigDiff()\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestShowDiff(t *testing.T) {
+	from := config.DeployHistoryEntry{Version: "1700000000", CommitHash: "aaa1111"}
+	to := config.DeployHistoryEntry{Version: "1700000001", CommitHash: "bbb2222"}
+
+	t.Run("新しいバージョンとの比較", func(t *testing.T) {
+		local := &fakeLocal{}
+		local.on("git merge-base", "", errors.New("exit status 1"))
+		if err := ShowDiff(context.Background(), local, from, to); err != nil {
+			t.Fatalf("ShowDiff() error = %v", err)
+		}
+		assertCommands(t, local.commands, []string{
+			"git cat-file -e aaa1111^{commit}",
+			"git cat-file -e bbb2222^{commit}",
+			"git merge-base --is-ancestor bbb2222 aaa1111",
+			"git --no-pager log --oneline --no-decorate aaa1111..bbb2222",
+			"git --no-pager diff --stat aaa1111 bbb2222",
+		})
+	})
+
+	t.Run("ロールバック先との比較", func(t *testing.T) {
+		local := &fakeLocal{}
+		if err := ShowDiff(context.Background(), local, to, from); err != nil {
+			t.Fatalf("ShowDiff() error = %v", err)
+		}
+		if got := local.commands[3]; got != "git --no-pager log --oneline --no-decorate aaa1111..bbb2222" {
+			t.Errorf("取り消されるコミットが表示されていません: %s", got)
+		}
+	})
+
+	t.Run("コミットが見つからない", func(t *testing.T) {
+		local := &fakeLocal{}
+		local.on("git cat-file -e bbb2222", "", errors.New("exit status 128"))
+		if err := ShowDiff(context.Background(), local, from, to); err == nil {
+			t.Error("存在しないコミットでエラーが返されていません")
+		}
+	})
+}
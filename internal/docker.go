@@ -1,20 +1,41 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/linkalls/sailor/config"
-	"golang.org/x/crypto/ssh"
 )
 
+// cleanupTimeout は中断・失敗後の後始末に許す時間
+const cleanupTimeout = 30 * time.Second
+
+// NewCleanupContext は後始末用のコンテキストを返す
+// 元のコンテキストがキャンセルされた後でも後始末のコマンドを実行できるよう、独立したコンテキストを使う
+func NewCleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
+
 // ExecuteComposeCommand はDocker Composeコマンドを実行する関数
-func ExecuteComposeCommand(conf *config.Config, args ...string) error {
+func ExecuteComposeCommand(ctx context.Context, conf *config.Config, local LocalRunner, args ...string) error {
+	name, args := composeCommandArgs(*conf, nil, args...)
+	return local.Run(ctx, name, args...)
+}
+
+// composeCommandArgs はローカルで実行する compose コマンドとその引数を返す
+// files は compose ファイルに重ねるオーバーライドファイル
+func composeCommandArgs(conf config.Config, files []string, args ...string) (string, []string) {
 	baseArgs := []string{
+		"-p", ProjectName(conf),
 		"-f", conf.Docker.ComposeFile,
 	}
+	for _, file := range files {
+		baseArgs = append(baseArgs, "-f", file)
+	}
 
 	if conf.Docker.ComposeEnvFile != "" {
 		baseArgs = append(baseArgs, "--env-file", conf.Docker.ComposeEnvFile)
@@ -24,33 +45,32 @@ func ExecuteComposeCommand(conf *config.Config, args ...string) error {
 		baseArgs = append(baseArgs, "--profile", conf.Compose.TargetEnv)
 	}
 
-	args = append(baseArgs, args...)
-	cmd := exec.Command("docker-compose", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	return cmd.Run()
+	command := strings.Fields(localComposeCommand(conf))
+	return command[0], append(append(command[1:], baseArgs...), args...)
 }
 
 // TransferComposeFiles は docker-compose.yml と関連ファイルを転送する関数
-func TransferComposeFiles(conf config.Config) error {
+// app_dir 指定時はリリースごとのディレクトリ (releases/<タグ>) に転送する
+func TransferComposeFiles(ctx context.Context, conf config.Config, remote RemoteRunner) error {
+	dir := composeReleaseDir(conf)
+
 	// まず docker-compose.yml を転送
-	if err := TransferFile(conf, conf.Docker.ComposeFile, conf.Deploy.RemoteTempDir+"/"+conf.Docker.ComposeFile); err != nil {
+	if err := remote.Transfer(ctx, conf.Docker.ComposeFile, dir+"/"+conf.Docker.ComposeFile); err != nil {
 		return fmt.Errorf("docker-compose.ymlの転送に失敗: %w", err)
 	}
 
 	// 環境変数ファイルの転送
 	for _, envFile := range conf.Compose.EnvFiles {
-		remotePath := conf.Deploy.RemoteTempDir + "/" + envFile
-		if err := TransferFile(conf, envFile, remotePath); err != nil {
+		remotePath := dir + "/" + envFile
+		if err := remote.Transfer(ctx, envFile, remotePath); err != nil {
 			return fmt.Errorf("環境変数ファイル %s の転送に失敗: %w", envFile, err)
 		}
 	}
 
 	// 追加ファイルの転送
 	for _, extraFile := range conf.Compose.ExtraFiles {
-		remotePath := conf.Deploy.RemoteTempDir + "/" + extraFile
-		if err := TransferFile(conf, extraFile, remotePath); err != nil {
+		remotePath := dir + "/" + extraFile
+		if err := remote.Transfer(ctx, extraFile, remotePath); err != nil {
 			return fmt.Errorf("追加ファイル %s の転送に失敗: %w", extraFile, err)
 		}
 	}
@@ -59,119 +79,142 @@ func TransferComposeFiles(conf config.Config) error {
 }
 
 // BuildDockerImage は Docker イメージをビルドする関数
-func BuildDockerImage(conf *config.Config) error {
+// タグとラベルは事前に ResolveImageTag で決定しておく
+func BuildDockerImage(ctx context.Context, conf config.Config, local LocalRunner) error {
 	fmt.Println("Dockerイメージをビルド中...")
 
-	// タイムスタンプベースのタグを生成
-	timestamp := time.Now().Format("20060102150405")
-	conf.Docker.Tag = timestamp
-
 	if conf.Docker.UseCompose {
 		// Docker Composeでビルド
-		if err := ExecuteComposeCommand(conf, "build", conf.Docker.ServiceName); err != nil {
+		args, err := composeBuildArgs(conf)
+		if err != nil {
+			return err
+		}
+		// ラベルは compose build に指定できないため、オーバーライドファイルで各サービスに付ける
+		var files []string
+		if len(conf.Docker.Labels) > 0 {
+			if err := prepareArtifactDir(); err != nil {
+				return err
+			}
+			path := filepath.Join(ArtifactDir, composeLabelsFile)
+			if err := os.WriteFile(path, []byte(renderComposeBuildLabels(composeServices(conf), conf.Docker.Labels)), 0644); err != nil {
+				return fmt.Errorf("%s の作成に失敗: %w", path, err)
+			}
+			files = append(files, path)
+		}
+		name, args := composeCommandArgs(conf, files, args...)
+		if conf.Docker.Platform != "" {
+			// compose build は DOCKER_DEFAULT_PLATFORM で対象のプラットフォームを指定する
+			name, args = "env", append([]string{"DOCKER_DEFAULT_PLATFORM=" + conf.Docker.Platform, name}, args...)
+		}
+		if err := local.Run(ctx, name, args...); err != nil {
 			return fmt.Errorf("Docker Composeのビルドに失敗: %w", err)
 		}
+		if err := TagComposeImages(ctx, conf, local); err != nil {
+			return err
+		}
 	} else {
 		// 従来のDockerfileでビルド
-		imageTag := fmt.Sprintf("%s:%s", conf.Docker.ImageName, timestamp)
-		buildCmd := exec.Command("docker", "build", "-t", imageTag, conf.Docker.Context, "--no-cache")
-		buildCmd.Stdout = os.Stdout
-		buildCmd.Stderr = os.Stderr
-
-		if err := buildCmd.Run(); err != nil {
+		args, err := dockerBuildArgs(conf, fmt.Sprintf("%s:%s", conf.Docker.ImageName, conf.Docker.Tag))
+		if err != nil {
+			return err
+		}
+		if err := local.Run(ctx, "docker", args...); err != nil {
 			return fmt.Errorf("ビルドに失敗: %w", err)
 		}
 	}
 
-	fmt.Printf("Dockerイメージをビルドしました（タグ: %s）\n", timestamp)
+	fmt.Printf("Dockerイメージをビルドしました（タグ: %s）\n", conf.Docker.Tag)
 	return nil
 }
 
+// builtImageRefs はビルドしたデプロイ用のイメージ参照を返す
+func builtImageRefs(conf config.Config) []string {
+	if !conf.Docker.UseCompose {
+		return []string{fmt.Sprintf("%s:%s", conf.Docker.ImageName, conf.Docker.Tag)}
+	}
+	var refs []string
+	for _, service := range composeServices(conf) {
+		refs = append(refs, composeImageRef(conf, service))
+	}
+	return refs
+}
+
 // SaveDockerImage は Docker イメージを tar.gz 形式で保存する関数
-func SaveDockerImage(conf config.Config) error {
+func SaveDockerImage(ctx context.Context, conf config.Config, local LocalRunner) error {
 	fmt.Println("イメージを圧縮して保存中...")
 
-	var imageTag string
-	if conf.Docker.UseCompose {
-		imageTag = fmt.Sprintf("%s_%s:%s", conf.Docker.ServiceName, conf.Docker.ServiceName, conf.Docker.Tag)
-	} else {
-		imageTag = fmt.Sprintf("%s:%s", conf.Docker.ImageName, conf.Docker.Tag)
+	imageTags := builtImageRefs(conf)
+	if err := prepareArtifactDir(); err != nil {
+		return err
 	}
-
-	cmd := exec.Command("docker", "save", "-o", conf.Deploy.CompressedFile, imageTag)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
+	path := LocalArtifactPath(conf)
+	args := append([]string{"save", "-o", path}, imageTags...)
+	if err := local.Run(ctx, "docker", args...); err != nil {
 		return fmt.Errorf("圧縮に失敗: %w", err)
 	}
 
-	fmt.Printf("Dockerイメージ %s を %s に保存しました\n", imageTag, conf.Deploy.CompressedFile)
+	fmt.Printf("Dockerイメージ %s を %s に保存しました\n", strings.Join(imageTags, ", "), path)
 	os.Stdout.Sync()
 	return nil
 }
 
 // TransferDockerImage は圧縮されたDockerイメージをリモートサーバーへ転送する関数
-func TransferDockerImage(conf config.Config) error {
-	remotePath := fmt.Sprintf("%s/%s", conf.Deploy.RemoteTempDir, conf.Deploy.CompressedFile)
+// リモートでビルドした場合は compose のファイルだけを転送する
+func TransferDockerImage(ctx context.Context, conf config.Config, remote RemoteRunner) error {
 	if conf.Docker.UseCompose {
-		if err := TransferComposeFiles(conf); err != nil {
+		if err := TransferComposeFiles(ctx, conf, remote); err != nil {
 			return err
 		}
 	}
-	return TransferFile(conf, conf.Deploy.CompressedFile, remotePath)
+	if RemoteBuild(conf) {
+		return nil
+	}
+	return remote.Transfer(ctx, LocalArtifactPath(conf), remoteArtifactPath(conf))
 }
 
 // RunRemoteContainer はリモートサーバーで古いコンテナを停止・削除し、新しいコンテナをデーモンモードで実行する関数
-func RunRemoteContainer(conf config.Config) error {
+func RunRemoteContainer(ctx context.Context, conf config.Config, remote RemoteRunner) error {
 	fmt.Println("\nリモートサーバーでコンテナを実行中...")
 
-	// イメージのロード
-	fmt.Println("1. Dockerイメージをロード中...")
-	loadCmd := fmt.Sprintf("cd %s && docker load < %s", conf.Deploy.RemoteTempDir, conf.Deploy.CompressedFile)
-	if err := ExecuteRemoteCommand(conf, loadCmd); err != nil {
-		return fmt.Errorf("Dockerイメージのロードに失敗: %w", err)
+	// イメージのロード（リモートでビルドした場合は不要）
+	if !RemoteBuild(conf) {
+		fmt.Println("1. Dockerイメージをロード中...")
+		loadCmd := fmt.Sprintf("cd %s && docker load < %s", remoteWorkDir(conf), filepath.Base(conf.Deploy.CompressedFile))
+		if err := remote.Run(ctx, loadCmd); err != nil {
+			return fmt.Errorf("Dockerイメージのロードに失敗: %w", err)
+		}
 	}
 
 	if conf.Docker.UseCompose {
-		// Docker Compose環境での実行
-		stopCmd := fmt.Sprintf("cd %s && docker-compose -f %s down", conf.Deploy.RemoteTempDir, conf.Docker.ComposeFile)
-		if err := ExecuteRemoteCommand(conf, stopCmd); err != nil {
-			fmt.Printf("警告: 既存サービスの停止に失敗しました: %v\n", err)
+		// 転送したイメージを使うよう各サービスのイメージを固定してから起動
+		images := make(map[string]string)
+		for _, service := range composeServices(conf) {
+			images[service] = composeImageRef(conf, service)
 		}
 
-		// 新しいサービスの起動
-		upCmd := fmt.Sprintf("cd %s && docker-compose -f %s up -d", conf.Deploy.RemoteTempDir, conf.Docker.ComposeFile)
-		if err := ExecuteRemoteCommand(conf, upCmd); err != nil {
-			return fmt.Errorf("Docker Composeサービスの起動に失敗: %w", err)
+		if conf.Remote.AppDir != "" {
+			// リリースディレクトリを current に切り替えて起動
+			if err := activateRelease(ctx, conf, remote, releasePath(conf), images); err != nil {
+				return err
+			}
+		} else {
+			// Docker Compose環境での実行
+			dir := remoteWorkDir(conf)
+			if err := remote.Run(ctx, composeDownCmd(conf, dir)); err != nil {
+				fmt.Printf("警告: 既存サービスの停止に失敗しました: %v\n", err)
+			}
+			if err := writeComposeOverride(ctx, remote, dir, images); err != nil {
+				return err
+			}
+			if err := remote.Run(ctx, composeUpCmd(conf, dir)); err != nil {
+				return fmt.Errorf("Docker Composeサービスの起動に失敗: %w", err)
+			}
 		}
 	} else {
 		// 従来の単一コンテナでの実行
-		checkContainerCmd := fmt.Sprintf("docker ps -a --filter name=%s --format {{.Names}}", conf.Remote.ContainerName)
-		containerOutput, err := executeRemoteCommandWithOutput(conf, checkContainerCmd)
-		if err != nil {
-			return fmt.Errorf("コンテナの確認に失敗: %w", err)
-		}
-
-		if containerOutput != "" {
-			// 古いコンテナの停止と削除
-			stopCmd := fmt.Sprintf("docker stop %s && docker rm %s", conf.Remote.ContainerName, conf.Remote.ContainerName)
-			if err := ExecuteRemoteCommand(conf, stopCmd); err != nil {
-				return fmt.Errorf("既存コンテナの停止・削除に失敗: %w", err)
-			}
-		}
-
-		// 新しいコンテナの起動
-		runCmd := fmt.Sprintf("docker run -d --name %s %s %s %s %s:%s",
-			conf.Remote.ContainerName,
-			formatPorts(conf.Remote.Ports),
-			formatEnvs(conf.Remote.Environment),
-			formatVolumes(conf.Remote.Volumes),
-			conf.Docker.ImageName,
-			conf.Docker.Tag,
-		)
-		if err := ExecuteRemoteCommand(conf, runCmd); err != nil {
-			return fmt.Errorf("コンテナの起動に失敗: %w", err)
+		specs := ContainerSpecs(conf, conf.Docker.ImageName+":"+conf.Docker.Tag)
+		if err := replaceContainers(ctx, conf, remote, specs); err != nil {
+			return err
 		}
 	}
 
@@ -180,92 +223,175 @@ func RunRemoteContainer(conf config.Config) error {
 }
 
 // RollbackToVersion は指定されたバージョンの Docker イメージでロールバックする関数
-func RollbackToVersion(conf config.Config, version string) error {
+// history には LoadDeployHistory で読み込んだリモートと統合済みの履歴を渡す
+func RollbackToVersion(ctx context.Context, conf config.Config, history config.History, version string, remote RemoteRunner) error {
 	// デプロイ履歴から該当エントリを取得
-	history, err := config.LoadHistory("config/history.toml")
-	if err != nil {
-		return err
-	}
 	entry, ok := history[version]
 	if !ok {
 		return fmt.Errorf("指定されたバージョン %s が見つかりません", version)
 	}
+	if entry.Status == config.DeployStatusAborted {
+		return fmt.Errorf("バージョン %s は中断されたデプロイのためロールバックできません", version)
+	}
+	if entry.Pruned {
+		return fmt.Errorf("バージョン %s のイメージは sailor prune で削除済みのためロールバックできません", version)
+	}
 
-	if entry.ComposeInfo.ServiceName != "" {
+	if entry.Release != "" && conf.Remote.AppDir != "" {
+		// リリースディレクトリにはデプロイ時のファイルとオーバーライドが残っているため current を切り替えるだけでよい
+		return activateRelease(ctx, conf, remote, entry.Release, nil)
+	} else if entry.ComposeInfo.ServiceName != "" || len(entry.ComposeInfo.Services) > 0 {
 		// Docker Compose環境でのロールバック
-		stopCmd := fmt.Sprintf("cd %s && docker-compose -f %s down", conf.Deploy.RemoteTempDir, conf.Docker.ComposeFile)
-		if err := ExecuteRemoteCommand(conf, stopCmd); err != nil {
+		dir := remoteWorkDir(conf)
+		if err := remote.Run(ctx, composeDownCmd(conf, dir)); err != nil {
 			fmt.Printf("警告: 既存サービスの停止に失敗しました: %v\n", err)
 		}
 
-		// docker-compose.yml内のイメージタグを更新（sed等を使用）
-		updateCmd := fmt.Sprintf("cd %s && sed -i 's|image: .*|image: %s|' %s",
-			conf.Deploy.RemoteTempDir,
-			entry.Image,
-			conf.Docker.ComposeFile,
-		)
-		if err := ExecuteRemoteCommand(conf, updateCmd); err != nil {
-			return fmt.Errorf("compose設定の更新に失敗: %w", err)
+		// ユーザーの compose ファイルは書き換えず、記録したイメージを固定するオーバーライドを生成する
+		if err := writeComposeOverride(ctx, remote, dir, entryComposeImages(entry)); err != nil {
+			return err
 		}
 
 		// サービスの再起動
-		upCmd := fmt.Sprintf("cd %s && docker-compose -f %s up -d", conf.Deploy.RemoteTempDir, conf.Docker.ComposeFile)
-		return ExecuteRemoteCommand(conf, upCmd)
+		return remote.Run(ctx, composeUpCmd(conf, dir))
 	} else {
-		// 従来の単一コンテナでのロールバック
-		stopCmd := fmt.Sprintf("docker stop %s && docker rm %s", conf.Remote.ContainerName, conf.Remote.ContainerName)
-		runCmd := fmt.Sprintf("docker run -d --name %s %s %s %s %s",
-			conf.Remote.ContainerName,
-			formatPorts(conf.Remote.Ports),
-			formatEnvs(conf.Remote.Environment),
-			formatVolumes(conf.Remote.Volumes),
-			entry.Image,
-		)
-		fullCmd := stopCmd + " && " + runCmd
-		return ExecuteRemoteCommand(conf, fullCmd)
+		// 単一コンテナでのロールバック（[[remote.containers]] 指定時はすべてのコンテナを入れ替える）
+		return replaceContainers(ctx, conf, remote, ContainerSpecs(conf, entry.Image))
 	}
 }
 
-// formatPorts はポート設定を "-p 80:80" のような形式に変換する
-func formatPorts(ports []string) string {
-	var result string
-	for _, p := range ports {
-		result += fmt.Sprintf(" -p %s", p)
-	}
-	return result
+// previousContainerName は入れ替え中に旧コンテナを退避させておく名前を返す
+func previousContainerName(name string) string {
+	return name + "_sailor_prev"
 }
 
-// formatEnvs は環境変数設定を "-e KEY=VALUE" のような形式に変換する
-func formatEnvs(envs map[string]string) string {
-	var result string
-	for key, val := range envs {
-		result += fmt.Sprintf(" -e %s=%s", key, val)
+// replaceContainers は既存コンテナを停止して退避させ、specs の順に新しいコンテナを起動する関数
+// いずれかのコンテナの起動に失敗した場合や中断された場合は、起動済みの新しいコンテナを削除して退避させた旧コンテナをすべて再起動する
+func replaceContainers(ctx context.Context, conf config.Config, remote RemoteRunner, specs []ContainerSpec) error {
+	stopped := make([]bool, len(specs))
+
+	// 古いコンテナは新しいコンテナがすべて起動するまで削除せず退避しておく（起動と逆の順に停止する）
+	for i := len(specs) - 1; i >= 0; i-- {
+		name := specs[i].Name
+		checkContainerCmd := fmt.Sprintf("docker ps -a --filter name=^%s$ --format {{.Names}}", name)
+		containerOutput, err := remote.Output(ctx, checkContainerCmd)
+		if err != nil {
+			restoreContainers(remote, specs, stopped, -1)
+			return fmt.Errorf("コンテナの確認に失敗: %w", err)
+		}
+		if strings.TrimSpace(containerOutput) == "" {
+			continue
+		}
+		previous := previousContainerName(name)
+		stopCmd := fmt.Sprintf("docker rm -f %s >/dev/null 2>&1; docker stop %s && docker rename %s %s", previous, name, name, previous)
+		if err := remote.Run(ctx, stopCmd); err != nil {
+			restoreContainers(remote, specs, stopped, -1)
+			return fmt.Errorf("既存コンテナ %s の停止に失敗: %w", name, err)
+		}
+		stopped[i] = true
+	}
+
+	// 新しいコンテナの起動
+	for i, spec := range specs {
+		if err := remote.Run(ctx, spec.RunCommand()); err != nil {
+			restoreContainers(remote, specs, stopped, i)
+			return fmt.Errorf("コンテナ %s の起動に失敗: %w", spec.Name, err)
+		}
+	}
+
+	for i, spec := range specs {
+		if !stopped[i] {
+			continue
+		}
+		previous := previousContainerName(spec.Name)
+		if err := remote.Run(ctx, "docker rm "+previous); err != nil {
+			fmt.Printf("警告: 旧コンテナ %s の削除に失敗しました: %v\n", previous, err)
+		}
+	}
+
+	if len(conf.Remote.Containers) > 0 {
+		removeStaleContainers(ctx, conf, remote, specs)
 	}
-	return result
+	return nil
 }
 
-// formatVolumes はボリューム設定を "-v host:container" の形式に変換する
-func formatVolumes(volumes []string) string {
-	var result string
-	for _, v := range volumes {
-		result += fmt.Sprintf(" -v %s", v)
+// restoreContainers は起動済みの新しいコンテナを削除し、退避させた旧コンテナを元の名前に戻して再起動する関数
+// last は最後に起動を試みたコンテナの位置（起動前なら -1）で、そこまでの旧コンテナがないコンテナは削除する
+func restoreContainers(remote RemoteRunner, specs []ContainerSpec, stopped []bool, last int) {
+	ctx, cancel := NewCleanupContext()
+	defer cancel()
+
+	for i, spec := range specs {
+		name := spec.Name
+		if !stopped[i] {
+			if i <= last {
+				if err := remote.Run(ctx, fmt.Sprintf("docker rm -f %s", name)); err != nil {
+					fmt.Printf("警告: コンテナ %s の削除に失敗しました: %v\n", name, err)
+				}
+			}
+			continue
+		}
+		fmt.Printf("旧コンテナ %s を復元しています...\n", name)
+		restoreCmd := fmt.Sprintf("docker rm -f %s >/dev/null 2>&1; docker rename %s %s && docker start %s",
+			name, previousContainerName(name), name, name)
+		if err := remote.Run(ctx, restoreCmd); err != nil {
+			fmt.Printf("警告: 旧コンテナ %s の復元に失敗しました: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("旧コンテナ %s を再起動しました\n", name)
 	}
-	return result
 }
 
-// executeRemoteCommandWithOutput は SSH を利用してリモートサーバー上でコマンドを実行し、その出力を返す関数
-func executeRemoteCommandWithOutput(conf config.Config, command string) (string, error) {
-	sshConfig, err := getSSHConfig(conf)
+// removeStaleContainers は以前のデプロイで起動したが今回の構成に含まれないコンテナ（減らしたレプリカなど）を削除する関数
+func removeStaleContainers(ctx context.Context, conf config.Config, remote RemoteRunner, specs []ContainerSpec) {
+	listCmd := fmt.Sprintf("docker ps -a --filter label=%s=%s --format {{.Names}}", containerGroupLabel, ProjectName(conf))
+	output, err := remote.Output(ctx, listCmd)
 	if err != nil {
-		return "", fmt.Errorf("SSH設定の取得に失敗: %w", err)
+		fmt.Printf("警告: 不要になったコンテナの確認に失敗しました: %v\n", err)
+		return
+	}
+	current := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		current[spec.Name] = true
+	}
+	for _, name := range strings.Fields(output) {
+		if current[name] || strings.HasSuffix(name, previousContainerName("")) {
+			continue
+		}
+		fmt.Printf("構成に含まれないコンテナ %s を削除します\n", name)
+		if err := remote.Run(ctx, "docker rm -f "+name); err != nil {
+			fmt.Printf("警告: コンテナ %s の削除に失敗しました: %v\n", name, err)
+		}
+	}
+}
+
+// CleanupAbortedDeploy は中断されたデプロイで残ったローカル・リモートの圧縮ファイルを削除する関数
+// 他のデプロイが転送したファイルを消さないよう、デプロイロックを保持している間に呼ぶ
+func CleanupAbortedDeploy(ctx context.Context, conf config.Config, remote RemoteRunner) {
+	RemoveLocalArtifacts(conf)
+
+	remotePath := remoteArtifactPath(conf)
+	if err := remote.Run(ctx, "rm -f "+remotePath); err != nil {
+		fmt.Printf("警告: リモートの %s の削除に失敗しました: %v\n", remotePath, err)
+	}
+
+	// current に切り替える前に中断されたリリースディレクトリは使われないため削除する
+	if conf.Docker.UseCompose && conf.Remote.AppDir != "" {
+		release := releasePath(conf)
+		cleanupCmd := fmt.Sprintf("[ \"$(readlink %s)\" = %s ] || rm -rf %s/%s", currentReleaseDir(conf), release, conf.Remote.AppDir, release)
+		if err := remote.Run(ctx, cleanupCmd); err != nil {
+			fmt.Printf("警告: リリースディレクトリ %s の削除に失敗しました: %v\n", release, err)
+		}
 	}
+}
 
-	address := fmt.Sprintf("%s:%d", conf.SSH.Host, conf.SSH.Port)
-	client, err := ssh.Dial("tcp", address, sshConfig)
+// executeRemoteCommandWithOutput は SSH を利用してリモートサーバー上でコマンドを実行し、その出力を返す関数
+func executeRemoteCommandWithOutput(ctx context.Context, conf config.Config, command string) (string, error) {
+	client, closeClient, err := dialSSH(ctx, conf)
 	if err != nil {
-		return "", fmt.Errorf("SSH接続に失敗: %w", err)
+		return "", err
 	}
-	defer client.Close()
+	defer closeClient()
 
 	session, err := client.NewSession()
 	if err != nil {
@@ -275,8 +401,17 @@ func executeRemoteCommandWithOutput(conf config.Config, command string) (string,
 
 	output, err := session.CombinedOutput(command)
 	if err != nil {
-		return "", fmt.Errorf("コマンドの実行に失敗: %w", err)
+		return "", canceledError(ctx, fmt.Errorf("コマンドの実行に失敗: %w", err))
 	}
 
 	return string(output), nil
 }
+
+// CheckRemoteDocker はリモートサーバーで Docker デーモンが利用可能かを確認し、そのバージョンを返す関数
+func CheckRemoteDocker(ctx context.Context, conf config.Config) (string, error) {
+	output, err := executeRemoteCommandWithOutput(ctx, conf, "docker version --format '{{.Server.Version}}'")
+	if err != nil {
+		return "", fmt.Errorf("リモートのDockerが利用できません: %w", err)
+	}
+	return strings.TrimSpace(output), nil
+}
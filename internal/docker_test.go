@@ -0,0 +1,736 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/linkalls/sailor/config"
+)
+
+// newTestConfig は単一コンテナ構成のテスト用設定を返す
+func newTestConfig() config.Config {
+	var conf config.Config
+	conf.Docker.ImageName = "myapp"
+	conf.Docker.Tag = "20240101000000"
+	conf.Docker.Context = "./"
+	conf.Remote.ContainerName = "myapp_container"
+	conf.Remote.Ports = []string{"80:80"}
+	conf.Remote.Environment = map[string]string{"B": "2", "A": "1"}
+	conf.Remote.Volumes = []string{"/data:/app/data"}
+	conf.Deploy.CompressedFile = "deploy.tar.gz"
+	conf.Deploy.RemoteTempDir = "~/tmp"
+	return conf
+}
+
+// newTestComposeConfig は Docker Compose 構成のテスト用設定を返す
+func newTestComposeConfig() config.Config {
+	conf := newTestConfig()
+	conf.Docker.UseCompose = true
+	conf.Docker.ComposeFile = "docker-compose.yml"
+	conf.Docker.ServiceName = "web"
+	conf.Docker.ComposeEnvFile = ".env"
+	conf.Compose.EnvFiles = []string{".env", ".env.prod"}
+	conf.Compose.ExtraFiles = []string{"nginx.conf"}
+	conf.Compose.TargetEnv = "production"
+	conf.Docker.ComposeCommand = "docker-compose"
+	conf.Compose.ProjectName = "myapp"
+	return conf
+}
+
+// chdirComposeProject は name: myapp の compose ファイルを置いた一時ディレクトリに移動する
+func chdirComposeProject(t *testing.T) {
+	t.Helper()
+	chdirWithFiles(t, map[string]string{
+		"docker-compose.yml": "name: myapp\nservices:\n  web:\n    build: .\n  worker:\n    build: ./worker\n",
+	})
+}
+
+// chdirWithHistory は一時ディレクトリに履歴ファイルを作成し、カレントディレクトリを移動する
+func chdirWithHistory(t *testing.T, history config.History) {
+	t.Helper()
+	tempDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tempDir, "config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filepath.Join(tempDir, "config/history.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := toml.NewEncoder(file).Encode(history); err != nil {
+		t.Fatal(err)
+	}
+
+	originalWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tempDir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(originalWd) })
+}
+
+func assertCommands(t *testing.T, got, want []string) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("実行されたコマンドが一致しません\ngot:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+	}
+}
+
+func TestBuildDockerImage(t *testing.T) {
+	t.Run("Dockerfile", func(t *testing.T) {
+		conf := newTestConfig()
+		local := &fakeLocal{}
+		if err := BuildDockerImage(context.Background(), conf, local); err != nil {
+			t.Fatalf("BuildDockerImage() error = %v", err)
+		}
+		assertCommands(t, local.commands, []string{
+			"docker build -t myapp:20240101000000 ./",
+		})
+	})
+
+	t.Run("Docker Compose のラベル", func(t *testing.T) {
+		chdirComposeProject(t)
+		conf := newTestComposeConfig()
+		conf.Docker.Labels = map[string]string{"org.opencontainers.image.revision": "abc1234"}
+		local := &fakeLocal{}
+		if err := BuildDockerImage(context.Background(), conf, local); err != nil {
+			t.Fatalf("BuildDockerImage() error = %v", err)
+		}
+		if want := "docker-compose -p myapp -f docker-compose.yml -f .sailor/docker-compose.labels.yml --env-file .env --profile production build web"; local.commands[0] != want {
+			t.Errorf("ビルドコマンド\ngot:  %s\nwant: %s", local.commands[0], want)
+		}
+		content, err := os.ReadFile(".sailor/docker-compose.labels.yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), "  web:\n    build:\n      labels:\n        \"org.opencontainers.image.revision\": \"abc1234\"\n") {
+			t.Errorf("ラベルのオーバーライドファイルが不正です:\n%s", content)
+		}
+	})
+
+	t.Run("Dockerfile のビルドオプション", func(t *testing.T) {
+		t.Setenv("NPM_TOKEN", "secret-token")
+		conf := newTestConfig()
+		conf.Docker.Dockerfile = "docker/Dockerfile.prod"
+		conf.Docker.NoCache = true
+		conf.Docker.Target = "production"
+		conf.Docker.BuildArgs = map[string]string{"NPM_TOKEN": "${NPM_TOKEN}", "APP_VERSION": "v-${SAILOR_TAG}"}
+		conf.Docker.Labels = map[string]string{"team": "web"}
+		conf.Docker.Secrets = []string{"id=npmrc,src=.npmrc"}
+		conf.Docker.SSH = []string{"default"}
+		local := &fakeLocal{}
+		if err := BuildDockerImage(context.Background(), conf, local); err != nil {
+			t.Fatalf("BuildDockerImage() error = %v", err)
+		}
+		assertCommands(t, local.commands, []string{
+			"docker build -t myapp:" + conf.Docker.Tag + " -f docker/Dockerfile.prod --no-cache --target production" +
+				" --build-arg APP_VERSION=v-" + conf.Docker.Tag + " --build-arg NPM_TOKEN=secret-token" +
+				" --label team=web --secret id=npmrc,src=.npmrc --ssh default ./",
+		})
+	})
+
+	t.Run("context からの相対パスの Dockerfile", func(t *testing.T) {
+		chdirWithFiles(t, map[string]string{
+			"app/Dockerfile":      "FROM scratch\n",
+			"app/Dockerfile.prod": "FROM scratch\n",
+			"Dockerfile.prod":     "FROM scratch\n",
+		})
+		conf := newTestConfig()
+		conf.Docker.Context = "./app"
+		for dockerfile, want := range map[string]string{
+			"Dockerfile":          "app/Dockerfile",      // カレントディレクトリにないため context から解決
+			"Dockerfile.prod":     "Dockerfile.prod",     // カレントディレクトリにあればそのまま
+			"app/Dockerfile.prod": "app/Dockerfile.prod", // カレントディレクトリからのパスもそのまま
+			"missing/Dockerfile":  "missing/Dockerfile",  // どちらにもなければ docker build のエラーに任せる
+		} {
+			conf.Docker.Dockerfile = dockerfile
+			local := &fakeLocal{}
+			if err := BuildDockerImage(context.Background(), conf, local); err != nil {
+				t.Fatalf("BuildDockerImage() error = %v", err)
+			}
+			assertCommands(t, local.commands, []string{
+				"docker build -t myapp:" + conf.Docker.Tag + " -f " + want + " ./app",
+			})
+		}
+	})
+
+	t.Run("別プラットフォーム向けは buildx でビルド", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Docker.Platform = "linux/arm64"
+		local := &fakeLocal{}
+		if err := BuildDockerImage(context.Background(), conf, local); err != nil {
+			t.Fatalf("BuildDockerImage() error = %v", err)
+		}
+		assertCommands(t, local.commands, []string{
+			"docker buildx build --platform linux/arm64 --load -t myapp:" + conf.Docker.Tag + " ./",
+		})
+	})
+
+	t.Run("未設定の環境変数を参照する build_args", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Docker.BuildArgs = map[string]string{"TOKEN": "${SAILOR_TEST_UNSET_VARIABLE}"}
+		local := &fakeLocal{}
+		err := BuildDockerImage(context.Background(), conf, local)
+		if err == nil || !strings.Contains(err.Error(), "SAILOR_TEST_UNSET_VARIABLE") {
+			t.Errorf("未設定の環境変数でエラーが返されていません: %v", err)
+		}
+		if len(local.commands) != 0 {
+			t.Errorf("ビルドが実行されています: %v", local.commands)
+		}
+	})
+
+	t.Run("Docker Compose", func(t *testing.T) {
+		chdirComposeProject(t)
+		conf := newTestComposeConfig()
+		local := &fakeLocal{}
+		if err := BuildDockerImage(context.Background(), conf, local); err != nil {
+			t.Fatalf("BuildDockerImage() error = %v", err)
+		}
+		assertCommands(t, local.commands, []string{
+			"docker-compose -p myapp -f docker-compose.yml --env-file .env --profile production build web",
+			"docker-compose version --short",
+			"docker tag myapp-web:latest myapp-web:" + conf.Docker.Tag,
+		})
+	})
+
+	t.Run("Docker Compose v1 のイメージ名", func(t *testing.T) {
+		chdirComposeProject(t)
+		conf := newTestComposeConfig()
+		local := &fakeLocal{}
+		local.on("docker-compose version", "1.29.2\n", nil)
+		if err := BuildDockerImage(context.Background(), conf, local); err != nil {
+			t.Fatalf("BuildDockerImage() error = %v", err)
+		}
+		if last := local.commands[len(local.commands)-1]; last != "docker tag myapp_web:latest myapp-web:"+conf.Docker.Tag {
+			t.Errorf("v1 の命名規則でタグ付けされていません: %s", last)
+		}
+	})
+
+	t.Run("Docker Compose v2 プラグイン", func(t *testing.T) {
+		chdirWithFiles(t, map[string]string{
+			"docker-compose.yml": "services:\n  web:\n    build: .\n    image: registry.example.com:5000/team/web\n",
+		})
+		conf := newTestComposeConfig()
+		conf.Docker.ComposeCommand = "docker compose"
+		local := &fakeLocal{}
+		if err := BuildDockerImage(context.Background(), conf, local); err != nil {
+			t.Fatalf("BuildDockerImage() error = %v", err)
+		}
+		assertCommands(t, local.commands, []string{
+			"docker compose -p myapp -f docker-compose.yml --env-file .env --profile production build web",
+			"docker tag registry.example.com:5000/team/web:latest registry.example.com:5000/team/web:" + conf.Docker.Tag,
+		})
+	})
+
+	t.Run("Docker Compose 複数サービス", func(t *testing.T) {
+		chdirComposeProject(t)
+		conf := newTestComposeConfig()
+		conf.Compose.Services = []string{"web", "worker"}
+		conf.Docker.NoCache = true
+		conf.Docker.BuildArgs = map[string]string{"APP_VERSION": "${SAILOR_TAG}"}
+		local := &fakeLocal{}
+		if err := BuildDockerImage(context.Background(), conf, local); err != nil {
+			t.Fatalf("BuildDockerImage() error = %v", err)
+		}
+		assertCommands(t, local.commands, []string{
+			"docker-compose -p myapp -f docker-compose.yml --env-file .env --profile production build --no-cache --build-arg APP_VERSION=" + conf.Docker.Tag + " web worker",
+			"docker-compose version --short",
+			"docker tag myapp-web:latest myapp-web:" + conf.Docker.Tag,
+			"docker tag myapp-worker:latest myapp-worker:" + conf.Docker.Tag,
+		})
+	})
+
+	t.Run("ビルド失敗", func(t *testing.T) {
+		conf := newTestConfig()
+		local := &fakeLocal{}
+		local.on("docker build", "", errors.New("exit status 1"))
+		if err := BuildDockerImage(context.Background(), conf, local); err == nil {
+			t.Error("ビルド失敗時にエラーが返されていません")
+		}
+	})
+}
+
+func TestSaveDockerImage(t *testing.T) {
+	multiServiceConf := newTestComposeConfig()
+	multiServiceConf.Compose.Services = []string{"web", "worker"}
+
+	tests := []struct {
+		name string
+		conf config.Config
+		want string
+	}{
+		{"Dockerfile", newTestConfig(), "docker save -o .sailor/deploy.tar.gz myapp:20240101000000"},
+		{"Docker Compose", newTestComposeConfig(), "docker save -o .sailor/deploy.tar.gz myapp-web:20240101000000"},
+		{"Docker Compose 複数サービス", multiServiceConf, "docker save -o .sailor/deploy.tar.gz myapp-web:20240101000000 myapp-worker:20240101000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chdirComposeProject(t)
+			local := &fakeLocal{}
+			if err := SaveDockerImage(context.Background(), tt.conf, local); err != nil {
+				t.Fatalf("SaveDockerImage() error = %v", err)
+			}
+			assertCommands(t, local.commands, []string{tt.want})
+			// 保存先のディレクトリはコミットされないよう .gitignore で無視する
+			if data, err := os.ReadFile(".sailor/.gitignore"); err != nil || string(data) != "*\n" {
+				t.Errorf(".sailor/.gitignore が作成されていません: %q, %v", data, err)
+			}
+		})
+	}
+
+	t.Run("保存失敗", func(t *testing.T) {
+		chdirWithFiles(t, nil)
+		local := &fakeLocal{}
+		local.on("docker save", "", errors.New("no such image"))
+		if err := SaveDockerImage(context.Background(), newTestConfig(), local); err == nil {
+			t.Error("保存失敗時にエラーが返されていません")
+		}
+	})
+}
+
+func TestTransferDockerImage(t *testing.T) {
+	t.Run("Dockerfile", func(t *testing.T) {
+		remote := &fakeRemote{}
+		if err := TransferDockerImage(context.Background(), newTestConfig(), remote); err != nil {
+			t.Fatalf("TransferDockerImage() error = %v", err)
+		}
+		assertCommands(t, remote.commands, []string{
+			"transfer .sailor/deploy.tar.gz -> ~/tmp/myapp_container/deploy.tar.gz",
+		})
+	})
+
+	t.Run("Docker Compose", func(t *testing.T) {
+		remote := &fakeRemote{}
+		if err := TransferDockerImage(context.Background(), newTestComposeConfig(), remote); err != nil {
+			t.Fatalf("TransferDockerImage() error = %v", err)
+		}
+		assertCommands(t, remote.commands, []string{
+			"transfer docker-compose.yml -> ~/tmp/myapp/docker-compose.yml",
+			"transfer .env -> ~/tmp/myapp/.env",
+			"transfer .env.prod -> ~/tmp/myapp/.env.prod",
+			"transfer nginx.conf -> ~/tmp/myapp/nginx.conf",
+			"transfer .sailor/deploy.tar.gz -> ~/tmp/myapp/deploy.tar.gz",
+		})
+	})
+
+	t.Run("app_dir のリリースディレクトリ", func(t *testing.T) {
+		conf := newTestComposeConfig()
+		conf.Remote.AppDir = "~/apps/myapp"
+		remote := &fakeRemote{}
+		if err := TransferDockerImage(context.Background(), conf, remote); err != nil {
+			t.Fatalf("TransferDockerImage() error = %v", err)
+		}
+		assertCommands(t, remote.commands, []string{
+			"transfer docker-compose.yml -> ~/apps/myapp/releases/20240101000000/docker-compose.yml",
+			"transfer .env -> ~/apps/myapp/releases/20240101000000/.env",
+			"transfer .env.prod -> ~/apps/myapp/releases/20240101000000/.env.prod",
+			"transfer nginx.conf -> ~/apps/myapp/releases/20240101000000/nginx.conf",
+			"transfer .sailor/deploy.tar.gz -> ~/tmp/myapp/deploy.tar.gz",
+		})
+	})
+
+	t.Run("環境変数ファイルの転送失敗", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("transfer .env.prod", "", errors.New("permission denied"))
+		err := TransferDockerImage(context.Background(), newTestComposeConfig(), remote)
+		if err == nil || !strings.Contains(err.Error(), ".env.prod") {
+			t.Errorf("失敗したファイル名を含むエラーが返されていません: %v", err)
+		}
+		if last := remote.commands[len(remote.commands)-1]; last != "transfer .env.prod -> ~/tmp/myapp/.env.prod" {
+			t.Errorf("失敗後も転送が続行されています: %s", last)
+		}
+	})
+}
+
+func TestRunRemoteContainer(t *testing.T) {
+	const (
+		runCmd     = "docker run -d --name myapp_container -p 80:80 -e A=1 -e B=2 -v /data:/app/data myapp:20240101000000"
+		checkCmd   = "docker ps -a --filter name=^myapp_container$ --format {{.Names}}"
+		stopCmd    = "docker rm -f myapp_container_sailor_prev >/dev/null 2>&1; docker stop myapp_container && docker rename myapp_container myapp_container_sailor_prev"
+		restoreCmd = "docker rm -f myapp_container >/dev/null 2>&1; docker rename myapp_container_sailor_prev myapp_container && docker start myapp_container"
+	)
+
+	t.Run("既存コンテナあり", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("docker ps -a", "myapp_container\n", nil)
+		if err := RunRemoteContainer(context.Background(), newTestConfig(), remote); err != nil {
+			t.Fatalf("RunRemoteContainer() error = %v", err)
+		}
+		assertCommands(t, remote.commands, []string{
+			"cd ~/tmp/myapp_container && docker load < deploy.tar.gz",
+			checkCmd,
+			stopCmd,
+			runCmd,
+			"docker rm myapp_container_sailor_prev",
+		})
+	})
+
+	t.Run("既存コンテナなし", func(t *testing.T) {
+		remote := &fakeRemote{}
+		if err := RunRemoteContainer(context.Background(), newTestConfig(), remote); err != nil {
+			t.Fatalf("RunRemoteContainer() error = %v", err)
+		}
+		assertCommands(t, remote.commands, []string{
+			"cd ~/tmp/myapp_container && docker load < deploy.tar.gz",
+			checkCmd,
+			runCmd,
+		})
+	})
+
+	t.Run("イメージのロード失敗", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("cd ~/tmp/myapp_container && docker load", "", errors.New("exit status 1"))
+		if err := RunRemoteContainer(context.Background(), newTestConfig(), remote); err == nil {
+			t.Fatal("ロード失敗時にエラーが返されていません")
+		}
+		if len(remote.commands) != 1 {
+			t.Errorf("ロード失敗後もコマンドが実行されています: %v", remote.commands)
+		}
+	})
+
+	t.Run("既存コンテナの停止失敗", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("docker ps -a", "myapp_container\n", nil)
+		remote.on("docker rm -f myapp_container_sailor_prev", "", errors.New("exit status 1"))
+		if err := RunRemoteContainer(context.Background(), newTestConfig(), remote); err == nil {
+			t.Fatal("停止失敗時にエラーが返されていません")
+		}
+		for _, c := range remote.commands {
+			if strings.HasPrefix(c, "docker run") {
+				t.Error("停止失敗後に新しいコンテナが起動されています")
+			}
+		}
+	})
+
+	t.Run("新しいコンテナの起動失敗時は旧コンテナを復元", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("docker ps -a", "myapp_container\n", nil)
+		remote.on("docker run", "", errors.New("port is already allocated"))
+		if err := RunRemoteContainer(context.Background(), newTestConfig(), remote); err == nil {
+			t.Fatal("起動失敗時にエラーが返されていません")
+		}
+		assertCommands(t, remote.commands, []string{
+			"cd ~/tmp/myapp_container && docker load < deploy.tar.gz",
+			checkCmd,
+			stopCmd,
+			runCmd,
+			restoreCmd,
+		})
+	})
+
+	t.Run("中断時も旧コンテナを復元", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		remote := &fakeRemote{}
+		remote.on("docker ps -a", "myapp_container\n", nil)
+		// 新しいコンテナの起動中に中断されたものとして扱う
+		remote.on("docker run", "", context.Canceled)
+		cancel()
+		if err := RunRemoteContainer(ctx, newTestConfig(), remote); err == nil {
+			t.Fatal("中断時にエラーが返されていません")
+		}
+		if last := remote.commands[len(remote.commands)-1]; last != restoreCmd {
+			t.Errorf("中断後に旧コンテナが復元されていません: %s", last)
+		}
+	})
+
+	t.Run("Docker Compose", func(t *testing.T) {
+		chdirComposeProject(t)
+		remote := &fakeRemote{}
+		if err := RunRemoteContainer(context.Background(), newTestComposeConfig(), remote); err != nil {
+			t.Fatalf("RunRemoteContainer() error = %v", err)
+		}
+		assertCommands(t, remote.commands, []string{
+			"cd ~/tmp/myapp && docker load < deploy.tar.gz",
+			"cd ~/tmp/myapp && docker-compose -p myapp -f docker-compose.yml down",
+			"cd ~/tmp/myapp && printf '%s' '# sailor が生成したファイルです。デプロイ・ロールバックのたびに上書きされます\n" +
+				"services:\n  web:\n    image: myapp-web:20240101000000\n' > docker-compose.sailor.yml",
+			"cd ~/tmp/myapp && docker-compose -p myapp -f docker-compose.yml -f docker-compose.sailor.yml up -d",
+		})
+	})
+
+	t.Run("Docker Compose 停止失敗は警告のみ", func(t *testing.T) {
+		chdirComposeProject(t)
+		remote := &fakeRemote{}
+		remote.on("cd ~/tmp/myapp && docker-compose -p myapp -f docker-compose.yml down", "", errors.New("no such project"))
+		if err := RunRemoteContainer(context.Background(), newTestComposeConfig(), remote); err != nil {
+			t.Fatalf("RunRemoteContainer() error = %v", err)
+		}
+		if len(remote.commands) != 4 {
+			t.Errorf("停止失敗後にサービスが起動されていません: %v", remote.commands)
+		}
+	})
+
+	t.Run("Docker Compose 起動失敗", func(t *testing.T) {
+		chdirComposeProject(t)
+		remote := &fakeRemote{}
+		remote.on("cd ~/tmp/myapp && docker-compose -p myapp -f docker-compose.yml -f docker-compose.sailor.yml up", "", errors.New("exit status 1"))
+		if err := RunRemoteContainer(context.Background(), newTestComposeConfig(), remote); err == nil {
+			t.Error("起動失敗時にエラーが返されていません")
+		}
+	})
+}
+
+func TestRunRemoteContainerGroup(t *testing.T) {
+	const (
+		webRun     = "docker run -d --name myapp_web -p 80:80 -e A=1 -e B=2 -v /data:/app/data --label sailor.group=myapp_container myapp:20240101000000"
+		worker1Run = "docker run -d --name myapp_worker-1 -e A=1 -e B=3 -v /data:/app/data --label sailor.group=myapp_container myapp:20240101000000 bin/worker"
+		worker2Run = "docker run -d --name myapp_worker-2 -e A=1 -e B=3 -v /data:/app/data --label sailor.group=myapp_container myapp:20240101000000 bin/worker"
+	)
+
+	t.Run("記述順に起動し不要なコンテナを削除", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("docker ps -a --filter name=^myapp_web$", "myapp_web\n", nil)
+		remote.on("docker ps -a --filter label=", "myapp_web\nmyapp_worker-1\nmyapp_worker-2\nmyapp_worker-3\n", nil)
+		if err := RunRemoteContainer(context.Background(), newTestGroupConfig(), remote); err != nil {
+			t.Fatalf("RunRemoteContainer() error = %v", err)
+		}
+		assertCommands(t, remote.commands, []string{
+			"cd ~/tmp/myapp_container && docker load < deploy.tar.gz",
+			"docker ps -a --filter name=^myapp_worker-2$ --format {{.Names}}",
+			"docker ps -a --filter name=^myapp_worker-1$ --format {{.Names}}",
+			"docker ps -a --filter name=^myapp_web$ --format {{.Names}}",
+			"docker rm -f myapp_web_sailor_prev >/dev/null 2>&1; docker stop myapp_web && docker rename myapp_web myapp_web_sailor_prev",
+			webRun,
+			worker1Run,
+			worker2Run,
+			"docker rm myapp_web_sailor_prev",
+			"docker ps -a --filter label=sailor.group=myapp_container --format {{.Names}}",
+			"docker rm -f myapp_worker-3",
+		})
+	})
+
+	t.Run("途中のコンテナの起動失敗時はグループ全体を戻す", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("docker ps -a --filter name=^myapp_web$", "myapp_web\n", nil)
+		remote.on("docker run -d --name myapp_worker-2", "", errors.New("exit status 125"))
+		if err := RunRemoteContainer(context.Background(), newTestGroupConfig(), remote); err == nil {
+			t.Fatal("起動失敗時にエラーが返されていません")
+		}
+		assertCommands(t, remote.commands[5:], []string{
+			webRun,
+			worker1Run,
+			worker2Run,
+			"docker rm -f myapp_web >/dev/null 2>&1; docker rename myapp_web_sailor_prev myapp_web && docker start myapp_web",
+			"docker rm -f myapp_worker-1",
+			"docker rm -f myapp_worker-2",
+		})
+	})
+
+	t.Run("ロールバックもグループ全体", func(t *testing.T) {
+		history := config.History{"1700000000": {Version: "1700000000", Image: "myapp:20231114000000"}}
+		remote := &fakeRemote{}
+		if err := RollbackToVersion(context.Background(), newTestGroupConfig(), history, "1700000000", remote); err != nil {
+			t.Fatalf("RollbackToVersion() error = %v", err)
+		}
+		var runs []string
+		for _, c := range remote.commands {
+			if strings.HasPrefix(c, "docker run") {
+				runs = append(runs, c)
+			}
+		}
+		if len(runs) != 3 || !strings.Contains(runs[2], "myapp:20231114000000 bin/worker") {
+			t.Errorf("すべてのコンテナが記録したイメージで起動されていません: %v", runs)
+		}
+	})
+}
+
+func TestRunRemoteContainerRelease(t *testing.T) {
+	const (
+		override = "cd ~/apps/myapp/releases/20240101000000 && printf '%s' '# sailor が生成したファイルです。デプロイ・ロールバックのたびに上書きされます\n" +
+			"services:\n  web:\n    image: myapp-web:20240101000000\n' > docker-compose.sailor.yml"
+		readlinkCmd = "readlink ~/apps/myapp/current || true"
+		downCmd     = "cd ~/apps/myapp/current && docker-compose -p myapp -f docker-compose.yml down"
+		switchCmd   = "ln -sfn releases/20240101000000 ~/apps/myapp/current"
+		upCmd       = "cd ~/apps/myapp/current && docker-compose -p myapp -f docker-compose.yml -f docker-compose.sailor.yml up -d"
+	)
+	newConf := func() config.Config {
+		conf := newTestComposeConfig()
+		conf.Remote.AppDir = "~/apps/myapp"
+		return conf
+	}
+
+	t.Run("current を切り替えて起動", func(t *testing.T) {
+		chdirComposeProject(t)
+		remote := &fakeRemote{}
+		remote.on("readlink", "releases/20231231000000\n", nil)
+		if err := RunRemoteContainer(context.Background(), newConf(), remote); err != nil {
+			t.Fatalf("RunRemoteContainer() error = %v", err)
+		}
+		assertCommands(t, remote.commands, []string{
+			"cd ~/tmp/myapp && docker load < deploy.tar.gz",
+			override,
+			readlinkCmd,
+			downCmd,
+			switchCmd,
+			upCmd,
+		})
+	})
+
+	t.Run("初回は remote_temp_dir のサービスを停止", func(t *testing.T) {
+		chdirComposeProject(t)
+		remote := &fakeRemote{}
+		if err := RunRemoteContainer(context.Background(), newConf(), remote); err != nil {
+			t.Fatalf("RunRemoteContainer() error = %v", err)
+		}
+		want := "if [ -f ~/tmp/docker-compose.yml ]; then cd ~/tmp && docker-compose -f docker-compose.yml down; fi"
+		if remote.commands[3] != want {
+			t.Errorf("旧ディレクトリのサービスが停止されていません\ngot:  %s\nwant: %s", remote.commands[3], want)
+		}
+	})
+
+	t.Run("起動失敗時は元のリリースに戻す", func(t *testing.T) {
+		chdirComposeProject(t)
+		remote := &fakeRemote{}
+		remote.on("readlink", "releases/20231231000000\n", nil)
+		remote.on(upCmd, "", errors.New("exit status 1"))
+		if err := RunRemoteContainer(context.Background(), newConf(), remote); err == nil {
+			t.Fatal("起動失敗時にエラーが返されていません")
+		}
+		want := "ln -sfn releases/20231231000000 ~/apps/myapp/current && " + upCmd
+		if last := remote.commands[len(remote.commands)-1]; last != want {
+			t.Errorf("元のリリースに戻されていません\ngot:  %s\nwant: %s", last, want)
+		}
+	})
+
+	t.Run("ロールバックは current を切り替えるだけ", func(t *testing.T) {
+		entry := config.DeployHistoryEntry{Version: "1700000004", Image: "myapp-web:20231231000000", Release: "releases/20231231000000"}
+		entry.ComposeInfo.ServiceName = "web"
+		history := config.History{"1700000004": entry}
+		remote := &fakeRemote{}
+		remote.on("readlink", "releases/20240101000000\n", nil)
+		if err := RollbackToVersion(context.Background(), newConf(), history, "1700000004", remote); err != nil {
+			t.Fatalf("RollbackToVersion() error = %v", err)
+		}
+		assertCommands(t, remote.commands, []string{
+			"test -d ~/apps/myapp/releases/20231231000000",
+			readlinkCmd,
+			downCmd,
+			"ln -sfn releases/20231231000000 ~/apps/myapp/current",
+			upCmd,
+		})
+	})
+
+	t.Run("削除済みのリリース", func(t *testing.T) {
+		entry := config.DeployHistoryEntry{Version: "1700000004", Release: "releases/20231231000000"}
+		entry.ComposeInfo.ServiceName = "web"
+		history := config.History{"1700000004": entry}
+		remote := &fakeRemote{}
+		remote.on("test -d", "", errors.New("exit status 1"))
+		if err := RollbackToVersion(context.Background(), newConf(), history, "1700000004", remote); err == nil {
+			t.Fatal("リリースがない場合にエラーが返されていません")
+		}
+		if len(remote.commands) != 1 {
+			t.Errorf("リリースがないのにコマンドが実行されています: %v", remote.commands)
+		}
+	})
+}
+
+func TestRollbackToVersion(t *testing.T) {
+	history := config.History{
+		"1700000000": {Version: "1700000000", Image: "myapp:20231114000000"},
+	}
+	composeEntry := config.DeployHistoryEntry{Version: "1700000001", Image: "web_web:20231114000001"}
+	composeEntry.ComposeInfo.ServiceName = "web"
+	history["1700000001"] = composeEntry
+	multiEntry := config.DeployHistoryEntry{Version: "1700000003", Image: "web_web:20231114000003"}
+	multiEntry.ComposeInfo.ServiceName = "web"
+	multiEntry.ComposeInfo.Services = map[string]config.ComposeServiceImage{
+		"web":    {Image: "web_web:20231114000003", ImageID: "sha256:aaa"},
+		"worker": {Image: "worker_worker:20231114000003", ImageID: "sha256:bbb"},
+	}
+	history["1700000003"] = multiEntry
+	history["1700000002"] = config.DeployHistoryEntry{Version: "1700000002", Image: "myapp:20231114000002", Status: config.DeployStatusAborted}
+
+	t.Run("単一コンテナ", func(t *testing.T) {
+		remote := &fakeRemote{}
+		if err := RollbackToVersion(context.Background(), newTestConfig(), history, "1700000000", remote); err != nil {
+			t.Fatalf("RollbackToVersion() error = %v", err)
+		}
+		assertCommands(t, remote.commands, []string{
+			"docker ps -a --filter name=^myapp_container$ --format {{.Names}}",
+			"docker run -d --name myapp_container -p 80:80 -e A=1 -e B=2 -v /data:/app/data myapp:20231114000000",
+		})
+	})
+
+	t.Run("中断されたデプロイ", func(t *testing.T) {
+		remote := &fakeRemote{}
+		if err := RollbackToVersion(context.Background(), newTestConfig(), history, "1700000002", remote); err == nil {
+			t.Error("中断されたデプロイへのロールバックでエラーが返されていません")
+		}
+		if len(remote.commands) != 0 {
+			t.Errorf("リモートコマンドが実行されています: %v", remote.commands)
+		}
+	})
+
+	t.Run("Docker Compose", func(t *testing.T) {
+		remote := &fakeRemote{}
+		if err := RollbackToVersion(context.Background(), newTestComposeConfig(), history, "1700000001", remote); err != nil {
+			t.Fatalf("RollbackToVersion() error = %v", err)
+		}
+		assertCommands(t, remote.commands, []string{
+			"cd ~/tmp/myapp && docker-compose -p myapp -f docker-compose.yml down",
+			"cd ~/tmp/myapp && printf '%s' '# sailor が生成したファイルです。デプロイ・ロールバックのたびに上書きされます\n" +
+				"services:\n  web:\n    image: web_web:20231114000001\n' > docker-compose.sailor.yml",
+			"cd ~/tmp/myapp && docker-compose -p myapp -f docker-compose.yml -f docker-compose.sailor.yml up -d",
+		})
+	})
+
+	t.Run("Docker Compose 複数サービス", func(t *testing.T) {
+		remote := &fakeRemote{}
+		if err := RollbackToVersion(context.Background(), newTestComposeConfig(), history, "1700000003", remote); err != nil {
+			t.Fatalf("RollbackToVersion() error = %v", err)
+		}
+		want := "cd ~/tmp/myapp && printf '%s' '# sailor が生成したファイルです。デプロイ・ロールバックのたびに上書きされます\n" +
+			"services:\n  web:\n    image: web_web:20231114000003\n  worker:\n    image: worker_worker:20231114000003\n' > docker-compose.sailor.yml"
+		if remote.commands[1] != want {
+			t.Errorf("サービスごとのイメージが固定されていません\ngot:  %s\nwant: %s", remote.commands[1], want)
+		}
+	})
+
+	t.Run("存在しないバージョン", func(t *testing.T) {
+		remote := &fakeRemote{}
+		if err := RollbackToVersion(context.Background(), newTestConfig(), history, "999", remote); err == nil {
+			t.Error("存在しないバージョンでエラーが返されていません")
+		}
+		if len(remote.commands) != 0 {
+			t.Errorf("リモートコマンドが実行されています: %v", remote.commands)
+		}
+	})
+
+	t.Run("compose設定の更新失敗", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("cd ~/tmp/myapp && printf", "", errors.New("exit status 2"))
+		if err := RollbackToVersion(context.Background(), newTestComposeConfig(), history, "1700000001", remote); err == nil {
+			t.Error("更新失敗時にエラーが返されていません")
+		}
+		for _, c := range remote.commands {
+			if strings.Contains(c, " up -d") {
+				t.Error("オーバーライドの作成失敗後にサービスが起動されています")
+			}
+		}
+	})
+}
+
+func TestCleanupAbortedDeployRelease(t *testing.T) {
+	chdirComposeProject(t)
+	conf := newTestComposeConfig()
+	conf.Remote.AppDir = "~/apps/myapp"
+	conf.Docker.Tag = "abc1234"
+	conf.Remote.Release = "abc1234-20240102030405"
+	remote := &fakeRemote{}
+	CleanupAbortedDeploy(context.Background(), conf, remote)
+
+	// 同じタグで以前にデプロイしたリリース (releases/abc1234) は削除しない
+	want := "[ \"$(readlink ~/apps/myapp/current)\" = releases/abc1234-20240102030405 ] || rm -rf ~/apps/myapp/releases/abc1234-20240102030405"
+	if last := remote.commands[len(remote.commands)-1]; last != want {
+		t.Errorf("削除するリリースが不正です\ngot:  %s\nwant: %s", last, want)
+	}
+}
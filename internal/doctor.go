@@ -0,0 +1,325 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// チェック結果のステータス
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+// CheckResult は doctor コマンドの個々のチェック結果
+type CheckResult struct {
+	Name    string // チェック項目名
+	Status  string // pass / warn / fail
+	Message string // 結果の詳細
+	Hint    string // 問題がある場合の対処方法
+}
+
+// RunDoctor はデプロイに必要なローカル・リモートの前提条件を順に確認する関数
+func RunDoctor(ctx context.Context, conf config.Config) []CheckResult {
+	var results []CheckResult
+
+	// ローカル環境のチェック
+	results = append(results, checkLocalDocker())
+	if conf.Docker.UseCompose {
+		results = append(results, checkLocalCompose())
+		results = append(results, checkComposeFile(conf))
+	}
+	results = append(results, checkGit(ctx, conf)...)
+
+	// SSH接続できなければリモートのチェックは行わない
+	sshResult := checkSSH(ctx, conf)
+	results = append(results, sshResult)
+	if sshResult.Status == CheckFail {
+		return results
+	}
+
+	results = append(results, checkRemoteScp(ctx, conf))
+	results = append(results, checkRemoteTempDir(ctx, conf))
+	results = append(results, checkRemoteDockerDaemon(ctx, conf))
+	results = append(results, checkDockerGroup(ctx, conf))
+	if conf.Docker.UseCompose {
+		results = append(results, checkRemoteCompose(ctx, conf))
+		if conf.Remote.AppDir != "" {
+			results = append(results, checkRemoteAppDir(ctx, conf))
+		}
+	}
+	results = append(results, checkRemoteDiskSpace(ctx, conf))
+
+	return results
+}
+
+// checkLocalDocker はローカルの Docker デーモンが利用可能か確認する
+func checkLocalDocker() CheckResult {
+	result := CheckResult{Name: "ローカルのDocker"}
+	out, err := exec.Command("docker", "version", "--format", "{{.Server.Version}}").Output()
+	if err != nil {
+		result.Status = CheckFail
+		result.Message = fmt.Sprintf("docker コマンドを実行できません: %v", err)
+		result.Hint = "Docker をインストールし、デーモンが起動していることを確認してください"
+		return result
+	}
+	result.Status = CheckPass
+	result.Message = "バージョン " + strings.TrimSpace(string(out))
+	return result
+}
+
+// checkLocalCompose はローカルで利用可能な Docker Compose を確認する
+func checkLocalCompose() CheckResult {
+	result := CheckResult{Name: "ローカルのDocker Compose"}
+	if out, err := exec.Command("docker", "compose", "version", "--short").Output(); err == nil {
+		result.Status = CheckPass
+		result.Message = "docker compose (v2) " + strings.TrimSpace(string(out))
+		return result
+	}
+	if out, err := exec.Command("docker-compose", "version", "--short").Output(); err == nil {
+		result.Status = CheckWarn
+		result.Message = "docker-compose (v1) " + strings.TrimSpace(string(out))
+		result.Hint = "docker-compose v1 はサポートが終了しています。Docker Compose v2 プラグインへの移行を推奨します"
+		return result
+	}
+	result.Status = CheckFail
+	result.Message = "docker compose / docker-compose のどちらも見つかりません"
+	result.Hint = "Docker Compose プラグインをインストールしてください"
+	return result
+}
+
+// checkComposeFile は compose ファイルを解析し、デプロイするサービスと転送できないパスを確認する
+func checkComposeFile(conf config.Config) CheckResult {
+	result := CheckResult{Name: "composeファイル"}
+	warnings, err := PrepareCompose(&conf)
+	if err != nil {
+		result.Status = CheckFail
+		result.Message = err.Error()
+		result.Hint = "[docker] compose_file と [compose] services / [docker] service_name を確認してください"
+		return result
+	}
+	files := 1 + len(conf.Compose.EnvFiles) + len(conf.Compose.ExtraFiles)
+	result.Message = fmt.Sprintf("サービス %s（転送するファイル %d 件）", strings.Join(composeServices(conf), ", "), files)
+	if len(warnings) > 0 {
+		result.Status = CheckWarn
+		result.Message += "\n       " + strings.Join(warnings, "\n       ")
+		result.Hint = "絶対パスや変数を含むパスはリモートサーバー上に用意するか、相対パスに変更してください"
+		return result
+	}
+	result.Status = CheckPass
+	return result
+}
+
+// checkGit は作業ツリーの状態と [deploy] のガード（ブランチ・プッシュ済みか・タグ）を確認する
+func checkGit(ctx context.Context, conf config.Config) []CheckResult {
+	status := CheckResult{Name: "Gitの作業ツリー", Status: CheckPass, Message: "未コミットの変更はありません"}
+	if ok, err := CheckGitStatus(); !ok {
+		status.Status = CheckWarn
+		status.Message = err.Error()
+		status.Hint = "デプロイ前に変更をコミットしてください"
+	}
+
+	guards := CheckResult{Name: "Gitのガード", Status: CheckPass, Message: "デプロイするブランチ・コミットの条件を満たしています"}
+	var messages []string
+	for _, failure := range CheckGitGuards(ctx, conf, NewLocalRunner(), "") {
+		messages = append(messages, failure.Message)
+	}
+	if len(messages) > 0 {
+		guards.Status = CheckWarn
+		guards.Message = strings.Join(messages, " / ")
+		guards.Hint = "ブランチの切り替え・git push・git pull・タグ付けを行うか、sailor deploy --force=<ガード名> で無視してください"
+	}
+
+	return []CheckResult{status, guards}
+}
+
+// checkSSH はリモートサーバーへ SSH 接続できるか確認する
+func checkSSH(ctx context.Context, conf config.Config) CheckResult {
+	result := CheckResult{Name: "SSH接続"}
+	if err := CheckSSHConnection(ctx, conf); err != nil {
+		result.Status = CheckFail
+		result.Message = err.Error()
+		result.Hint = "[ssh] の host / port / user / 認証情報と known_hosts を確認してください"
+		return result
+	}
+	result.Status = CheckPass
+	result.Message = fmt.Sprintf("%s@%s:%d に接続できました", conf.SSH.User, conf.SSH.Host, conf.SSH.Port)
+	return result
+}
+
+// checkRemoteScp はリモートに scp コマンドが存在するか確認する
+func checkRemoteScp(ctx context.Context, conf config.Config) CheckResult {
+	result := CheckResult{Name: "リモートのscp"}
+	out, err := executeRemoteCommandWithOutput(ctx, conf, "which scp")
+	if err != nil {
+		result.Status = CheckFail
+		result.Message = "scp コマンドが見つかりません"
+		result.Hint = "リモートサーバーに openssh-client をインストールしてください"
+		return result
+	}
+	result.Status = CheckPass
+	result.Message = strings.TrimSpace(out)
+	return result
+}
+
+// checkRemoteTempDir は remote_temp_dir が作成・書き込み可能か確認する
+func checkRemoteTempDir(ctx context.Context, conf config.Config) CheckResult {
+	result := CheckResult{Name: "リモートの一時ディレクトリ"}
+	cmd := fmt.Sprintf("mkdir -p %s && test -w %s", conf.Deploy.RemoteTempDir, conf.Deploy.RemoteTempDir)
+	if _, err := executeRemoteCommandWithOutput(ctx, conf, cmd); err != nil {
+		result.Status = CheckFail
+		result.Message = conf.Deploy.RemoteTempDir + " に書き込めません"
+		result.Hint = "[deploy] remote_temp_dir の権限を確認するか、書き込み可能なディレクトリを指定してください"
+		return result
+	}
+	result.Status = CheckPass
+	result.Message = conf.Deploy.RemoteTempDir + " に書き込めます"
+	return result
+}
+
+// checkRemoteAppDir は app_dir にリリースディレクトリを作成できるか確認する
+func checkRemoteAppDir(ctx context.Context, conf config.Config) CheckResult {
+	result := CheckResult{Name: "リモートのアプリケーションディレクトリ"}
+	cmd := fmt.Sprintf("mkdir -p %s/releases && test -w %s/releases", conf.Remote.AppDir, conf.Remote.AppDir)
+	if _, err := executeRemoteCommandWithOutput(ctx, conf, cmd); err != nil {
+		result.Status = CheckFail
+		result.Message = conf.Remote.AppDir + " に書き込めません"
+		result.Hint = "[remote] app_dir の権限を確認するか、書き込み可能なディレクトリを指定してください"
+		return result
+	}
+	result.Status = CheckPass
+	result.Message = conf.Remote.AppDir + " に書き込めます"
+	return result
+}
+
+// checkRemoteDockerDaemon はリモートの Docker デーモンが利用可能か確認する
+func checkRemoteDockerDaemon(ctx context.Context, conf config.Config) CheckResult {
+	result := CheckResult{Name: "リモートのDocker"}
+	version, err := CheckRemoteDocker(ctx, conf)
+	if err != nil {
+		result.Status = CheckFail
+		result.Message = err.Error()
+		result.Hint = "リモートに Docker をインストールし、デーモンが起動していることを確認してください"
+		return result
+	}
+	result.Status = CheckPass
+	result.Message = "バージョン " + version
+	return result
+}
+
+// checkDockerGroup は SSH ユーザーが sudo なしで docker を実行できるか確認する
+func checkDockerGroup(ctx context.Context, conf config.Config) CheckResult {
+	result := CheckResult{Name: "dockerグループ"}
+	out, err := executeRemoteCommandWithOutput(ctx, conf, "id -un && id -nG")
+	if err != nil {
+		result.Status = CheckWarn
+		result.Message = "ユーザーの所属グループを取得できません"
+		return result
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == "root" {
+		result.Status = CheckPass
+		result.Message = "root ユーザーで接続しています"
+		return result
+	}
+	for _, group := range strings.Fields(out) {
+		if group == "docker" {
+			result.Status = CheckPass
+			result.Message = conf.SSH.User + " は docker グループに所属しています"
+			return result
+		}
+	}
+	result.Status = CheckWarn
+	result.Message = conf.SSH.User + " は docker グループに所属していません"
+	result.Hint = fmt.Sprintf("sudo usermod -aG docker %s を実行し、再ログインしてください", conf.SSH.User)
+	return result
+}
+
+// checkRemoteCompose はリモートで利用可能な Docker Compose を確認する
+func checkRemoteCompose(ctx context.Context, conf config.Config) CheckResult {
+	result := CheckResult{Name: "リモートのDocker Compose"}
+	if out, err := executeRemoteCommandWithOutput(ctx, conf, "docker compose version --short"); err == nil {
+		result.Status = CheckPass
+		result.Message = "docker compose (v2) " + strings.TrimSpace(out)
+		return result
+	}
+	if out, err := executeRemoteCommandWithOutput(ctx, conf, "docker-compose version --short"); err == nil {
+		result.Status = CheckWarn
+		result.Message = "docker-compose (v1) " + strings.TrimSpace(out)
+		result.Hint = "docker-compose v1 はサポートが終了しています。Docker Compose v2 プラグインへの移行を推奨します"
+		return result
+	}
+	result.Status = CheckFail
+	result.Message = "docker compose / docker-compose のどちらも見つかりません"
+	result.Hint = "リモートサーバーに Docker Compose プラグインをインストールしてください"
+	return result
+}
+
+// checkRemoteDiskSpace はリモートにイメージを転送・ロードできるだけの空き容量があるか確認する
+func checkRemoteDiskSpace(ctx context.Context, conf config.Config) CheckResult {
+	result := CheckResult{Name: "リモートのディスク容量"}
+	cmd := fmt.Sprintf("df -Pk %s | tail -1 | awk '{print $4}'", conf.Deploy.RemoteTempDir)
+	out, err := executeRemoteCommandWithOutput(ctx, conf, cmd)
+	if err != nil {
+		result.Status = CheckWarn
+		result.Message = "空き容量を取得できません"
+		return result
+	}
+	availableKB, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		result.Status = CheckWarn
+		result.Message = "空き容量を解析できません: " + strings.TrimSpace(out)
+		return result
+	}
+	available := availableKB * 1024
+
+	// 転送する tar と展開後のイメージの両方が置けるだけの容量を必要とする
+	required := localImageSize(conf) * 2
+	if required == 0 {
+		required = 1024 * 1024 * 1024 // イメージサイズが不明な場合は 1GB を目安にする
+	}
+
+	result.Message = fmt.Sprintf("空き容量 %.1f GB (目安 %.1f GB)", float64(available)/1e9, float64(required)/1e9)
+	switch {
+	case available < required/2:
+		result.Status = CheckFail
+		result.Hint = "sailor prune で古いリリースを削除するか、ディスクを拡張してください"
+	case available < required:
+		result.Status = CheckWarn
+		result.Hint = "空き容量が少なくなっています。[deploy] keep_releases の設定や sailor prune を検討してください"
+	default:
+		result.Status = CheckPass
+	}
+	return result
+}
+
+// localImageSize はローカルにある最新のビルド済みイメージのサイズを返す。見つからない場合は 0
+func localImageSize(conf config.Config) int64 {
+	image := conf.Docker.ImageName
+	if conf.Docker.UseCompose {
+		image = imageRepository(composeImageRef(conf, composeServices(conf)[0]))
+	}
+	out, err := exec.Command("docker", "image", "ls", image, "--format", "{{.ID}}").Output()
+	if err != nil {
+		return 0
+	}
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return 0
+	}
+	out, err = exec.Command("docker", "image", "inspect", "--format", "{{.Size}}", ids[0]).Output()
+	if err != nil {
+		return 0
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// デプロイ前の git のガード（--force=<名前> で個別に無視できる）
+const (
+	GuardBranch   = "branch"   // 許可されたブランチ以外からのデプロイ
+	GuardUnpushed = "unpushed" // リモートにプッシュされていないコミットのデプロイ
+	GuardBehind   = "behind"   // origin より遅れているブランチからのデプロイ
+	GuardTag      = "tag"      // タグが付いていないコミットのデプロイ
+)
+
+// ForceAll は --force で値を省略した場合にすべてのガードを無視する指定
+const ForceAll = "all"
+
+// GuardFailure は満たされなかったデプロイ前のガード
+type GuardFailure struct {
+	Guard   string // ガードの名前
+	Message string // 満たされなかった理由
+}
+
+// allowedBranches はデプロイを許可するブランチのパターンを返す
+// [deploy] allowed_branches が未指定なら trigger_branch だけを許可する
+func allowedBranches(conf config.Config) []string {
+	if len(conf.Deploy.AllowedBranches) > 0 {
+		return conf.Deploy.AllowedBranches
+	}
+	if conf.Deploy.TriggerBranch != "" {
+		return []string{conf.Deploy.TriggerBranch}
+	}
+	return nil
+}
+
+// branchAllowed はブランチがいずれかのパターン (例: "release/*") に一致するかどうかを返す
+func branchAllowed(patterns []string, branch string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, branch); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckGitGuards はデプロイするコミットが [deploy] のガードを満たしているか確認し、満たされなかったガードを返す関数
+// ref が空なら作業ツリーの HEAD とブランチを、指定されていれば ref のコミットを確認する（ブランチに関するガードは確認しない）
+func CheckGitGuards(ctx context.Context, conf config.Config, local LocalRunner, ref string) []GuardFailure {
+	var failures []GuardFailure
+	commit := ref
+	if commit == "" {
+		commit = "HEAD"
+	}
+
+	var branch, upstream string
+	if ref == "" {
+		out, err := local.Output(ctx, "git", "rev-parse", "--abbrev-ref", "HEAD")
+		branch = strings.TrimSpace(out)
+		if patterns := allowedBranches(conf); len(patterns) > 0 && (err != nil || !branchAllowed(patterns, branch)) {
+			failures = append(failures, GuardFailure{GuardBranch, fmt.Sprintf("ブランチ %s からのデプロイは許可されていません（許可: %s）", branch, strings.Join(patterns, ", "))})
+		}
+		if out, err := local.Output(ctx, "git", "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{u}"); err == nil {
+			upstream = strings.TrimSpace(out)
+		}
+	}
+
+	// リモートとの比較は最新の状態で行う
+	if conf.Deploy.RequirePushed || conf.Deploy.RequireUpToDate {
+		if err := local.Run(ctx, "git", "fetch", "--quiet"); err != nil {
+			fmt.Printf("警告: git fetch に失敗しました。手元のリモート追跡ブランチで確認します: %v\n", err)
+		}
+	}
+
+	if conf.Deploy.RequirePushed {
+		switch {
+		case ref != "":
+			out, err := local.Output(ctx, "git", "branch", "-r", "--contains", commit)
+			if err != nil || strings.TrimSpace(out) == "" {
+				failures = append(failures, GuardFailure{GuardUnpushed, fmt.Sprintf("%s はどのリモートブランチにもプッシュされていません", ref)})
+			}
+		case upstream == "":
+			failures = append(failures, GuardFailure{GuardUnpushed, fmt.Sprintf("ブランチ %s に追跡ブランチがありません（git push -u で設定してください）", branch)})
+		default:
+			if err := local.Run(ctx, "git", "merge-base", "--is-ancestor", "HEAD", upstream); err != nil {
+				failures = append(failures, GuardFailure{GuardUnpushed, fmt.Sprintf("HEAD が %s にプッシュされていません", upstream)})
+			}
+		}
+	}
+
+	if conf.Deploy.RequireUpToDate && upstream != "" {
+		out, err := local.Output(ctx, "git", "rev-list", "--count", "HEAD.."+upstream)
+		if behind, _ := strconv.Atoi(strings.TrimSpace(out)); err == nil && behind > 0 {
+			failures = append(failures, GuardFailure{GuardBehind, fmt.Sprintf("ブランチ %s は %s より %d コミット遅れています（git pull してください）", branch, upstream, behind)})
+		}
+	}
+
+	if conf.Deploy.RequireTag {
+		out, err := local.Output(ctx, "git", "tag", "--points-at", commit)
+		if err != nil || strings.TrimSpace(out) == "" {
+			failures = append(failures, GuardFailure{GuardTag, fmt.Sprintf("%s にタグが付いていません", commit)})
+		}
+	}
+	return failures
+}
+
+// ValidateForce は --force で指定されたガードの名前を確認する関数
+func ValidateForce(force []string) error {
+	for _, name := range force {
+		switch name {
+		case GuardBranch, GuardUnpushed, GuardBehind, GuardTag, ForceAll:
+		default:
+			return fmt.Errorf("--force のガード名が不正です: %q（branch, unpushed, behind, tag, all のいずれかを指定してください）", name)
+		}
+	}
+	return nil
+}
+
+// ApplyForce は --force で指定されたガードを無視し、無視したガードの名前とデプロイを止めるガードを返す関数
+func ApplyForce(failures []GuardFailure, force []string) (forced []string, blocking []GuardFailure) {
+	for _, failure := range failures {
+		if containsString(force, ForceAll) || containsString(force, failure.Guard) {
+			forced = append(forced, failure.Guard)
+		} else {
+			blocking = append(blocking, failure)
+		}
+	}
+	return forced, blocking
+}
+
+// containsString は list に s が含まれるかどうかを返す
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
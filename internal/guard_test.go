@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func guardNames(failures []GuardFailure) []string {
+	var names []string
+	for _, failure := range failures {
+		names = append(names, failure.Guard)
+	}
+	return names
+}
+
+func TestCheckGitGuards(t *testing.T) {
+	t.Run("すべて満たしている", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Deploy.AllowedBranches = []string{"main", "release/*"}
+		conf.Deploy.RequirePushed = true
+		conf.Deploy.RequireUpToDate = true
+		conf.Deploy.RequireTag = true
+		local := &fakeLocal{}
+		local.on("git rev-parse --abbrev-ref HEAD", "release/1.4\n", nil)
+		local.on("git rev-parse --abbrev-ref --symbolic-full-name @{u}", "origin/release/1.4\n", nil)
+		local.on("git rev-list --count", "0\n", nil)
+		local.on("git tag --points-at HEAD", "v1.4.2\n", nil)
+
+		if failures := CheckGitGuards(context.Background(), conf, local, ""); len(failures) != 0 {
+			t.Errorf("failures = %v", failures)
+		}
+		assertCommands(t, local.commands[2:], []string{
+			"git fetch --quiet",
+			"git merge-base --is-ancestor HEAD origin/release/1.4",
+			"git rev-list --count HEAD..origin/release/1.4",
+			"git tag --points-at HEAD",
+		})
+	})
+
+	t.Run("満たしていないガード", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Deploy.TriggerBranch = "main"
+		conf.Deploy.RequirePushed = true
+		conf.Deploy.RequireUpToDate = true
+		conf.Deploy.RequireTag = true
+		local := &fakeLocal{}
+		local.on("git rev-parse --abbrev-ref HEAD", "feature/login\n", nil)
+		local.on("git rev-parse --abbrev-ref --symbolic-full-name @{u}", "origin/feature/login\n", nil)
+		local.on("git merge-base", "", errors.New("exit status 1"))
+		local.on("git rev-list --count", "3\n", nil)
+		local.on("git tag --points-at HEAD", "", nil)
+
+		failures := CheckGitGuards(context.Background(), conf, local, "")
+		if want := []string{GuardBranch, GuardUnpushed, GuardBehind, GuardTag}; !reflect.DeepEqual(guardNames(failures), want) {
+			t.Errorf("failures = %v, want %v", failures, want)
+		}
+	})
+
+	t.Run("追跡ブランチが無い", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Deploy.RequirePushed = true
+		local := &fakeLocal{}
+		local.on("git rev-parse --abbrev-ref HEAD", "main\n", nil)
+		local.on("git rev-parse --abbrev-ref --symbolic-full-name @{u}", "", errors.New("no upstream"))
+
+		failures := CheckGitGuards(context.Background(), conf, local, "")
+		if want := []string{GuardUnpushed}; !reflect.DeepEqual(guardNames(failures), want) {
+			t.Errorf("failures = %v, want %v", failures, want)
+		}
+	})
+
+	t.Run("--ref のコミット", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Deploy.TriggerBranch = "main"
+		conf.Deploy.RequirePushed = true
+		conf.Deploy.RequireUpToDate = true
+		local := &fakeLocal{}
+		local.on("git branch -r --contains v1.4.2", "  origin/main\n", nil)
+
+		if failures := CheckGitGuards(context.Background(), conf, local, "v1.4.2"); len(failures) != 0 {
+			t.Errorf("failures = %v", failures)
+		}
+		assertCommands(t, local.commands, []string{
+			"git fetch --quiet",
+			"git branch -r --contains v1.4.2",
+		})
+	})
+}
+
+func TestApplyForce(t *testing.T) {
+	failures := []GuardFailure{{Guard: GuardBranch}, {Guard: GuardUnpushed}, {Guard: GuardTag}}
+
+	forced, blocking := ApplyForce(failures, []string{GuardUnpushed, GuardTag})
+	if want := []string{GuardUnpushed, GuardTag}; !reflect.DeepEqual(forced, want) {
+		t.Errorf("forced = %v, want %v", forced, want)
+	}
+	if want := []string{GuardBranch}; !reflect.DeepEqual(guardNames(blocking), want) {
+		t.Errorf("blocking = %v, want %v", blocking, want)
+	}
+
+	if _, blocking := ApplyForce(failures, []string{ForceAll}); len(blocking) != 0 {
+		t.Errorf("--force ですべてのガードが無視されていません: %v", blocking)
+	}
+}
+
+func TestValidateForce(t *testing.T) {
+	if err := ValidateForce([]string{GuardBranch, GuardUnpushed, GuardBehind, GuardTag, ForceAll}); err != nil {
+		t.Errorf("ValidateForce() error = %v", err)
+	}
+	if err := ValidateForce([]string{GuardTag, "unpushd"}); err == nil || !strings.Contains(err.Error(), "unpushd") {
+		t.Errorf("不明なガード名でエラーが返されていません: %v", err)
+	}
+}
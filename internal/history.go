@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/linkalls/sailor/config"
+)
+
+// remoteHistoryPath はリモートのデプロイ履歴ファイルのパスを返す
+func remoteHistoryPath(conf config.Config) string {
+	return RemoteStateDir(conf) + "/history.toml"
+}
+
+// remoteCurrentPath は現在デプロイされているバージョンを記録するファイルのパスを返す
+func remoteCurrentPath(conf config.Config) string {
+	return RemoteStateDir(conf) + "/current"
+}
+
+// FetchRemoteHistory はリモートのデプロイ履歴と現在デプロイされているバージョンを読み込む関数
+// 履歴がまだ無い場合は空の履歴を返す
+func FetchRemoteHistory(ctx context.Context, conf config.Config, remote RemoteRunner) (config.History, string, error) {
+	out, err := remote.Output(ctx, fmt.Sprintf("cat %s 2>/dev/null || true", remoteHistoryPath(conf)))
+	if err != nil {
+		return nil, "", fmt.Errorf("リモートのデプロイ履歴の読み込みに失敗: %w", err)
+	}
+	history := make(config.History)
+	if _, err := toml.Decode(out, &history); err != nil {
+		return nil, "", fmt.Errorf("リモートのデプロイ履歴の解析に失敗: %w", err)
+	}
+
+	current, err := remote.Output(ctx, fmt.Sprintf("cat %s 2>/dev/null || true", remoteCurrentPath(conf)))
+	if err != nil {
+		return nil, "", fmt.Errorf("現在のバージョンの読み込みに失敗: %w", err)
+	}
+	return history, strings.TrimSpace(current), nil
+}
+
+// LoadDeployHistory はリモートの履歴とローカルの履歴を統合して返す関数
+// 同じバージョンのエントリはリモートの内容を正とする
+func LoadDeployHistory(ctx context.Context, conf config.Config, remote RemoteRunner) (config.History, string, error) {
+	local, err := config.LoadHistory(config.HistoryPath)
+	if err != nil {
+		return nil, "", err
+	}
+	remoteHistory, current, err := FetchRemoteHistory(ctx, conf, remote)
+	if err != nil {
+		return nil, "", err
+	}
+	return config.MergeHistory(local, remoteHistory), current, nil
+}
+
+// RecordDeploy はデプロイ履歴エントリをリモートとローカルの両方に記録する関数
+// 正常に完了したデプロイはリモートの「現在のバージョン」も更新する
+// リモートへの記録に失敗した場合もローカルには記録したうえでエラーを返す
+func RecordDeploy(ctx context.Context, conf config.Config, remote RemoteRunner, entry config.DeployHistoryEntry) error {
+	local, err := config.LoadHistory(config.HistoryPath)
+	if err != nil {
+		return err
+	}
+	remoteHistory, current, remoteErr := FetchRemoteHistory(ctx, conf, remote)
+
+	// ローカルにしかない過去の履歴もリモートへ引き継ぐ
+	history := config.MergeHistory(local, remoteHistory)
+	history[entry.Version] = entry
+	if err := config.SaveHistory(config.HistoryPath, history); err != nil {
+		return fmt.Errorf("ローカルのデプロイ履歴の保存に失敗: %w", err)
+	}
+	if remoteErr != nil {
+		return remoteErr
+	}
+
+	if entry.Status == config.DeployStatusSuccess {
+		current = entry.Version
+	}
+	return pushRemoteHistory(ctx, conf, remote, history, current)
+}
+
+// SetCurrentVersion はリモートの「現在デプロイされているバージョン」を更新する関数
+func SetCurrentVersion(ctx context.Context, conf config.Config, remote RemoteRunner, version string) error {
+	cmd := fmt.Sprintf("mkdir -p %s && printf '%%s\\n' %s > %s",
+		RemoteStateDir(conf), shellQuote(version), remoteCurrentPath(conf))
+	if err := remote.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("現在のバージョンの記録に失敗: %w", err)
+	}
+	return nil
+}
+
+// pushRemoteHistory はリモートの履歴ファイルと現在のバージョンを書き換える関数
+// 履歴は増え続けるため、コマンドの引数ではなくファイルとして転送する
+// 書き込み途中で中断されても履歴が壊れないよう、一時ファイルに転送してから置き換える
+func pushRemoteHistory(ctx context.Context, conf config.Config, remote RemoteRunner, history config.History, current string) error {
+	file, err := os.CreateTemp("", "sailor-history-*.toml")
+	if err != nil {
+		return fmt.Errorf("デプロイ履歴の一時ファイルの作成に失敗: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if err := toml.NewEncoder(file).Encode(history); err != nil {
+		file.Close()
+		return fmt.Errorf("デプロイ履歴の作成に失敗: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("デプロイ履歴の作成に失敗: %w", err)
+	}
+
+	path := remoteHistoryPath(conf)
+	if err := remote.Run(ctx, "mkdir -p "+RemoteStateDir(conf)); err != nil {
+		return fmt.Errorf("リモートのデプロイ履歴の保存に失敗: %w", err)
+	}
+	if err := remote.Transfer(ctx, file.Name(), path+".tmp"); err != nil {
+		return fmt.Errorf("リモートのデプロイ履歴の転送に失敗: %w", err)
+	}
+	if err := remote.Run(ctx, fmt.Sprintf("mv %s.tmp %s", path, path)); err != nil {
+		return fmt.Errorf("リモートのデプロイ履歴の保存に失敗: %w", err)
+	}
+	if current == "" {
+		return nil
+	}
+	return SetCurrentVersion(ctx, conf, remote, current)
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/linkalls/sailor/config"
+)
+
+const remoteHistoryOutput = `[1700000001]
+version = "1700000001"
+commit_hash = "remote1"
+image = "myapp:20231114000001"
+timestamp = 2023-11-14T22:13:21Z
+
+[1700000002]
+version = "1700000002"
+commit_hash = "remote2"
+image = "myapp:20231114000002"
+timestamp = 2023-11-14T22:13:22Z
+`
+
+func TestLoadDeployHistory(t *testing.T) {
+	chdirWithHistory(t, config.History{
+		"1700000000": {Version: "1700000000", CommitHash: "local0"},
+		"1700000001": {Version: "1700000001", CommitHash: "local1"},
+	})
+
+	remote := &fakeRemote{}
+	remote.on("cat ~/.sailor/myapp_container/history.toml", remoteHistoryOutput, nil)
+	remote.on("cat ~/.sailor/myapp_container/current", "1700000002\n", nil)
+	history, current, err := LoadDeployHistory(context.Background(), newTestConfig(), remote)
+	if err != nil {
+		t.Fatalf("LoadDeployHistory() error = %v", err)
+	}
+	if current != "1700000002" {
+		t.Errorf("current = %q, want 1700000002", current)
+	}
+	if len(history) != 3 {
+		t.Fatalf("ローカルとリモートの履歴が統合されていません: %v", history)
+	}
+	if got := history["1700000001"].CommitHash; got != "remote1" {
+		t.Errorf("重複したバージョンでリモートの履歴が優先されていません: %s", got)
+	}
+	if got := history["1700000000"].CommitHash; got != "local0" {
+		t.Errorf("ローカルにしかない履歴が失われています: %s", got)
+	}
+}
+
+// historyRemote は転送されたデプロイ履歴の内容を記録する fakeRemote
+type historyRemote struct {
+	fakeRemote
+	pushed string
+}
+
+func (r *historyRemote) Transfer(ctx context.Context, localPath, remotePath string) error {
+	if content, err := os.ReadFile(localPath); err == nil {
+		r.pushed = string(content)
+	}
+	return r.fakeRemote.Transfer(ctx, localPath, remotePath)
+}
+
+func TestRecordDeploy(t *testing.T) {
+	t.Run("成功したデプロイ", func(t *testing.T) {
+		chdirWithHistory(t, config.History{"1600000000": {Version: "1600000000", CommitHash: "local0"}})
+		remote := &historyRemote{}
+		remote.on("cat ~/.sailor/myapp_container/history.toml", remoteHistoryOutput, nil)
+		if err := RecordDeploy(context.Background(), newTestConfig(), remote, config.NewDeployHistoryEntry(newTestConfig(), config.DeployStatusSuccess)); err != nil {
+			t.Fatalf("RecordDeploy() error = %v", err)
+		}
+
+		local, err := config.LoadHistory(config.HistoryPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(local) != 4 {
+			t.Errorf("ローカルの履歴にリモートの履歴と新しいエントリが統合されていません: %d 件", len(local))
+		}
+		var version string
+		for v, entry := range local {
+			if entry.Image == "myapp:20240101000000" {
+				version = v
+			}
+		}
+		if version == "" {
+			t.Fatal("新しいエントリがローカルに記録されていません")
+		}
+
+		assertCommands(t, []string{remote.commands[2], remote.commands[4]}, []string{
+			"mkdir -p ~/.sailor/myapp_container",
+			"mv ~/.sailor/myapp_container/history.toml.tmp ~/.sailor/myapp_container/history.toml",
+		})
+		if transfer := remote.commands[3]; !strings.HasPrefix(transfer, "transfer ") || !strings.HasSuffix(transfer, " -> ~/.sailor/myapp_container/history.toml.tmp") {
+			t.Errorf("リモートの履歴の転送コマンドが想定と異なります: %s", transfer)
+		}
+		for _, want := range []string{"local0", "remote2", "myapp:20240101000000"} {
+			if !strings.Contains(remote.pushed, want) {
+				t.Errorf("リモートに書き込む履歴に %s が含まれていません", want)
+			}
+		}
+		if want := "mkdir -p ~/.sailor/myapp_container && printf '%s\\n' '" + version + "' > ~/.sailor/myapp_container/current"; remote.commands[5] != want {
+			t.Errorf("現在のバージョンが更新されていません\ngot:  %s\nwant: %s", remote.commands[5], want)
+		}
+	})
+
+	t.Run("中断されたデプロイは現在のバージョンを変えない", func(t *testing.T) {
+		chdirWithHistory(t, config.History{})
+		remote := &fakeRemote{}
+		remote.on("cat ~/.sailor/myapp_container/current", "1700000002\n", nil)
+		if err := RecordDeploy(context.Background(), newTestConfig(), remote, config.NewDeployHistoryEntry(newTestConfig(), config.DeployStatusAborted)); err != nil {
+			t.Fatalf("RecordDeploy() error = %v", err)
+		}
+		if last := remote.commands[len(remote.commands)-1]; !strings.Contains(last, "'1700000002' > ~/.sailor/myapp_container/current") {
+			t.Errorf("現在のバージョンが変更されています: %s", last)
+		}
+	})
+
+	t.Run("リモートに接続できなくてもローカルには記録する", func(t *testing.T) {
+		chdirWithHistory(t, config.History{})
+		remote := &fakeRemote{}
+		remote.on("cat", "", errors.New("connection refused"))
+		if err := RecordDeploy(context.Background(), newTestConfig(), remote, config.NewDeployHistoryEntry(newTestConfig(), config.DeployStatusSuccess)); err == nil {
+			t.Error("リモートへの記録失敗でエラーが返されていません")
+		}
+		local, err := config.LoadHistory(config.HistoryPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(local) != 1 {
+			t.Errorf("ローカルに履歴が記録されていません: %v", local)
+		}
+		for _, c := range remote.commands {
+			if strings.HasPrefix(c, "mkdir") {
+				t.Errorf("読み込みに失敗したリモートの履歴が上書きされています: %s", c)
+			}
+		}
+	})
+}
@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/linkalls/sailor/config"
+)
+
+const (
+	defaultStateDir = "~/.sailor"
+	defaultLockTTL  = 30 * time.Minute
+	lockDirName     = "deploy.lock"
+)
+
+// ErrDeployLocked は他のデプロイがロックを保持している場合のエラー
+var ErrDeployLocked = errors.New("他のデプロイが実行中です")
+
+// LockInfo はデプロイロックの保持者の情報
+type LockInfo struct {
+	User      string    `toml:"user"`
+	Host      string    `toml:"host"`
+	PID       int       `toml:"pid"`
+	Commit    string    `toml:"commit"`
+	StartedAt time.Time `toml:"started_at"`
+}
+
+// NewLockInfo は現在のユーザー・ホスト・プロセスのロック情報を作成する関数
+func NewLockInfo(commit string) LockInfo {
+	info := LockInfo{PID: os.Getpid(), Commit: commit, StartedAt: time.Now()}
+	if u, err := user.Current(); err == nil {
+		info.User = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		info.Host = host
+	}
+	return info
+}
+
+// String はロック保持者を人が読める形式で返す
+func (l LockInfo) String() string {
+	started := "不明"
+	if !l.StartedAt.IsZero() {
+		started = l.StartedAt.Local().Format("2006-01-02 15:04:05")
+	}
+	return fmt.Sprintf("%s@%s (pid %d, commit %s, 開始 %s)", l.User, l.Host, l.PID, l.Commit, started)
+}
+
+// IsStale は取得から ttl 以上経過した（または情報が壊れている）ロックかどうかを返す
+func (l LockInfo) IsStale(ttl time.Duration, now time.Time) bool {
+	return l.StartedAt.IsZero() || now.Sub(l.StartedAt) > ttl
+}
+
+// OwnedBy は同じユーザー・ホストが取得したロックかどうかを返す
+func (l LockInfo) OwnedBy(other LockInfo) bool {
+	return l.User == other.User && l.Host == other.Host
+}
+
+// HeldBy は同じユーザー・ホストの同じプロセスが取得したロックかどうかを返す
+func (l LockInfo) HeldBy(other LockInfo) bool {
+	return l.OwnedBy(other) && l.PID == other.PID
+}
+
+// RemoteStateDir はリモートで sailor の状態を保存するディレクトリを返す
+// 同じサーバーに複数のアプリをデプロイできるよう、プロジェクトごとのサブディレクトリに分ける
+func RemoteStateDir(conf config.Config) string {
+	dir := defaultStateDir
+	if conf.Deploy.StateDir != "" {
+		dir = conf.Deploy.StateDir
+	}
+	if name := ProjectName(conf); name != "" {
+		dir += "/" + name
+	}
+	return dir
+}
+
+// LockTTL はロックを古いとみなすまでの時間を返す
+func LockTTL(conf config.Config) (time.Duration, error) {
+	if conf.Deploy.LockTTL == "" {
+		return defaultLockTTL, nil
+	}
+	ttl, err := time.ParseDuration(conf.Deploy.LockTTL)
+	if err != nil {
+		return 0, fmt.Errorf("lock_ttl の形式が不正です: %w", err)
+	}
+	return ttl, nil
+}
+
+// lockDir はリモートのロックディレクトリのパスを返す
+func lockDir(conf config.Config) string {
+	return RemoteStateDir(conf) + "/" + lockDirName
+}
+
+// encodeLockInfo はロック情報をリモートの info ファイルに書き込む TOML に変換する
+func encodeLockInfo(info LockInfo) (string, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(info); err != nil {
+		return "", fmt.Errorf("ロック情報の作成に失敗: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// AcquireDeployLock はリモートにデプロイロックを取得する関数
+// ロックは mkdir の原子性を利用して取得し、TTL を過ぎた古いロックは解除してから取り直す
+func AcquireDeployLock(ctx context.Context, conf config.Config, remote RemoteRunner, info LockInfo) error {
+	ttl, err := LockTTL(conf)
+	if err != nil {
+		return err
+	}
+
+	body, err := encodeLockInfo(info)
+	if err != nil {
+		return err
+	}
+	dir := lockDir(conf)
+	lockCmd := fmt.Sprintf("mkdir -p %s && mkdir %s 2>/dev/null && printf '%%s' %s > %s/info",
+		RemoteStateDir(conf), dir, shellQuote(body), dir)
+
+	if err := remote.Run(ctx, lockCmd); err == nil {
+		return nil
+	} else if ctx.Err() != nil {
+		return err
+	}
+
+	current, currentBody, err := readDeployLock(ctx, conf, remote)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		if !current.IsStale(ttl, time.Now()) {
+			return fmt.Errorf("%w: %s がロックを保持しています", ErrDeployLocked, current)
+		}
+		fmt.Printf("警告: 古いデプロイロックを解除します: %s\n", current)
+		// 確認した古いロックのままの場合だけ別名に移動してから削除する
+		// 同時に解除しようとした他のデプロイが取り直したロックを消さないよう、確認と移動は 1 つのコマンドで行う
+		takeoverCmd := fmt.Sprintf("[ \"$(cat %s/info 2>/dev/null)\" = %s ] && mv %s %s.stale.$$ && rm -rf %s.stale.$$",
+			dir, shellQuote(currentBody), dir, dir, dir)
+		if err := remote.Run(ctx, takeoverCmd); err != nil {
+			return fmt.Errorf("%w: 古いロックの解除中に他のデプロイがロックを取得しました", ErrDeployLocked)
+		}
+	}
+
+	// 古いロックの解除後、または確認までの間に解放された場合にもう一度だけ取得を試みる
+	if err := remote.Run(ctx, lockCmd); err != nil {
+		return fmt.Errorf("デプロイロックの取得に失敗: %w", err)
+	}
+	return nil
+}
+
+// ReadDeployLock はリモートのデプロイロックの情報を読み込む関数
+// ロックが存在しない場合は nil を返す
+func ReadDeployLock(ctx context.Context, conf config.Config, remote RemoteRunner) (*LockInfo, error) {
+	info, _, err := readDeployLock(ctx, conf, remote)
+	return info, err
+}
+
+// readDeployLock はリモートのデプロイロックの情報と info ファイルの内容（末尾の改行を除く）を読み込む
+func readDeployLock(ctx context.Context, conf config.Config, remote RemoteRunner) (*LockInfo, string, error) {
+	dir := lockDir(conf)
+	out, err := remote.Output(ctx, fmt.Sprintf("if [ -d %s ]; then echo locked; cat %s/info 2>/dev/null; fi", dir, dir))
+	if err != nil {
+		return nil, "", fmt.Errorf("デプロイロックの確認に失敗: %w", err)
+	}
+	status, body, _ := strings.Cut(strings.TrimSpace(out), "\n")
+	if status != "locked" {
+		return nil, "", nil
+	}
+
+	// 情報が書き込まれる前に中断されたロックは開始時刻が空のまま返し、古いロックとして扱う
+	var info LockInfo
+	if _, err := toml.Decode(body, &info); err != nil {
+		return &LockInfo{}, body, nil
+	}
+	return &info, body, nil
+}
+
+// ReleaseDeployLock はリモートのデプロイロックを保持者に関係なく削除する関数（sailor unlock 用）
+func ReleaseDeployLock(ctx context.Context, conf config.Config, remote RemoteRunner) error {
+	if err := remote.Run(ctx, "rm -rf "+lockDir(conf)); err != nil {
+		return fmt.Errorf("デプロイロックの解除に失敗: %w", err)
+	}
+	return nil
+}
+
+// ReleaseOwnDeployLock は info のプロセスが保持しているデプロイロックを削除する関数
+// TTL を過ぎて他のデプロイに引き継がれたロックは削除しない
+func ReleaseOwnDeployLock(ctx context.Context, conf config.Config, remote RemoteRunner, info LockInfo) error {
+	current, err := ReadDeployLock(ctx, conf, remote)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return nil
+	}
+	if !current.HeldBy(info) {
+		return fmt.Errorf("デプロイロックは %s に引き継がれているため解除しません", current)
+	}
+	return ReleaseDeployLock(ctx, conf, remote)
+}
+
+// RefreshDeployLock は info のプロセスが保持しているデプロイロックの開始時刻を更新する関数
+// 長い転送の途中で TTL を過ぎ、他のデプロイに古いロックとして解除されないようにする
+func RefreshDeployLock(ctx context.Context, conf config.Config, remote RemoteRunner, info *LockInfo) error {
+	current, err := ReadDeployLock(ctx, conf, remote)
+	if err != nil {
+		return err
+	}
+	if current == nil || !current.HeldBy(*info) {
+		return fmt.Errorf("デプロイロックが他のデプロイに引き継がれています")
+	}
+
+	refreshed := *info
+	refreshed.StartedAt = time.Now()
+	body, err := encodeLockInfo(refreshed)
+	if err != nil {
+		return err
+	}
+	if err := remote.Run(ctx, fmt.Sprintf("printf '%%s' %s > %s/info", shellQuote(body), lockDir(conf))); err != nil {
+		return fmt.Errorf("デプロイロックの更新に失敗: %w", err)
+	}
+	*info = refreshed
+	return nil
+}
+
+// KeepDeployLock は TTL の 1/3 ごとにデプロイロックの開始時刻を更新し続ける関数
+// 返り値の関数を呼ぶと更新を止める
+func KeepDeployLock(ctx context.Context, conf config.Config, remote RemoteRunner, info LockInfo) (stop func()) {
+	ttl, err := LockTTL(conf)
+	if err != nil || ttl <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := RefreshDeployLock(ctx, conf, remote, &info); err != nil && ctx.Err() == nil {
+					fmt.Println("警告:", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// shellQuote は文字列をシェルのシングルクォートで囲む
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lockOutput は ReadDeployLock が読み込むリモートの出力を作成する
+func lockOutput(startedAt time.Time) string {
+	return "locked\n" +
+		"user = \"alice\"\n" +
+		"host = \"laptop\"\n" +
+		"pid = 4242\n" +
+		"commit = \"abc1234\"\n" +
+		"started_at = " + startedAt.UTC().Format(time.RFC3339) + "\n"
+}
+
+func TestAcquireDeployLock(t *testing.T) {
+	info := LockInfo{User: "bob", Host: "desk", PID: 1, Commit: "def5678", StartedAt: time.Now()}
+
+	t.Run("ロックなし", func(t *testing.T) {
+		remote := &fakeRemote{}
+		if err := AcquireDeployLock(context.Background(), newTestConfig(), remote, info); err != nil {
+			t.Fatalf("AcquireDeployLock() error = %v", err)
+		}
+		if len(remote.commands) != 1 {
+			t.Fatalf("実行されたコマンドが想定と異なります: %v", remote.commands)
+		}
+		cmd := remote.commands[0]
+		if !strings.HasPrefix(cmd, "mkdir -p ~/.sailor/myapp_container && mkdir ~/.sailor/myapp_container/deploy.lock 2>/dev/null && printf '%s' ") {
+			t.Errorf("ロック取得コマンドが想定と異なります: %s", cmd)
+		}
+		for _, want := range []string{`user = "bob"`, `host = "desk"`, `commit = "def5678"`, "> ~/.sailor/myapp_container/deploy.lock/info"} {
+			if !strings.Contains(cmd, want) {
+				t.Errorf("ロック取得コマンドに %q が含まれていません: %s", want, cmd)
+			}
+		}
+	})
+
+	t.Run("他のデプロイが実行中", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("mkdir -p", "", errors.New("exit status 1"))
+		remote.on("if [ -d", lockOutput(time.Now().Add(-time.Minute)), nil)
+		err := AcquireDeployLock(context.Background(), newTestConfig(), remote, info)
+		if !errors.Is(err, ErrDeployLocked) {
+			t.Fatalf("ErrDeployLocked が返されていません: %v", err)
+		}
+		if !strings.Contains(err.Error(), "alice@laptop") || !strings.Contains(err.Error(), "abc1234") {
+			t.Errorf("ロック保持者がエラーに含まれていません: %v", err)
+		}
+		for _, c := range remote.commands {
+			if strings.HasPrefix(c, "rm -rf") {
+				t.Error("有効なロックが解除されています")
+			}
+		}
+	})
+
+	t.Run("古いロックは解除して取り直す", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Deploy.StateDir = "/var/lib/sailor"
+		conf.Deploy.LockTTL = "10m"
+		remote := &fakeRemote{}
+		remote.on("mkdir -p", "", errors.New("exit status 1"))
+		remote.on("if [ -d", lockOutput(time.Now().Add(-time.Hour)), nil)
+		err := AcquireDeployLock(context.Background(), conf, remote, info)
+		if err == nil || errors.Is(err, ErrDeployLocked) {
+			t.Fatalf("再取得の失敗がそのまま返されていません: %v", err)
+		}
+		// 読み込んだ古いロックのままの場合だけ別名に移動してから削除する
+		body := strings.TrimPrefix(strings.TrimSpace(lockOutput(time.Now().Add(-time.Hour))), "locked\n")
+		takeover := `[ "$(cat /var/lib/sailor/myapp_container/deploy.lock/info 2>/dev/null)" = ` + shellQuote(body) + ` ] && ` +
+			"mv /var/lib/sailor/myapp_container/deploy.lock /var/lib/sailor/myapp_container/deploy.lock.stale.$$ && " +
+			"rm -rf /var/lib/sailor/myapp_container/deploy.lock.stale.$$"
+		if len(remote.commands) != 4 || remote.commands[2] != takeover {
+			t.Errorf("古いロックの解除と再取得が行われていません: %v", remote.commands)
+		}
+	})
+
+	t.Run("古いロックの解除中に他のデプロイが取得", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("mkdir -p", "", errors.New("exit status 1"))
+		remote.on("if [ -d", lockOutput(time.Now().Add(-time.Hour)), nil)
+		remote.on(`[ "$(cat`, "", errors.New("exit status 1"))
+		err := AcquireDeployLock(context.Background(), newTestConfig(), remote, info)
+		if !errors.Is(err, ErrDeployLocked) {
+			t.Fatalf("ErrDeployLocked が返されていません: %v", err)
+		}
+		if len(remote.commands) != 3 {
+			t.Errorf("解除に失敗した後もロックの取得が試みられています: %v", remote.commands)
+		}
+	})
+
+	t.Run("不正な lock_ttl", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Deploy.LockTTL = "30"
+		remote := &fakeRemote{}
+		if err := AcquireDeployLock(context.Background(), conf, remote, info); err == nil {
+			t.Error("不正な lock_ttl でエラーが返されていません")
+		}
+		if len(remote.commands) != 0 {
+			t.Errorf("リモートコマンドが実行されています: %v", remote.commands)
+		}
+	})
+}
+
+func TestReadDeployLock(t *testing.T) {
+	t.Run("ロックなし", func(t *testing.T) {
+		remote := &fakeRemote{}
+		info, err := ReadDeployLock(context.Background(), newTestConfig(), remote)
+		if err != nil || info != nil {
+			t.Errorf("ReadDeployLock() = %v, %v, want nil, nil", info, err)
+		}
+	})
+
+	t.Run("ロックあり", func(t *testing.T) {
+		started := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		remote := &fakeRemote{}
+		remote.on("if [ -d", lockOutput(started), nil)
+		info, err := ReadDeployLock(context.Background(), newTestConfig(), remote)
+		if err != nil {
+			t.Fatalf("ReadDeployLock() error = %v", err)
+		}
+		want := LockInfo{User: "alice", Host: "laptop", PID: 4242, Commit: "abc1234", StartedAt: started}
+		if info == nil || *info != want {
+			t.Errorf("ReadDeployLock() = %+v, want %+v", info, want)
+		}
+	})
+
+	t.Run("情報のないロックは古いものとして扱う", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("if [ -d", "locked\n", nil)
+		info, err := ReadDeployLock(context.Background(), newTestConfig(), remote)
+		if err != nil || info == nil {
+			t.Fatalf("ReadDeployLock() = %v, %v", info, err)
+		}
+		if !info.IsStale(time.Hour, time.Now()) {
+			t.Error("情報のないロックが古いものとして扱われていません")
+		}
+	})
+}
+
+func TestReleaseOwnDeployLock(t *testing.T) {
+	owner := LockInfo{User: "alice", Host: "laptop", PID: 4242}
+
+	t.Run("自分のロックを解除", func(t *testing.T) {
+		remote := &fakeRemote{}
+		remote.on("if [ -d", lockOutput(time.Now()), nil)
+		if err := ReleaseOwnDeployLock(context.Background(), newTestConfig(), remote, owner); err != nil {
+			t.Fatalf("ReleaseOwnDeployLock() error = %v", err)
+		}
+		if last := remote.commands[len(remote.commands)-1]; last != "rm -rf ~/.sailor/myapp_container/deploy.lock" {
+			t.Errorf("ロックが解除されていません: %v", remote.commands)
+		}
+	})
+
+	t.Run("引き継がれたロックは解除しない", func(t *testing.T) {
+		for _, other := range []LockInfo{
+			{User: "alice", Host: "laptop", PID: 1},
+			{User: "bob", Host: "laptop", PID: 4242},
+		} {
+			remote := &fakeRemote{}
+			remote.on("if [ -d", lockOutput(time.Now()), nil)
+			err := ReleaseOwnDeployLock(context.Background(), newTestConfig(), remote, other)
+			if err == nil || !strings.Contains(err.Error(), "alice@laptop") {
+				t.Errorf("他のプロセスのロックでエラーが返されていません: %v", err)
+			}
+			if len(remote.commands) != 1 {
+				t.Errorf("他のプロセスのロックが解除されています: %v", remote.commands)
+			}
+		}
+	})
+
+	t.Run("ロックなし", func(t *testing.T) {
+		remote := &fakeRemote{}
+		if err := ReleaseOwnDeployLock(context.Background(), newTestConfig(), remote, owner); err != nil {
+			t.Fatalf("ReleaseOwnDeployLock() error = %v", err)
+		}
+		if len(remote.commands) != 1 {
+			t.Errorf("ロックがないのに解除されています: %v", remote.commands)
+		}
+	})
+}
+
+func TestRefreshDeployLock(t *testing.T) {
+	started := time.Now().Add(-time.Hour)
+
+	t.Run("開始時刻を更新", func(t *testing.T) {
+		info := LockInfo{User: "alice", Host: "laptop", PID: 4242, Commit: "abc1234", StartedAt: started}
+		remote := &fakeRemote{}
+		remote.on("if [ -d", lockOutput(started), nil)
+		if err := RefreshDeployLock(context.Background(), newTestConfig(), remote, &info); err != nil {
+			t.Fatalf("RefreshDeployLock() error = %v", err)
+		}
+		if !info.StartedAt.After(started) || info.IsStale(time.Minute, time.Now()) {
+			t.Errorf("開始時刻が更新されていません: %s", info.StartedAt)
+		}
+		last := remote.commands[len(remote.commands)-1]
+		if !strings.HasPrefix(last, "printf '%s' ") || !strings.HasSuffix(last, " > ~/.sailor/myapp_container/deploy.lock/info") ||
+			!strings.Contains(last, "started_at = "+info.StartedAt.Format("2006-01-02T15:04:05")) {
+			t.Errorf("ロック情報の更新コマンドが想定と異なります: %s", last)
+		}
+	})
+
+	t.Run("引き継がれたロックは更新しない", func(t *testing.T) {
+		info := LockInfo{User: "alice", Host: "laptop", PID: 1, StartedAt: started}
+		remote := &fakeRemote{}
+		remote.on("if [ -d", lockOutput(started), nil)
+		if err := RefreshDeployLock(context.Background(), newTestConfig(), remote, &info); err == nil {
+			t.Error("他のプロセスのロックでエラーが返されていません")
+		}
+		if len(remote.commands) != 1 || !info.StartedAt.Equal(started) {
+			t.Errorf("他のプロセスのロックが更新されています: %v", remote.commands)
+		}
+	})
+}
+
+func TestShellQuote(t *testing.T) {
+	if got, want := shellQuote("it's"), `'it'\''s'`; got != want {
+		t.Errorf("shellQuote() = %s, want %s", got, want)
+	}
+}
+
+func TestRemoteStateDir(t *testing.T) {
+	conf := newTestConfig()
+	if got := RemoteStateDir(conf); got != "~/.sailor/myapp_container" {
+		t.Errorf("RemoteStateDir() = %s, want ~/.sailor/myapp_container", got)
+	}
+
+	// compose 使用時は project_name ごとに分ける
+	conf = newTestComposeConfig()
+	conf.Deploy.StateDir = "/var/lib/sailor"
+	conf.Compose.ProjectName = "Shop API"
+	if got := RemoteStateDir(conf); got != "/var/lib/sailor/shopapi" {
+		t.Errorf("RemoteStateDir() = %s, want /var/lib/sailor/shopapi", got)
+	}
+}
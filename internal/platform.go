@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// unamePlatform は uname -m の出力を Docker のプラットフォーム名に変換する
+// 対応していないアーキテクチャの場合は空を返す
+func unamePlatform(machine string) string {
+	switch machine {
+	case "x86_64", "amd64":
+		return "linux/amd64"
+	case "aarch64", "arm64":
+		return "linux/arm64"
+	case "armv7l":
+		return "linux/arm/v7"
+	case "armv6l":
+		return "linux/arm/v6"
+	case "i386", "i686":
+		return "linux/386"
+	case "ppc64le", "s390x", "riscv64":
+		return "linux/" + machine
+	}
+	return ""
+}
+
+// samePlatform は2つのプラットフォームの OS とアーキテクチャが一致するかどうかを返す
+// linux/arm64 と linux/arm64/v8 のように、バリアントの有無は区別しない
+func samePlatform(a, b string) bool {
+	osArch := func(platform string) string {
+		parts := strings.SplitN(strings.TrimSpace(platform), "/", 3)
+		if len(parts) < 2 {
+			return platform
+		}
+		return parts[0] + "/" + parts[1]
+	}
+	return osArch(a) == osArch(b)
+}
+
+// ResolvePlatform はリモートサーバーのプラットフォームを検出し、[docker] platform が未指定の場合は
+// ローカルの Docker と異なるときだけビルドするプラットフォームとして設定する関数
+// 検出したリモートのプラットフォームを返す（検出できなければ空）
+func ResolvePlatform(ctx context.Context, conf *config.Config, local LocalRunner, remote RemoteRunner) (string, error) {
+	out, err := remote.Output(ctx, "uname -m")
+	if err != nil {
+		return "", fmt.Errorf("リモートサーバーのアーキテクチャの取得に失敗: %w", err)
+	}
+	target := unamePlatform(strings.TrimSpace(out))
+	if conf.Docker.Platform != "" || target == "" {
+		return target, nil
+	}
+
+	out, err = local.Output(ctx, "docker", "version", "--format", "{{.Server.Os}}/{{.Server.Arch}}")
+	if err != nil {
+		return target, fmt.Errorf("ローカルの Docker のプラットフォームの取得に失敗: %w", err)
+	}
+	if strings.Contains(out, "/") && !samePlatform(out, target) {
+		fmt.Printf("リモートサーバーのプラットフォーム %s 向けにビルドします（ローカル: %s）\n", target, strings.TrimSpace(out))
+		conf.Docker.Platform = target
+	}
+	return target, nil
+}
+
+// CheckImagePlatform はビルドしたイメージのアーキテクチャがデプロイ先と一致するか確認し、一致しないイメージの警告を返す関数
+func CheckImagePlatform(ctx context.Context, conf config.Config, local LocalRunner, target string) []string {
+	if target == "" {
+		return nil
+	}
+	var warnings []string
+	for _, image := range builtImageRefs(conf) {
+		out, err := local.Output(ctx, "docker", "image", "inspect", "--format", "{{.Os}}/{{.Architecture}}", image)
+		platform := strings.TrimSpace(out)
+		if err != nil || !strings.Contains(platform, "/") {
+			continue
+		}
+		if !samePlatform(platform, target) {
+			warnings = append(warnings, fmt.Sprintf("イメージ %s は %s 向けですが、リモートサーバーは %s です（[docker] platform を確認してください）", image, platform, target))
+		}
+	}
+	return warnings
+}
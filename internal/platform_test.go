@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestResolvePlatform(t *testing.T) {
+	t.Run("ローカルと異なるアーキテクチャ", func(t *testing.T) {
+		conf := newTestConfig()
+		local := &fakeLocal{}
+		local.on("docker version", "linux/amd64\n", nil)
+		remote := &fakeRemote{}
+		remote.on("uname -m", "aarch64\n", nil)
+
+		target, err := ResolvePlatform(context.Background(), &conf, local, remote)
+		if err != nil {
+			t.Fatalf("ResolvePlatform() error = %v", err)
+		}
+		if target != "linux/arm64" || conf.Docker.Platform != "linux/arm64" {
+			t.Errorf("target = %s, platform = %s", target, conf.Docker.Platform)
+		}
+	})
+
+	t.Run("ローカルと同じアーキテクチャ", func(t *testing.T) {
+		conf := newTestConfig()
+		local := &fakeLocal{}
+		local.on("docker version", "linux/arm64\n", nil)
+		remote := &fakeRemote{}
+		remote.on("uname -m", "arm64\n", nil)
+
+		if _, err := ResolvePlatform(context.Background(), &conf, local, remote); err != nil {
+			t.Fatalf("ResolvePlatform() error = %v", err)
+		}
+		if conf.Docker.Platform != "" {
+			t.Errorf("同じアーキテクチャで platform が設定されています: %s", conf.Docker.Platform)
+		}
+	})
+
+	t.Run("platform を明示した場合は上書きしない", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Docker.Platform = "linux/amd64"
+		local := &fakeLocal{}
+		remote := &fakeRemote{}
+		remote.on("uname -m", "x86_64\n", nil)
+
+		if _, err := ResolvePlatform(context.Background(), &conf, local, remote); err != nil {
+			t.Fatalf("ResolvePlatform() error = %v", err)
+		}
+		if conf.Docker.Platform != "linux/amd64" || len(local.commands) != 0 {
+			t.Errorf("platform = %s, commands = %v", conf.Docker.Platform, local.commands)
+		}
+	})
+}
+
+func TestCheckImagePlatform(t *testing.T) {
+	conf := newTestComposeConfig()
+	conf.Compose.Services = []string{"web", "worker"}
+	local := &fakeLocal{}
+	local.on("docker image inspect --format {{.Os}}/{{.Architecture}} "+composeImageRef(conf, "web"), "linux/arm64\n", nil)
+	local.on("docker image inspect", "linux/amd64\n", nil)
+
+	warnings := CheckImagePlatform(context.Background(), conf, local, "linux/arm64/v8")
+	if len(warnings) != 1 || !strings.Contains(warnings[0], composeImageRef(conf, "worker")) {
+		t.Errorf("warnings = %v", warnings)
+	}
+}
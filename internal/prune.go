@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// PrunePlan は sailor prune で削除するリモートのイメージ・リリースディレクトリ・圧縮ファイル
+type PrunePlan struct {
+	Versions []string // 削除済みとして記録するバージョン（古い順）
+	Images   []string // 削除するイメージ参照
+	Releases []string // 削除するリリースディレクトリ（app_dir からの相対パス）
+	Tarball  string   // 削除する圧縮ファイルのパス（無ければ空）
+	Bytes    int64    // 解放される見込みのサイズ（他のイメージと共有するレイヤーを含むため目安）
+}
+
+// Empty は削除するものが無いかどうかを返す
+func (p PrunePlan) Empty() bool {
+	return len(p.Versions) == 0 && len(p.Images) == 0 && len(p.Releases) == 0 && p.Tarball == ""
+}
+
+// Print は削除対象を表示する
+func (p PrunePlan) Print() {
+	for _, image := range p.Images {
+		fmt.Println("  イメージ:", image)
+	}
+	for _, release := range p.Releases {
+		fmt.Println("  リリース:", release)
+	}
+	if p.Tarball != "" {
+		fmt.Println("  圧縮ファイル:", p.Tarball)
+	}
+	fmt.Printf("解放される容量の目安: %.1f MB\n", float64(p.Bytes)/1024/1024)
+}
+
+// PlanPrune は直近 keep 件の成功したデプロイ・現在のバージョン・pinned_versions 以外のリリースを削除対象として返す関数
+// イメージのサイズを確認するためにリモートのコマンドを実行するが、削除はしない
+func PlanPrune(ctx context.Context, conf config.Config, remote RemoteRunner, history config.History, current string, keep int) (PrunePlan, error) {
+	var plan PrunePlan
+
+	entries := make([]config.DeployHistoryEntry, 0, len(history))
+	for _, entry := range history {
+		entries = append(entries, entry)
+	}
+	// 新しい順に並べる
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Timestamp.Equal(entries[j].Timestamp) {
+			return entries[i].Timestamp.After(entries[j].Timestamp)
+		}
+		return entries[i].Version > entries[j].Version
+	})
+
+	pinned := make(map[string]bool)
+	for _, version := range conf.Deploy.PinnedVersions {
+		pinned[version] = true
+	}
+
+	var kept, pruned []config.DeployHistoryEntry
+	for _, entry := range entries {
+		switch {
+		case entry.Status != config.DeployStatusAborted && !entry.Pruned && keep > 0:
+			kept = append(kept, entry)
+			keep--
+		case entry.Version == current || pinned[entry.Version]:
+			kept = append(kept, entry)
+		case !entry.Pruned:
+			pruned = append(pruned, entry)
+		}
+	}
+
+	// 残すリリースと同じイメージ・ディレクトリは削除しない
+	keptImages := make(map[string]bool)
+	keptReleases := make(map[string]bool)
+	for _, entry := range kept {
+		for _, image := range historyImages(entry) {
+			keptImages[image] = true
+		}
+		keptReleases[entry.Release] = true
+	}
+
+	seen := make(map[string]bool)
+	for i := len(pruned) - 1; i >= 0; i-- {
+		entry := pruned[i]
+		plan.Versions = append(plan.Versions, entry.Version)
+		for _, image := range historyImages(entry) {
+			if keptImages[image] || seen[image] {
+				continue
+			}
+			seen[image] = true
+			// 既に削除されているイメージは対象にしない
+			out, err := remote.Output(ctx, fmt.Sprintf("docker image inspect --format {{.Size}} %s 2>/dev/null || true", image))
+			if err != nil {
+				return plan, fmt.Errorf("イメージ %s の確認に失敗: %w", image, err)
+			}
+			if strings.TrimSpace(out) == "" {
+				continue
+			}
+			size, _ := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+			plan.Images = append(plan.Images, image)
+			plan.Bytes += size
+		}
+		if conf.Remote.AppDir != "" && entry.Release != "" && !keptReleases[entry.Release] {
+			plan.Releases = append(plan.Releases, entry.Release)
+		}
+	}
+
+	// 圧縮ファイルはロード後は不要なため、残っていれば削除する
+	tarball := remoteArtifactPath(conf)
+	out, err := remote.Output(ctx, fmt.Sprintf("stat -c %%s %s 2>/dev/null || true", tarball))
+	if err != nil {
+		return plan, fmt.Errorf("圧縮ファイルの確認に失敗: %w", err)
+	}
+	if size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64); err == nil {
+		plan.Tarball = tarball
+		plan.Bytes += size
+	}
+	return plan, nil
+}
+
+// historyImages は履歴エントリでデプロイしたイメージ参照を返す
+func historyImages(entry config.DeployHistoryEntry) []string {
+	if entry.ComposeInfo.ServiceName == "" && len(entry.ComposeInfo.Services) == 0 {
+		if entry.Image == "" {
+			return nil
+		}
+		return []string{entry.Image}
+	}
+	images := entryComposeImages(entry)
+	refs := make([]string, 0, len(images))
+	for _, image := range images {
+		refs = append(refs, image)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// containsAny は items のいずれかが set に含まれるかどうかを返す
+func containsAny(set map[string]bool, items []string) bool {
+	for _, item := range items {
+		if set[item] {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecutePrune は PlanPrune で作成した削除対象を削除し、履歴に削除済みとして記録する関数
+// 個々の削除の失敗は警告として表示し、処理を続ける
+func ExecutePrune(ctx context.Context, conf config.Config, remote RemoteRunner, plan PrunePlan) error {
+	failed := make(map[string]bool)
+	for _, image := range plan.Images {
+		if err := remote.Run(ctx, "docker image rm "+image); err != nil {
+			fmt.Printf("警告: イメージ %s の削除に失敗しました（コンテナで使用中の可能性があります）: %v\n", image, err)
+			failed[image] = true
+		}
+	}
+	for _, release := range plan.Releases {
+		if err := remote.Run(ctx, fmt.Sprintf("rm -rf %s/%s", conf.Remote.AppDir, release)); err != nil {
+			fmt.Printf("警告: リリースディレクトリ %s の削除に失敗しました: %v\n", release, err)
+		}
+	}
+	if plan.Tarball != "" {
+		if err := remote.Run(ctx, "rm -f "+plan.Tarball); err != nil {
+			fmt.Printf("警告: %s の削除に失敗しました: %v\n", plan.Tarball, err)
+		}
+	}
+	if len(plan.Versions) == 0 {
+		return nil
+	}
+
+	// イメージを削除できたバージョンをロールバックできないバージョンとして履歴に記録する
+	local, err := config.LoadHistory(config.HistoryPath)
+	if err != nil {
+		return err
+	}
+	remoteHistory, current, remoteErr := FetchRemoteHistory(ctx, conf, remote)
+	history := config.MergeHistory(local, remoteHistory)
+	for _, version := range plan.Versions {
+		entry, ok := history[version]
+		if !ok || containsAny(failed, historyImages(entry)) {
+			continue
+		}
+		entry.Pruned = true
+		history[version] = entry
+	}
+	if err := config.SaveHistory(config.HistoryPath, history); err != nil {
+		return fmt.Errorf("ローカルのデプロイ履歴の保存に失敗: %w", err)
+	}
+	if remoteErr != nil {
+		return remoteErr
+	}
+	return pushRemoteHistory(ctx, conf, remote, history, current)
+}
+
+// PruneReleases はデプロイ履歴を読み込み、直近 keep 件より古いリリースを削除する関数
+// dryRun の場合は削除対象を返すだけで削除しない
+func PruneReleases(ctx context.Context, conf config.Config, remote RemoteRunner, keep int, dryRun bool) (PrunePlan, error) {
+	history, current, err := LoadDeployHistory(ctx, conf, remote)
+	if err != nil {
+		return PrunePlan{}, err
+	}
+	plan, err := PlanPrune(ctx, conf, remote, history, current, keep)
+	if err != nil || dryRun || plan.Empty() {
+		return plan, err
+	}
+	return plan, ExecutePrune(ctx, conf, remote, plan)
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// newPruneHistory は1分おきに6回デプロイした履歴を返す（1700000002 は中断）
+func newPruneHistory() config.History {
+	history := make(config.History)
+	base := time.Date(2023, 11, 14, 0, 0, 0, 0, time.UTC)
+	for i, version := range []string{"1700000000", "1700000001", "1700000002", "1700000003", "1700000004", "1700000005"} {
+		entry := config.DeployHistoryEntry{
+			Version:   version,
+			Status:    config.DeployStatusSuccess,
+			Image:     "myapp:v" + version,
+			Timestamp: base.Add(time.Duration(i) * time.Minute),
+		}
+		history[version] = entry
+	}
+	aborted := history["1700000002"]
+	aborted.Status = config.DeployStatusAborted
+	history["1700000002"] = aborted
+	return history
+}
+
+func TestPlanPrune(t *testing.T) {
+	t.Run("直近の成功したデプロイ・現在・ピン留めを残す", func(t *testing.T) {
+		conf := newTestConfig()
+		conf.Deploy.PinnedVersions = []string{"1700000000"}
+		remote := &fakeRemote{}
+		remote.on("docker image inspect", "1048576\n", nil)
+		remote.on("stat -c", "2097152\n", nil)
+
+		// 現在のバージョンは直近2件より古い 1700000001
+		plan, err := PlanPrune(context.Background(), conf, remote, newPruneHistory(), "1700000001", 2)
+		if err != nil {
+			t.Fatalf("PlanPrune() error = %v", err)
+		}
+		if want := []string{"1700000002", "1700000003"}; !reflect.DeepEqual(plan.Versions, want) {
+			t.Errorf("Versions = %v, want %v", plan.Versions, want)
+		}
+		if want := []string{"myapp:v1700000002", "myapp:v1700000003"}; !reflect.DeepEqual(plan.Images, want) {
+			t.Errorf("Images = %v, want %v", plan.Images, want)
+		}
+		if plan.Tarball != "~/tmp/myapp_container/deploy.tar.gz" || plan.Bytes != 4*1024*1024 {
+			t.Errorf("Tarball = %s, Bytes = %d", plan.Tarball, plan.Bytes)
+		}
+	})
+
+	t.Run("削除済みのイメージと圧縮ファイルは対象外", func(t *testing.T) {
+		history := newPruneHistory()
+		pruned := history["1700000000"]
+		pruned.Pruned = true
+		history["1700000000"] = pruned
+		remote := &fakeRemote{}
+		remote.on("docker image inspect --format {{.Size}} myapp:v1700000001", "", nil)
+		remote.on("docker image inspect", "100\n", nil)
+
+		plan, err := PlanPrune(context.Background(), newTestConfig(), remote, history, "1700000005", 3)
+		if err != nil {
+			t.Fatalf("PlanPrune() error = %v", err)
+		}
+		if want := []string{"1700000001", "1700000002"}; !reflect.DeepEqual(plan.Versions, want) {
+			t.Errorf("Versions = %v, want %v", plan.Versions, want)
+		}
+		if want := []string{"myapp:v1700000002"}; !reflect.DeepEqual(plan.Images, want) {
+			t.Errorf("Images = %v, want %v", plan.Images, want)
+		}
+		if plan.Tarball != "" {
+			t.Errorf("存在しない圧縮ファイルが対象になっています: %s", plan.Tarball)
+		}
+	})
+
+	t.Run("compose のリリースディレクトリ", func(t *testing.T) {
+		conf := newTestComposeConfig()
+		conf.Remote.AppDir = "~/apps/myapp"
+		history := make(config.History)
+		for i, version := range []string{"1700000000", "1700000001"} {
+			entry := config.DeployHistoryEntry{Version: version, Timestamp: time.Unix(int64(i), 0), Release: "releases/" + version}
+			entry.ComposeInfo.ServiceName = "web,worker"
+			entry.ComposeInfo.Services = map[string]config.ComposeServiceImage{
+				"web":    {Image: "myapp-web:" + version},
+				"worker": {Image: "myapp-worker:" + version},
+			}
+			history[version] = entry
+		}
+		remote := &fakeRemote{}
+		remote.on("docker image inspect", "1\n", nil)
+
+		plan, err := PlanPrune(context.Background(), conf, remote, history, "1700000001", 1)
+		if err != nil {
+			t.Fatalf("PlanPrune() error = %v", err)
+		}
+		if want := []string{"myapp-web:1700000000", "myapp-worker:1700000000"}; !reflect.DeepEqual(plan.Images, want) {
+			t.Errorf("Images = %v, want %v", plan.Images, want)
+		}
+		if want := []string{"releases/1700000000"}; !reflect.DeepEqual(plan.Releases, want) {
+			t.Errorf("Releases = %v, want %v", plan.Releases, want)
+		}
+	})
+}
+
+func TestExecutePrune(t *testing.T) {
+	chdirWithHistory(t, newPruneHistory())
+	remote := &fakeRemote{}
+	remote.on("docker image rm myapp:v1700000001", "", errors.New("image is being used by stopped container"))
+	plan := PrunePlan{
+		Versions: []string{"1700000000", "1700000001"},
+		Images:   []string{"myapp:v1700000000", "myapp:v1700000001"},
+		Tarball:  "~/tmp/myapp_container/deploy.tar.gz",
+	}
+	if err := ExecutePrune(context.Background(), newTestConfig(), remote, plan); err != nil {
+		t.Fatalf("ExecutePrune() error = %v", err)
+	}
+	assertCommands(t, remote.commands[:3], []string{
+		"docker image rm myapp:v1700000000",
+		"docker image rm myapp:v1700000001",
+		"rm -f ~/tmp/myapp_container/deploy.tar.gz",
+	})
+
+	history, err := config.LoadHistory(config.HistoryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !history["1700000000"].Pruned {
+		t.Error("イメージを削除したバージョンが削除済みとして記録されていません")
+	}
+	if history["1700000001"].Pruned {
+		t.Error("イメージの削除に失敗したバージョンが削除済みとして記録されています")
+	}
+
+	// 削除済みのバージョンにはロールバックできない
+	if err := RollbackToVersion(context.Background(), newTestConfig(), history, "1700000000", &fakeRemote{}); err == nil {
+		t.Error("削除済みのバージョンへのロールバックでエラーが返されていません")
+	}
+}
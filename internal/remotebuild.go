@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// ビルドする場所 ([deploy] build)
+const (
+	BuildLocal  = "local"  // ローカルでビルドしてイメージを転送する（デフォルト）
+	BuildRemote = "remote" // ソースを転送してリモートサーバーでビルドする
+)
+
+// sourceArchive は build = "remote" で転送するソースの圧縮ファイル名
+const sourceArchive = "source.tar.gz"
+
+// RemoteBuild はリモートサーバーでビルドするかどうかを返す
+func RemoteBuild(conf config.Config) bool {
+	return conf.Deploy.Build == BuildRemote
+}
+
+// ValidateBuildMode は [deploy] build の値を確認する関数
+func ValidateBuildMode(conf config.Config) error {
+	switch conf.Deploy.Build {
+	case "", BuildLocal, BuildRemote:
+		return nil
+	}
+	return fmt.Errorf("[deploy] build の値が不正です: %q（local または remote を指定してください）", conf.Deploy.Build)
+}
+
+// remoteSourceDir はリモートでソースを展開するディレクトリを返す
+func remoteSourceDir(conf config.Config) string {
+	return conf.Deploy.RemoteTempDir + "/" + ProjectName(conf) + "-src"
+}
+
+// remoteSourceArchive はリモートに転送するソースの圧縮ファイルのパスを返す
+func remoteSourceArchive(conf config.Config) string {
+	return conf.Deploy.RemoteTempDir + "/" + ProjectName(conf) + "-" + sourceArchive
+}
+
+// remoteDirRunner はリモートの指定ディレクトリでコマンドを実行する LocalRunner
+// ローカル向けのビルド・タグ付けの処理をそのままリモートで実行するために使う
+type remoteDirRunner struct {
+	remote RemoteRunner
+	dir    string
+}
+
+func (r remoteDirRunner) command(name string, args []string) string {
+	words := []string{name}
+	for _, arg := range args {
+		words = append(words, shellArg(arg))
+	}
+	if r.dir == "" {
+		return strings.Join(words, " ")
+	}
+	return "cd " + shellArg(r.dir) + " && " + strings.Join(words, " ")
+}
+
+func (r remoteDirRunner) Run(ctx context.Context, name string, args ...string) error {
+	return r.remote.Run(ctx, r.command(name, args))
+}
+
+func (r remoteDirRunner) Output(ctx context.Context, name string, args ...string) (string, error) {
+	return r.remote.Output(ctx, r.command(name, args))
+}
+
+// BuildRunner はビルドしたイメージがある環境でコマンドを実行する LocalRunner を返す
+// build = "remote" の場合はリモートサーバー、それ以外はローカル
+func BuildRunner(conf config.Config, local LocalRunner, remote RemoteRunner) LocalRunner {
+	if RemoteBuild(conf) {
+		return remoteDirRunner{remote: remote}
+	}
+	return local
+}
+
+// gitPrefix はカレントディレクトリのリポジトリルートからの相対パスを返す
+func gitPrefix(ctx context.Context, local LocalRunner) string {
+	out, err := local.Output(ctx, "git", "rev-parse", "--show-prefix")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimSpace(out), "/")
+}
+
+// BuildRemoteImage は HEAD のソースを git archive で転送し、リモートサーバーでイメージをビルドする関数
+// ビルドの出力はそのまま表示する。ビルド後は展開したソースと圧縮ファイルを削除する
+// タグとラベルは事前に ResolveImageTag で決定しておく
+func BuildRemoteImage(ctx context.Context, conf config.Config, local LocalRunner, remote RemoteRunner) error {
+	fmt.Println("リモートサーバーでDockerイメージをビルド中...")
+
+	// コミット済みのソースだけを転送する
+	if err := prepareArtifactDir(); err != nil {
+		return err
+	}
+	archive := filepath.Join(ArtifactDir, sourceArchive)
+	if err := local.Run(ctx, "git", "archive", "--format=tar.gz", "-o", archive, "HEAD"); err != nil {
+		return fmt.Errorf("ソースの圧縮に失敗: %w", err)
+	}
+	remoteArchive := remoteSourceArchive(conf)
+	if err := remote.Run(ctx, "mkdir -p "+shellArg(conf.Deploy.RemoteTempDir)); err != nil {
+		return fmt.Errorf("リモートディレクトリの作成に失敗: %w", err)
+	}
+	if err := remote.Transfer(ctx, archive, remoteArchive); err != nil {
+		return fmt.Errorf("ソースの転送に失敗: %w", err)
+	}
+
+	src := remoteSourceDir(conf)
+	extractCmd := fmt.Sprintf("rm -rf %s && mkdir -p %s && tar -xzf %s -C %s", shellArg(src), shellArg(src), shellArg(remoteArchive), shellArg(src))
+	if err := remote.Run(ctx, extractCmd); err != nil {
+		return fmt.Errorf("ソースの展開に失敗: %w", err)
+	}
+	defer removeRemoteSource(conf, remote)
+
+	// サブディレクトリから実行した場合は同じディレクトリでビルドする
+	dir := src
+	if prefix := gitPrefix(ctx, QueryRunner(local)); prefix != "" {
+		dir += "/" + prefix
+	}
+	runner := remoteDirRunner{remote: remote, dir: dir}
+
+	if conf.Docker.UseCompose {
+		// 環境変数ファイルはコミットされていないことが多いため個別に転送する（存在しないファイルは転送しない）
+		envFiles := conf.Compose.EnvFiles
+		if conf.Docker.ComposeEnvFile != "" {
+			envFiles = appendMissing(append([]string(nil), envFiles...), conf.Docker.ComposeEnvFile)
+		}
+		for _, envFile := range envFiles {
+			if _, err := os.Stat(envFile); os.IsNotExist(err) {
+				fmt.Printf("警告: 環境変数ファイル %s が存在しないため転送しません\n", envFile)
+				continue
+			}
+			if err := remote.Transfer(ctx, envFile, dir+"/"+envFile); err != nil {
+				return fmt.Errorf("環境変数ファイル %s の転送に失敗: %w", envFile, err)
+			}
+		}
+
+		// リモートの compose コマンドでビルドし、デプロイ用のタグを付ける
+		buildConf := conf
+		buildConf.Docker.ComposeCommand = remoteComposeCommand(conf)
+		args, err := composeBuildArgs(buildConf)
+		if err != nil {
+			return err
+		}
+		var files []string
+		if len(conf.Docker.Labels) > 0 {
+			writeCmd := fmt.Sprintf("cd %s && printf '%%s' %s > %s", shellArg(dir), shellQuote(renderComposeBuildLabels(composeServices(conf), conf.Docker.Labels)), composeLabelsFile)
+			if err := remote.Run(ctx, writeCmd); err != nil {
+				return fmt.Errorf("%s の作成に失敗: %w", composeLabelsFile, err)
+			}
+			files = append(files, composeLabelsFile)
+		}
+		name, args := composeCommandArgs(buildConf, files, args...)
+		if err := runner.Run(ctx, name, args...); err != nil {
+			return fmt.Errorf("Docker Composeのビルドに失敗: %w", err)
+		}
+		if err := TagComposeImages(ctx, buildConf, runner); err != nil {
+			return err
+		}
+	} else {
+		args, err := dockerBuildArgs(conf, fmt.Sprintf("%s:%s", conf.Docker.ImageName, conf.Docker.Tag))
+		if err != nil {
+			return err
+		}
+		if err := runner.Run(ctx, "docker", args...); err != nil {
+			return fmt.Errorf("ビルドに失敗: %w", err)
+		}
+	}
+
+	fmt.Printf("Dockerイメージをビルドしました（タグ: %s）\n", conf.Docker.Tag)
+	return nil
+}
+
+// removeRemoteSource はリモートに展開したソースと圧縮ファイルを削除する
+func removeRemoteSource(conf config.Config, remote RemoteRunner) {
+	cleanupCtx, cancel := NewCleanupContext()
+	defer cancel()
+	if err := remote.Run(cleanupCtx, fmt.Sprintf("rm -rf %s %s", shellArg(remoteSourceDir(conf)), shellArg(remoteSourceArchive(conf)))); err != nil {
+		fmt.Printf("警告: リモートのソースの削除に失敗しました: %v\n", err)
+	}
+}
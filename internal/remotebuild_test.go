@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// writeEnvFiles はカレントディレクトリに環境変数ファイルを作成する
+func writeEnvFiles(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := os.WriteFile(name, []byte("A=1\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuildRemoteImage(t *testing.T) {
+	t.Run("Dockerfile", func(t *testing.T) {
+		chdirWithFiles(t, nil)
+		conf := newTestConfig()
+		conf.Deploy.Build = BuildRemote
+		conf.Docker.BuildArgs = map[string]string{"APP_VERSION": "${SAILOR_TAG}"}
+		local := &fakeLocal{}
+		remote := &fakeRemote{}
+		if err := BuildRemoteImage(context.Background(), conf, local, remote); err != nil {
+			t.Fatalf("BuildRemoteImage() error = %v", err)
+		}
+		assertCommands(t, local.commands, []string{
+			"git archive --format=tar.gz -o .sailor/source.tar.gz HEAD",
+			"git rev-parse --show-prefix",
+		})
+		src := "~/tmp/myapp_container-src"
+		assertCommands(t, remote.commands, []string{
+			"mkdir -p ~/tmp",
+			"transfer .sailor/source.tar.gz -> ~/tmp/myapp_container-source.tar.gz",
+			"rm -rf " + src + " && mkdir -p " + src + " && tar -xzf ~/tmp/myapp_container-source.tar.gz -C " + src,
+			"cd " + src + " && docker build -t myapp:" + conf.Docker.Tag + " --build-arg APP_VERSION=" + conf.Docker.Tag + " ./",
+			"rm -rf " + src + " ~/tmp/myapp_container-source.tar.gz",
+		})
+	})
+
+	t.Run("Docker Compose", func(t *testing.T) {
+		chdirComposeProject(t)
+		writeEnvFiles(t, ".env", ".env.prod")
+		conf := newTestComposeConfig()
+		conf.Deploy.Build = BuildRemote
+		conf.Docker.ComposeCommand = "docker compose"
+		conf.Remote.ComposeCommand = "docker-compose"
+		remote := &fakeRemote{}
+		if err := BuildRemoteImage(context.Background(), conf, &fakeLocal{}, remote); err != nil {
+			t.Fatalf("BuildRemoteImage() error = %v", err)
+		}
+		src := "~/tmp/myapp-src"
+		assertCommands(t, remote.commands[3:], []string{
+			"transfer .env -> " + src + "/.env",
+			"transfer .env.prod -> " + src + "/.env.prod",
+			"cd " + src + " && docker-compose -p myapp -f docker-compose.yml --env-file .env --profile production build web",
+			"cd " + src + " && docker-compose version --short",
+			"cd " + src + " && docker tag myapp-web:latest myapp-web:" + conf.Docker.Tag,
+			"rm -rf " + src + " ~/tmp/myapp-source.tar.gz",
+		})
+	})
+
+	t.Run("存在しない環境変数ファイルは転送しない", func(t *testing.T) {
+		chdirComposeProject(t)
+		writeEnvFiles(t, ".env")
+		conf := newTestComposeConfig()
+		conf.Deploy.Build = BuildRemote
+		remote := &fakeRemote{}
+		if err := BuildRemoteImage(context.Background(), conf, &fakeLocal{}, remote); err != nil {
+			t.Fatalf("BuildRemoteImage() error = %v", err)
+		}
+		for _, command := range remote.commands {
+			if strings.HasPrefix(command, "transfer .env.prod") {
+				t.Errorf("存在しないファイルを転送しています: %s", command)
+			}
+		}
+	})
+
+	t.Run("ディレクトリの引用", func(t *testing.T) {
+		chdirComposeProject(t)
+		conf := newTestComposeConfig()
+		conf.Deploy.Build = BuildRemote
+		conf.Deploy.RemoteTempDir = "/srv/deploy tmp"
+		conf.Docker.Labels = map[string]string{"team": "web"}
+		remote := &fakeRemote{}
+		if err := BuildRemoteImage(context.Background(), conf, &fakeLocal{}, remote); err != nil {
+			t.Fatalf("BuildRemoteImage() error = %v", err)
+		}
+		for _, command := range remote.commands {
+			if strings.HasPrefix(command, "cd ") && !strings.HasPrefix(command, "cd '/srv/deploy tmp/myapp-src' && ") {
+				t.Errorf("ディレクトリが引用されていません: %s", command)
+			}
+		}
+		if last := remote.commands[len(remote.commands)-1]; last != "rm -rf '/srv/deploy tmp/myapp-src' '/srv/deploy tmp/myapp-source.tar.gz'" {
+			t.Errorf("削除するパスが引用されていません: %s", last)
+		}
+	})
+
+	t.Run("サブディレクトリ", func(t *testing.T) {
+		chdirWithFiles(t, nil)
+		conf := newTestConfig()
+		conf.Deploy.Build = BuildRemote
+		local := &fakeLocal{}
+		local.on("git rev-parse --show-prefix", "services/api/\n", nil)
+		remote := &fakeRemote{}
+		if err := BuildRemoteImage(context.Background(), conf, local, remote); err != nil {
+			t.Fatalf("BuildRemoteImage() error = %v", err)
+		}
+		if build := remote.commands[3]; !strings.HasPrefix(build, "cd ~/tmp/myapp_container-src/services/api && docker build") {
+			t.Errorf("サブディレクトリでビルドされていません: %s", build)
+		}
+	})
+
+	t.Run("ビルド失敗時もソースを削除", func(t *testing.T) {
+		chdirWithFiles(t, nil)
+		conf := newTestConfig()
+		conf.Deploy.Build = BuildRemote
+		remote := &fakeRemote{}
+		remote.on("cd ~/tmp/myapp_container-src && docker build", "", errors.New("build failed"))
+		if err := BuildRemoteImage(context.Background(), conf, &fakeLocal{}, remote); err == nil {
+			t.Fatal("ビルドの失敗でエラーが返されていません")
+		}
+		if last := remote.commands[len(remote.commands)-1]; last != "rm -rf ~/tmp/myapp_container-src ~/tmp/myapp_container-source.tar.gz" {
+			t.Errorf("ソースが削除されていません: %s", last)
+		}
+	})
+}
+
+func TestRunRemoteContainerRemoteBuild(t *testing.T) {
+	conf := newTestConfig()
+	conf.Deploy.Build = BuildRemote
+	remote := &fakeRemote{}
+	if err := RunRemoteContainer(context.Background(), conf, remote); err != nil {
+		t.Fatalf("RunRemoteContainer() error = %v", err)
+	}
+	for _, command := range remote.commands {
+		if command == "cd ~/tmp && docker load < deploy.tar.gz" {
+			t.Error("リモートでビルドしたのにイメージをロードしています")
+		}
+	}
+	if err := TransferDockerImage(context.Background(), conf, remote); err != nil {
+		t.Fatalf("TransferDockerImage() error = %v", err)
+	}
+	if last := remote.commands[len(remote.commands)-1]; last == "transfer .sailor/deploy.tar.gz -> ~/tmp/deploy.tar.gz" {
+		t.Error("リモートでビルドしたのにイメージを転送しています")
+	}
+}
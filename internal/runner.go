@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// LocalRunner はローカルでのコマンド実行を抽象化するインターフェース
+type LocalRunner interface {
+	// Run はコマンドを実行し、出力を標準出力・標準エラーにそのまま流す
+	Run(ctx context.Context, name string, args ...string) error
+	// Output はコマンドを実行し、標準出力の内容を返す
+	Output(ctx context.Context, name string, args ...string) (string, error)
+}
+
+// RemoteRunner はリモートサーバーでのコマンド実行とファイル転送を抽象化するインターフェース
+// コンテキストがキャンセルされると実行中の SSH セッションは中断される
+type RemoteRunner interface {
+	// Run はリモートでコマンドを実行し、出力を標準出力・標準エラーにそのまま流す
+	Run(ctx context.Context, command string) error
+	// Output はリモートでコマンドを実行し、その出力を返す
+	Output(ctx context.Context, command string) (string, error)
+	// Transfer はローカルファイルをリモートの指定パスへ転送する
+	Transfer(ctx context.Context, localPath, remotePath string) error
+}
+
+// execRunner は os/exec でローカルコマンドを実行する LocalRunner
+type execRunner struct{}
+
+// NewLocalRunner はローカルで実際にコマンドを実行する LocalRunner を返す
+func NewLocalRunner() LocalRunner {
+	return execRunner{}
+}
+
+func (execRunner) Run(ctx context.Context, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (execRunner) Output(ctx context.Context, name string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// sshRunner は SSH 経由でリモートコマンドを実行する RemoteRunner
+type sshRunner struct {
+	conf config.Config
+}
+
+// NewRemoteRunner は SSH 経由で実際にコマンドを実行する RemoteRunner を返す
+func NewRemoteRunner(conf config.Config) RemoteRunner {
+	return sshRunner{conf: conf}
+}
+
+func (r sshRunner) Run(ctx context.Context, command string) error {
+	return ExecuteRemoteCommand(ctx, r.conf, command)
+}
+
+func (r sshRunner) Output(ctx context.Context, command string) (string, error) {
+	return executeRemoteCommandWithOutput(ctx, r.conf, command)
+}
+
+func (r sshRunner) Transfer(ctx context.Context, localPath, remotePath string) error {
+	return TransferFile(ctx, r.conf, localPath, remotePath)
+}
+
+// DryRunRecorder は実行予定のコマンドを表示・記録するだけで、実際には何も実行しない
+type DryRunRecorder struct {
+	Commands []string // 記録したコマンド（"local: ..." / "remote: ..." / "transfer: ..." 形式）
+}
+
+// NewDryRunRecorder は新しい DryRunRecorder を作成する
+func NewDryRunRecorder() *DryRunRecorder {
+	return &DryRunRecorder{}
+}
+
+// Local は記録用の LocalRunner を返す
+func (r *DryRunRecorder) Local() LocalRunner {
+	return dryRunLocal{r}
+}
+
+// Remote は記録用の RemoteRunner を返す
+func (r *DryRunRecorder) Remote() RemoteRunner {
+	return dryRunRemote{r}
+}
+
+// record はコマンドを記録して表示する
+func (r *DryRunRecorder) record(kind, command string) {
+	entry := fmt.Sprintf("%s: %s", kind, command)
+	r.Commands = append(r.Commands, entry)
+	fmt.Println("[dry-run]", entry)
+}
+
+// QueryRunner は git rev-parse などの読み取り専用の問い合わせに使う LocalRunner を返す
+// dry-run でも実際のタグ・プロジェクト名・コマンドを表示できるよう、記録用の LocalRunner の代わりに実際に実行する
+func QueryRunner(local LocalRunner) LocalRunner {
+	if _, ok := local.(dryRunLocal); ok {
+		return NewLocalRunner()
+	}
+	return local
+}
+
+type dryRunLocal struct{ r *DryRunRecorder }
+
+func (d dryRunLocal) Run(ctx context.Context, name string, args ...string) error {
+	d.r.record("local", strings.Join(append([]string{name}, args...), " "))
+	return nil
+}
+
+// Output は出力を伴うコマンドの結果を空でない値として扱い、条件付きのコマンドも表示されるようにする
+func (d dryRunLocal) Output(ctx context.Context, name string, args ...string) (string, error) {
+	d.r.record("local", strings.Join(append([]string{name}, args...), " "))
+	return "<dry-run>", nil
+}
+
+type dryRunRemote struct{ r *DryRunRecorder }
+
+func (d dryRunRemote) Run(ctx context.Context, command string) error {
+	d.r.record("remote", command)
+	return nil
+}
+
+func (d dryRunRemote) Output(ctx context.Context, command string) (string, error) {
+	d.r.record("remote", command)
+	return "<dry-run>", nil
+}
+
+func (d dryRunRemote) Transfer(ctx context.Context, localPath, remotePath string) error {
+	d.r.record("transfer", localPath+" -> "+remotePath)
+	return nil
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// fakeResponse はコマンドの前方一致でスクリプト化した応答
+type fakeResponse struct {
+	prefix string
+	output string
+	err    error
+}
+
+// fakeScript は記録したコマンドに対してスクリプト化した応答を返す
+type fakeScript struct {
+	commands  []string
+	responses []fakeResponse
+}
+
+// on は prefix で始まるコマンドに対する応答を登録する
+func (s *fakeScript) on(prefix, output string, err error) {
+	s.responses = append(s.responses, fakeResponse{prefix: prefix, output: output, err: err})
+}
+
+// respond はコマンドを記録し、最初に一致した応答を返す
+func (s *fakeScript) respond(command string) (string, error) {
+	s.commands = append(s.commands, command)
+	for _, r := range s.responses {
+		if strings.HasPrefix(command, r.prefix) {
+			return r.output, r.err
+		}
+	}
+	return "", nil
+}
+
+// fakeLocal はテスト用の LocalRunner
+type fakeLocal struct {
+	fakeScript
+}
+
+func (f *fakeLocal) Run(ctx context.Context, name string, args ...string) error {
+	_, err := f.respond(strings.Join(append([]string{name}, args...), " "))
+	return err
+}
+
+func (f *fakeLocal) Output(ctx context.Context, name string, args ...string) (string, error) {
+	return f.respond(strings.Join(append([]string{name}, args...), " "))
+}
+
+// fakeRemote はテスト用の RemoteRunner。転送は "transfer local -> remote" として記録する
+type fakeRemote struct {
+	fakeScript
+}
+
+func (f *fakeRemote) Run(ctx context.Context, command string) error {
+	_, err := f.respond(command)
+	return err
+}
+
+func (f *fakeRemote) Output(ctx context.Context, command string) (string, error) {
+	return f.respond(command)
+}
+
+func (f *fakeRemote) Transfer(ctx context.Context, localPath, remotePath string) error {
+	_, err := f.respond(fmt.Sprintf("transfer %s -> %s", localPath, remotePath))
+	return err
+}
@@ -3,69 +3,169 @@ package internal
 import (
 "bufio"
 "bytes"
+"context"
 "fmt"
 "io"
+"net"
 "os"
 "path/filepath"
+"strings"
+"sync"
 "time"
 
 	"github.com/linkalls/sailor/config"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // getSSHConfig はSSH接続の設定を生成する関数
-func getSSHConfig(conf config.Config) (*ssh.ClientConfig, error) {
+// エージェント認証では ssh-agent への接続を開くため、返される関数で接続を閉じる
+func getSSHConfig(conf config.Config) (*ssh.ClientConfig, func(), error) {
 	var authMethods []ssh.AuthMethod
+	closeAgent := func() {}
 
-	if conf.SSH.Password != "" {
+	switch resolveAuthMethod(conf) {
+	case "password":
 		// パスワード認証を利用
 		authMethods = append(authMethods, ssh.Password(conf.SSH.Password))
-	} else if conf.SSH.PrivateKeyPath != "" {
+	case "key":
 		// 鍵認証を利用
-		key, err := os.ReadFile(conf.SSH.PrivateKeyPath)
+		key, err := os.ReadFile(expandHome(conf.SSH.PrivateKeyPath))
 		if err != nil {
-			return nil, fmt.Errorf("SSHキーの読み込みに失敗: %w", err)
+			return nil, nil, fmt.Errorf("SSHキーの読み込みに失敗: %w", err)
 		}
 		signer, err := ssh.ParsePrivateKey(key)
 		if err != nil {
-			return nil, fmt.Errorf("SSHキーの解析に失敗: %w", err)
+			return nil, nil, fmt.Errorf("SSHキーの解析に失敗: %w", err)
 		}
 		authMethods = append(authMethods, ssh.PublicKeys(signer))
-	} else {
-		return nil, fmt.Errorf("SSH認証情報が設定されていません")
+	case "agent":
+		// ssh-agent に登録された鍵を利用
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, nil, fmt.Errorf("SSH_AUTH_SOCK が設定されていません。ssh-agent を起動してください")
+		}
+		agentConn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ssh-agentへの接続に失敗: %w", err)
+		}
+		closeAgent = func() { agentConn.Close() }
+		authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	case "":
+		return nil, nil, fmt.Errorf("SSH認証情報が設定されていません")
+	default:
+		return nil, nil, fmt.Errorf("不明な認証方式です: %s", conf.SSH.AuthMethod)
 	}
 
 	// SSH設定を生成
 	config := &ssh.ClientConfig{
-		User:            conf.SSH.User,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.FixedHostKey(nil), // デフォルトではnil、後で上書き
-		Timeout:         10 * time.Minute,      // タイムアウトを10分に延長
+		User:    conf.SSH.User,
+		Auth:    authMethods,
+		Timeout: 10 * time.Minute, // タイムアウトを10分に延長
 	}
 
-	// パスワード認証の場合は、既知のホストキーを使用
-	if conf.SSH.Password != "" {
+	// パスワード認証の場合は従来通りホストキーを検証しない
+	if resolveAuthMethod(conf) == "password" {
 		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return config, closeAgent, nil
+	}
+
+	// 鍵認証・エージェント認証では known_hosts でホストキーを検証
+	knownHostsPath := conf.SSH.KnownHostsPath
+	if knownHostsPath == "" {
+		knownHostsPath = "~/.ssh/known_hosts"
+	}
+	hostKeyCallback, err := knownhosts.New(expandHome(knownHostsPath))
+	if err != nil {
+		closeAgent()
+		return nil, nil, fmt.Errorf("known_hostsの読み込みに失敗: %w", err)
+	}
+	config.HostKeyCallback = hostKeyCallback
+
+	return config, closeAgent, nil
+}
+
+// resolveAuthMethod は設定から使用する認証方式を決定する関数
+func resolveAuthMethod(conf config.Config) string {
+	if conf.SSH.AuthMethod != "" {
+		return conf.SSH.AuthMethod
+	}
+	if conf.SSH.Password != "" {
+		return "password"
+	}
+	if conf.SSH.PrivateKeyPath != "" {
+		return "key"
+	}
+	return ""
+}
+
+// expandHome はパス先頭の "~" をホームディレクトリに展開する関数
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
+
+// dialSSH は SSH 接続を確立する関数
+// コンテキストがキャンセルされると接続を閉じ、実行中のセッションを中断する。返される関数で接続を閉じる
+func dialSSH(ctx context.Context, conf config.Config) (*ssh.Client, func(), error) {
+	sshConfig, closeAgent, err := getSSHConfig(conf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SSH設定の取得に失敗: %w", err)
+	}
+
+	address := fmt.Sprintf("%s:%d", conf.SSH.Host, conf.SSH.Port)
+	dialer := net.Dialer{Timeout: sshConfig.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		closeAgent()
+		return nil, nil, fmt.Errorf("SSH接続に失敗: %w", err)
 	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, sshConfig)
+	if err != nil {
+		conn.Close()
+		closeAgent()
+		return nil, nil, fmt.Errorf("SSH接続に失敗: %w", err)
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	return client, func() {
+		stop()
+		client.Close()
+		closeAgent()
+	}, nil
+}
 
-	return config, nil
+// canceledError はコンテキストがキャンセルされていればその旨のエラーを、そうでなければ元のエラーを返す
+func canceledError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("処理が中断されました: %w", ctx.Err())
+	}
+	return err
 }
 
 // TransferFile は指定されたファイルをSSH経由で転送する関数
-func TransferFile(conf config.Config, localPath string, remotePath string) error {
-    // SSH設定の取得
-    sshConfig, err := getSSHConfig(conf)
-    if err != nil {
-        return fmt.Errorf("SSH設定の取得に失敗: %w", err)
-    }
+func TransferFile(ctx context.Context, conf config.Config, localPath string, remotePath string) (err error) {
+    // 中断された場合は途中までのエラーではなく中断として報告する
+    defer func() {
+        if err != nil {
+            err = canceledError(ctx, err)
+        }
+    }()
 
     // SSHクライアントの作成
-    address := fmt.Sprintf("%s:%d", conf.SSH.Host, conf.SSH.Port)
-    client, err := ssh.Dial("tcp", address, sshConfig)
+    client, closeClient, err := dialSSH(ctx, conf)
     if err != nil {
-        return fmt.Errorf("SSH接続に失敗: %w", err)
+        return err
     }
-    defer client.Close()
+    defer closeClient()
 
     // セッションの作成
     session, err := client.NewSession()
@@ -110,7 +210,8 @@ func TransferFile(conf config.Config, localPath string, remotePath string) error
     r := bufio.NewReader(stdout)
 
     // エラー出力の取得用に設定
-    var stderrBuf bytes.Buffer
+    // (セッションが書き込み中でもエラーメッセージを参照できるよう排他制御付きのバッファを使う)
+    var stderrBuf syncBuffer
     session.Stderr = &stderrBuf
 
     // SCPコマンドの実行（絶対パスを使用）
@@ -152,6 +253,10 @@ func TransferFile(conf config.Config, localPath string, remotePath string) error
     fmt.Printf("\n%s の転送を開始します\n", description)
 
     for {
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+
         n, err := localFile.Read(buffer)
         if err == io.EOF {
             break
@@ -223,20 +328,13 @@ func TransferFile(conf config.Config, localPath string, remotePath string) error
 }
 
 // ExecuteRemoteCommand は SSH を利用してリモートサーバー上でコマンドを実行する関数
-func ExecuteRemoteCommand(conf config.Config, command string) error {
-	// SSH設定の取得
-	sshConfig, err := getSSHConfig(conf)
-	if err != nil {
-		return fmt.Errorf("SSH設定の取得に失敗: %w", err)
-	}
-
+func ExecuteRemoteCommand(ctx context.Context, conf config.Config, command string) error {
 	// SSHクライアントの作成
-	address := fmt.Sprintf("%s:%d", conf.SSH.Host, conf.SSH.Port)
-	client, err := ssh.Dial("tcp", address, sshConfig)
+	client, closeClient, err := dialSSH(ctx, conf)
 	if err != nil {
-		return fmt.Errorf("SSH接続に失敗: %w", err)
+		return err
 	}
-	defer client.Close()
+	defer closeClient()
 
 	// セッションの作成と実行
 	session, err := client.NewSession()
@@ -249,7 +347,10 @@ func ExecuteRemoteCommand(conf config.Config, command string) error {
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
 
-	return session.Run(command)
+	if err := session.Run(command); err != nil {
+		return canceledError(ctx, err)
+	}
+	return nil
 }
 
 // executeCommand は SSH クライアントを使用してコマンドを実行するヘルパー関数
@@ -267,6 +368,27 @@ func executeCommand(client *ssh.Client, command string) error {
 	return session.Run(command)
 }
 
+// syncBuffer は複数のゴルーチンから安全に書き込み・参照できるバッファ
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// ackRetryInterval はACK確認をリトライする際の待機時間の単位（テストでは短縮する）
+var ackRetryInterval = time.Second
+
 // retryAck はACK確認を複数回試行する関数
 func retryAck(r *bufio.Reader, phase string) error {
 	var lastErr error
@@ -275,7 +397,7 @@ func retryAck(r *bufio.Reader, phase string) error {
 			return nil
 		} else {
 			lastErr = err
-			time.Sleep(time.Second * time.Duration(retry+1))
+			time.Sleep(ackRetryInterval * time.Duration(retry+1))
 		}
 	}
 	return fmt.Errorf("%sに失敗: %w", phase, lastErr)
@@ -311,3 +433,13 @@ func checkAck(r io.Reader) error {
 		}
 	}
 }
+
+// CheckSSHConnection は SSH 接続と認証が成功するかを確認する関数
+func CheckSSHConnection(ctx context.Context, conf config.Config) error {
+	_, closeClient, err := dialSSH(ctx, conf)
+	if err != nil {
+		return err
+	}
+	closeClient()
+	return nil
+}
@@ -0,0 +1,441 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linkalls/sailor/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func init() {
+	// エラー系のテストでリトライ待機に時間がかからないようにする
+	ackRetryInterval = time.Millisecond
+}
+
+// newClientKey はクライアント用の鍵ペアを生成し、秘密鍵ファイルのパスと公開鍵を返す
+func newClientKey(t *testing.T) (string, ed25519.PrivateKey, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, priv, sshPub
+}
+
+// writeLocalFile は転送元となるローカルファイルを作成する
+func writeLocalFile(t *testing.T, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "deploy.tar.gz")
+	if err := os.WriteFile(path, content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGetSSHConfig(t *testing.T) {
+	keyPath, _, _ := newClientKey(t)
+
+	tests := []struct {
+		name    string
+		setup   func(conf *config.Config)
+		wantErr string
+	}{
+		{
+			name:  "パスワード認証",
+			setup: func(conf *config.Config) { conf.SSH.Password = "secret" },
+		},
+		{
+			name: "鍵認証",
+			setup: func(conf *config.Config) {
+				conf.SSH.PrivateKeyPath = keyPath
+				conf.SSH.KnownHostsPath = filepath.Join(t.TempDir(), "known_hosts")
+				os.WriteFile(conf.SSH.KnownHostsPath, nil, 0600)
+			},
+		},
+		{
+			name:    "認証情報なし",
+			setup:   func(conf *config.Config) {},
+			wantErr: "SSH認証情報が設定されていません",
+		},
+		{
+			name:    "不明な認証方式",
+			setup:   func(conf *config.Config) { conf.SSH.AuthMethod = "kerberos" },
+			wantErr: "不明な認証方式です",
+		},
+		{
+			name:    "秘密鍵が存在しない",
+			setup:   func(conf *config.Config) { conf.SSH.PrivateKeyPath = filepath.Join(t.TempDir(), "missing") },
+			wantErr: "SSHキーの読み込みに失敗",
+		},
+		{
+			name: "known_hostsが存在しない",
+			setup: func(conf *config.Config) {
+				conf.SSH.PrivateKeyPath = keyPath
+				conf.SSH.KnownHostsPath = filepath.Join(t.TempDir(), "missing")
+			},
+			wantErr: "known_hostsの読み込みに失敗",
+		},
+		{
+			name: "ssh-agent未起動",
+			setup: func(conf *config.Config) {
+				conf.SSH.AuthMethod = "agent"
+				t.Setenv("SSH_AUTH_SOCK", "")
+			},
+			wantErr: "SSH_AUTH_SOCK",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf config.Config
+			conf.SSH.User = "deploy"
+			tt.setup(&conf)
+
+			sshConfig, closeAgent, err := getSSHConfig(conf)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("getSSHConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getSSHConfig() error = %v", err)
+			}
+			defer closeAgent()
+			if len(sshConfig.Auth) != 1 {
+				t.Errorf("認証方式の数: want 1, got %d", len(sshConfig.Auth))
+			}
+			if sshConfig.HostKeyCallback == nil {
+				t.Error("HostKeyCallback が設定されていません")
+			}
+		})
+	}
+}
+
+func TestTransferFile(t *testing.T) {
+	content := bytes.Repeat([]byte("sailor"), 300000) // バッファサイズを超える大きさ
+
+	t.Run("パスワード認証", func(t *testing.T) {
+		server := newTestSSHServer(t)
+		if err := TransferFile(context.Background(), server.passwordConfig(), writeLocalFile(t, content), "/srv/app/deploy.tar.gz"); err != nil {
+			t.Fatalf("TransferFile() error = %v", err)
+		}
+		got, ok := server.file("/srv/app/deploy.tar.gz")
+		if !ok || !bytes.Equal(got, content) {
+			t.Errorf("転送されたファイルの内容が一致しません (%d バイト)", len(got))
+		}
+		if mode := server.mode("/srv/app/deploy.tar.gz"); mode != 0640 {
+			t.Errorf("ファイルモード: want 0640, got %04o", mode)
+		}
+		if cmds := server.executed(); len(cmds) != 2 || cmds[0] != "mkdir -p /srv/app && which scp" {
+			t.Errorf("実行されたコマンドが想定と異なります: %v", cmds)
+		}
+	})
+
+	t.Run("鍵認証とホストキー検証", func(t *testing.T) {
+		server := newTestSSHServer(t)
+		keyPath, _, pub := newClientKey(t)
+		server.authorize(pub)
+
+		var conf config.Config
+		conf.SSH.Host, conf.SSH.Port, conf.SSH.User = server.host, server.port, server.user
+		conf.SSH.PrivateKeyPath = keyPath
+		conf.SSH.KnownHostsPath = server.knownHostsFile(t)
+
+		if err := TransferFile(context.Background(), conf, writeLocalFile(t, []byte("hello")), "/srv/app/hello.txt"); err != nil {
+			t.Fatalf("TransferFile() error = %v", err)
+		}
+		if got, _ := server.file("/srv/app/hello.txt"); string(got) != "hello" {
+			t.Errorf("転送されたファイルの内容: want hello, got %q", got)
+		}
+	})
+
+	t.Run("ホストキー不一致", func(t *testing.T) {
+		server := newTestSSHServer(t)
+		other := newTestSSHServer(t)
+		keyPath, _, pub := newClientKey(t)
+		server.authorize(pub)
+
+		var conf config.Config
+		conf.SSH.Host, conf.SSH.Port, conf.SSH.User = server.host, server.port, server.user
+		conf.SSH.PrivateKeyPath = keyPath
+		// 別サーバーのホストキーを同じアドレスで登録する
+		other.host, other.port = server.host, server.port
+		conf.SSH.KnownHostsPath = other.knownHostsFile(t)
+
+		err := TransferFile(context.Background(), conf, writeLocalFile(t, []byte("hello")), "/srv/app/hello.txt")
+		if err == nil || !strings.Contains(err.Error(), "SSH接続に失敗") {
+			t.Errorf("ホストキー不一致でエラーになっていません: %v", err)
+		}
+	})
+
+	t.Run("エージェント認証", func(t *testing.T) {
+		server := newTestSSHServer(t)
+		_, priv, pub := newClientKey(t)
+		server.authorize(pub)
+
+		keyring := agent.NewKeyring()
+		if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+			t.Fatal(err)
+		}
+		socket := filepath.Join(t.TempDir(), "agent.sock")
+		listener, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		var served sync.WaitGroup
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				served.Add(1)
+				go func() {
+					defer served.Done()
+					agent.ServeAgent(keyring, conn)
+					conn.Close()
+				}()
+			}
+		}()
+		t.Setenv("SSH_AUTH_SOCK", socket)
+
+		var conf config.Config
+		conf.SSH.Host, conf.SSH.Port, conf.SSH.User = server.host, server.port, server.user
+		conf.SSH.AuthMethod = "agent"
+		conf.SSH.KnownHostsPath = server.knownHostsFile(t)
+
+		if err := TransferFile(context.Background(), conf, writeLocalFile(t, []byte("agent")), "/srv/app/agent.txt"); err != nil {
+			t.Fatalf("TransferFile() error = %v", err)
+		}
+
+		// 転送が終わったら ssh-agent への接続も閉じられている
+		done := make(chan struct{})
+		go func() {
+			served.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("ssh-agent への接続が閉じられていません")
+		}
+	})
+
+	t.Run("パスワード誤り", func(t *testing.T) {
+		server := newTestSSHServer(t)
+		conf := server.passwordConfig()
+		conf.SSH.Password = "wrong"
+		err := TransferFile(context.Background(), conf, writeLocalFile(t, []byte("x")), "/srv/app/x")
+		if err == nil || !strings.Contains(err.Error(), "SSH接続に失敗") {
+			t.Errorf("認証失敗でエラーになっていません: %v", err)
+		}
+	})
+
+	t.Run("サーバーエラー応答", func(t *testing.T) {
+		tests := []struct {
+			phase string
+			code  byte
+			want  string
+		}{
+			{"initial", 2, "初期確認に失敗"},
+			{"header", 1, "ファイル情報の確認に失敗"},
+			{"final", 1, "ファイル転送の確認に失敗"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.phase, func(t *testing.T) {
+				server := newTestSSHServer(t)
+				server.failScp(tt.phase, tt.code, "scp: /srv/app: Permission denied")
+				err := TransferFile(context.Background(), server.passwordConfig(), writeLocalFile(t, []byte("data")), "/srv/app/data")
+				if err == nil {
+					t.Fatal("エラー応答でエラーになっていません")
+				}
+				if !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("エラーにフェーズ %q が含まれていません: %v", tt.want, err)
+				}
+				if _, ok := server.file("/srv/app/data"); ok {
+					t.Error("エラー応答にもかかわらずファイルが保存されています")
+				}
+			})
+		}
+	})
+
+	t.Run("転送中のEOF", func(t *testing.T) {
+		server := newTestSSHServer(t)
+		server.cutScpAfter(1024)
+		err := TransferFile(context.Background(), server.passwordConfig(), writeLocalFile(t, content), "/srv/app/deploy.tar.gz")
+		if err == nil {
+			t.Fatal("転送途中で切断されたのにエラーになっていません")
+		}
+		if _, ok := server.file("/srv/app/deploy.tar.gz"); ok {
+			t.Error("切断されたにもかかわらずファイルが保存されています")
+		}
+	})
+
+	t.Run("ディレクトリ作成の失敗", func(t *testing.T) {
+		server := newTestSSHServer(t)
+		server.respond("mkdir -p", "", 1)
+		err := TransferFile(context.Background(), server.passwordConfig(), writeLocalFile(t, []byte("x")), "/srv/app/x")
+		if err == nil || !strings.Contains(err.Error(), "リモートディレクトリの作成") {
+			t.Errorf("ディレクトリ作成失敗でエラーになっていません: %v", err)
+		}
+	})
+
+	t.Run("中断", func(t *testing.T) {
+		server := newTestSSHServer(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := TransferFile(ctx, server.passwordConfig(), writeLocalFile(t, content), "/srv/app/deploy.tar.gz")
+		if err == nil || !strings.Contains(err.Error(), "処理が中断されました") {
+			t.Errorf("中断時に中断エラーが返されていません: %v", err)
+		}
+		if _, ok := server.file("/srv/app/deploy.tar.gz"); ok {
+			t.Error("中断されたにもかかわらずファイルが保存されています")
+		}
+	})
+}
+
+func TestExecuteRemoteCommand(t *testing.T) {
+	server := newTestSSHServer(t)
+	server.respond("docker ps", "myapp_container\n", 0)
+	server.respond("docker stop", "", 1)
+	conf := server.passwordConfig()
+
+	out, err := executeRemoteCommandWithOutput(context.Background(), conf, "docker ps -a --format {{.Names}}")
+	if err != nil {
+		t.Fatalf("executeRemoteCommandWithOutput() error = %v", err)
+	}
+	if out != "myapp_container\n" {
+		t.Errorf("出力: want %q, got %q", "myapp_container\n", out)
+	}
+
+	if err := ExecuteRemoteCommand(context.Background(), conf, "docker stop myapp_container"); err == nil {
+		t.Error("終了コード 1 でエラーになっていません")
+	}
+}
+
+func TestTestSSHServerSFTP(t *testing.T) {
+	server := newTestSSHServer(t)
+	conf := server.passwordConfig()
+	if err := TransferFile(context.Background(), conf, writeLocalFile(t, []byte("via scp")), "/srv/app/scp.txt"); err != nil {
+		t.Fatalf("TransferFile() error = %v", err)
+	}
+
+	client, closeClient, err := dialSSH(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("dialSSH() error = %v", err)
+	}
+	defer closeClient()
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatalf("sftp.NewClient() error = %v", err)
+	}
+	defer sftpClient.Close()
+
+	// scp で受信したファイルを sftp で読める
+	f, err := sftpClient.Open("/srv/app/scp.txt")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(f); err != nil || buf.String() != "via scp" {
+		t.Errorf("読み込んだ内容: want %q, got %q (err = %v)", "via scp", buf.String(), err)
+	}
+	f.Close()
+
+	// sftp で書き込んだファイルはサーバーのファイルとして保存される
+	w, err := sftpClient.Create("/srv/app/tmp.txt")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	w.Write([]byte("via sftp"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := sftpClient.Chmod("/srv/app/tmp.txt", 0600); err != nil {
+		t.Fatalf("Chmod() error = %v", err)
+	}
+	if err := sftpClient.Rename("/srv/app/tmp.txt", "/srv/app/sftp.txt"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if got, _ := server.file("/srv/app/sftp.txt"); string(got) != "via sftp" {
+		t.Errorf("書き込まれた内容: want %q, got %q", "via sftp", got)
+	}
+	if mode := server.mode("/srv/app/sftp.txt"); mode != 0600 {
+		t.Errorf("ファイルモード: want 0600, got %04o", mode)
+	}
+
+	entries, err := sftpClient.ReadDir("/srv/app")
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != "scp.txt,sftp.txt" {
+		t.Errorf("ディレクトリの内容: got %v", names)
+	}
+
+	if err := sftpClient.Remove("/srv/app/scp.txt"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := sftpClient.Stat("/srv/app/scp.txt"); !os.IsNotExist(err) {
+		t.Errorf("削除したファイルが残っています: %v", err)
+	}
+}
+
+func TestCheckAck(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{"成功", "\x00", ""},
+		{"警告", "\x01scp: warning\n", "サーバーエラー応答 (コード 1): scp: warning"},
+		{"致命的エラー", "\x02scp: fatal\n", "サーバーエラー応答 (コード 2): scp: fatal"},
+		{"不正な応答", "\x05", "不正な応答コード: 5"},
+		{"EOF", "", "予期せぬEOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAck(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkAck() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkAck() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,488 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linkalls/sailor/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// scpFailure は SCP 受信側で返すエラー応答の設定
+type scpFailure struct {
+	phase   string // "initial" / "header" / "final"
+	code    byte   // 1: 警告, 2: 致命的エラー
+	message string
+}
+
+// execResponse は任意コマンドに対するスクリプト化した応答
+type execResponse struct {
+	output string
+	status uint32
+}
+
+// testSSHServer はテスト用にローカルで起動する SSH サーバー
+// scp -t による受信、sftp サブシステム、任意コマンドの実行に対応し、ファイルはメモリ上に保持する
+type testSSHServer struct {
+	t        *testing.T
+	host     string
+	port     int
+	hostKey  ssh.Signer
+	user     string
+	password string
+
+	mu             sync.Mutex
+	authorizedKeys []ssh.PublicKey
+	files          map[string][]byte
+	modes          map[string]os.FileMode
+	commands       []string
+	responses      map[string]execResponse
+	scpFailure     *scpFailure
+	scpEOFAfter    int64 // 0 以上なら指定バイト数を受信した時点で接続を切る
+}
+
+// newTestSSHServer はテスト用 SSH サーバーを起動する。テスト終了時に停止される
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSSHServer{
+		t:           t,
+		hostKey:     hostKey,
+		user:        "deploy",
+		password:    "secret",
+		files:       make(map[string][]byte),
+		modes:       make(map[string]os.FileMode),
+		responses:   make(map[string]execResponse),
+		scpEOFAfter: -1,
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == s.user && string(password) == s.password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("パスワードが一致しません")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for _, k := range s.authorizedKeys {
+				if c.User() == s.user && bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("許可されていない公開鍵です")
+		},
+	}
+	serverConfig.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	addr := listener.Addr().(*net.TCPAddr)
+	s.host = addr.IP.String()
+	s.port = addr.Port
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConn(conn, serverConfig)
+		}
+	}()
+
+	return s
+}
+
+// authorize は公開鍵認証で許可する鍵を追加する
+func (s *testSSHServer) authorize(key ssh.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorizedKeys = append(s.authorizedKeys, key)
+}
+
+// respond は prefix で始まるコマンドに対する出力と終了コードを登録する
+func (s *testSSHServer) respond(prefix, output string, status uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[prefix] = execResponse{output: output, status: status}
+}
+
+// failScp は SCP 受信の指定フェーズでエラー応答を返すよう設定する
+func (s *testSSHServer) failScp(phase string, code byte, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scpFailure = &scpFailure{phase: phase, code: code, message: message}
+}
+
+// cutScpAfter は SCP でファイル本体を n バイト受信した時点で接続を切るよう設定する
+func (s *testSSHServer) cutScpAfter(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scpEOFAfter = n
+}
+
+// file は受信したファイルの内容を返す
+func (s *testSSHServer) file(path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[path]
+	return data, ok
+}
+
+// mode は受信したファイルのパーミッションを返す
+func (s *testSSHServer) mode(path string) os.FileMode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.modes[path]
+}
+
+// executed は実行されたコマンドの一覧を返す
+func (s *testSSHServer) executed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// knownHostsFile はこのサーバーのホストキーを登録した known_hosts ファイルを作成する
+func (s *testSSHServer) knownHostsFile(t *testing.T) string {
+	t.Helper()
+	address := knownhosts.Normalize(fmt.Sprintf("%s:%d", s.host, s.port))
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{address}, s.hostKey.PublicKey())
+	if err := os.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// passwordConfig はパスワード認証でこのサーバーに接続する設定を返す
+func (s *testSSHServer) passwordConfig() config.Config {
+	var conf config.Config
+	conf.SSH.Host = s.host
+	conf.SSH.Port = s.port
+	conf.SSH.User = s.user
+	conf.SSH.Password = s.password
+	return conf
+}
+
+func (s *testSSHServer) handleConn(conn net.Conn, serverConfig *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session のみ対応しています")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(channel, requests)
+	}
+}
+
+func (s *testSSHServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				return
+			}
+			req.Reply(true, nil)
+
+			status, ok := s.exec(payload.Command, channel)
+			if ok {
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			}
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			s.mu.Lock()
+			s.commands = append(s.commands, "subsystem sftp")
+			s.mu.Unlock()
+			handler := &sftpHandler{s: s}
+			server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: handler, FilePut: handler, FileCmd: handler, FileList: handler})
+			server.Serve()
+			server.Close()
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+			return
+		default:
+			// pty などは未対応
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// exec はコマンドを記録して実行する。終了コードを返さずに切断する場合は ok が false
+func (s *testSSHServer) exec(command string, channel ssh.Channel) (status uint32, ok bool) {
+	s.mu.Lock()
+	s.commands = append(s.commands, command)
+	s.mu.Unlock()
+
+	fields := strings.Fields(command)
+	if len(fields) == 3 && filepath.Base(fields[0]) == "scp" && fields[1] == "-t" {
+		return s.scpSink(fields[2], channel)
+	}
+
+	s.mu.Lock()
+	var matched execResponse
+	longest := -1
+	for prefix, r := range s.responses {
+		if strings.HasPrefix(command, prefix) && len(prefix) > longest {
+			matched, longest = r, len(prefix)
+		}
+	}
+	s.mu.Unlock()
+
+	io.WriteString(channel, matched.output)
+	return matched.status, true
+}
+
+// scpSink は scp -t の受信側プロトコルを実装する
+func (s *testSSHServer) scpSink(target string, channel ssh.Channel) (uint32, bool) {
+	s.mu.Lock()
+	failure := s.scpFailure
+	eofAfter := s.scpEOFAfter
+	s.mu.Unlock()
+
+	reject := func(phase string) bool {
+		if failure == nil || failure.phase != phase {
+			return false
+		}
+		channel.Write(append([]byte{failure.code}, failure.message+"\n"...))
+		return true
+	}
+
+	r := bufio.NewReader(channel)
+	if reject("initial") {
+		return 1, true
+	}
+	channel.Write([]byte{0})
+
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return 1, true
+	}
+	var mode uint32
+	var size int64
+	var name string
+	if _, err := fmt.Sscanf(header, "C%o %d %s", &mode, &size, &name); err != nil {
+		channel.Write([]byte("\x02不正なヘッダーです\n"))
+		return 1, true
+	}
+	if reject("header") {
+		return 1, true
+	}
+	channel.Write([]byte{0})
+
+	if eofAfter >= 0 && eofAfter < size {
+		io.CopyN(io.Discard, r, eofAfter)
+		return 0, false
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 1, true
+	}
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return 1, true
+	}
+	if reject("final") {
+		return 1, true
+	}
+
+	s.mu.Lock()
+	s.files[target] = data
+	s.modes[target] = os.FileMode(mode)
+	s.mu.Unlock()
+
+	channel.Write([]byte{0})
+	return 0, true
+}
+
+// sftpHandler は testSSHServer のメモリ上のファイルを sftp で読み書きするハンドラー
+// ディレクトリはファイルのパスから暗黙に存在するものとして扱う
+type sftpHandler struct {
+	s *testSSHServer
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	data, ok := h.s.file(r.Filepath)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return &sftpFile{s: h.s, path: r.Filepath}, nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	switch r.Method {
+	case "Setstat":
+		if _, ok := h.s.files[r.Filepath]; ok && r.AttrFlags().Permissions {
+			h.s.modes[r.Filepath] = r.Attributes().FileMode().Perm()
+		}
+	case "Rename", "PosixRename":
+		data, ok := h.s.files[r.Filepath]
+		if !ok {
+			return os.ErrNotExist
+		}
+		h.s.files[r.Target], h.s.modes[r.Target] = data, h.s.modes[r.Filepath]
+		delete(h.s.files, r.Filepath)
+		delete(h.s.modes, r.Filepath)
+	case "Remove":
+		if _, ok := h.s.files[r.Filepath]; !ok {
+			return os.ErrNotExist
+		}
+		delete(h.s.files, r.Filepath)
+		delete(h.s.modes, r.Filepath)
+	case "Mkdir", "Rmdir":
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return nil
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	switch r.Method {
+	case "Stat", "Lstat":
+		if data, ok := h.s.files[r.Filepath]; ok {
+			return sftpLister{sftpFileInfo{name: path.Base(r.Filepath), size: int64(len(data)), mode: h.s.modes[r.Filepath]}}, nil
+		}
+		for file := range h.s.files {
+			if strings.HasPrefix(file, strings.TrimSuffix(r.Filepath, "/")+"/") {
+				return sftpLister{sftpFileInfo{name: path.Base(r.Filepath), mode: os.ModeDir | 0755}}, nil
+			}
+		}
+		return nil, os.ErrNotExist
+	case "List":
+		var entries sftpLister
+		seen := make(map[string]bool)
+		prefix := strings.TrimSuffix(r.Filepath, "/") + "/"
+		for file, data := range h.s.files {
+			rest, ok := strings.CutPrefix(file, prefix)
+			if !ok {
+				continue
+			}
+			name, sub, isDir := strings.Cut(rest, "/")
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if isDir && sub != "" {
+				entries = append(entries, sftpFileInfo{name: name, mode: os.ModeDir | 0755})
+			} else {
+				entries = append(entries, sftpFileInfo{name: name, size: int64(len(data)), mode: h.s.modes[file]})
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		return entries, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// sftpFile は sftp で書き込み中のファイル。Close したときにサーバーのファイルとして保存する
+type sftpFile struct {
+	s    *testSSHServer
+	path string
+	mu   sync.Mutex
+	data []byte
+}
+
+func (f *sftpFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[off:], p)
+	return len(p), nil
+}
+
+func (f *sftpFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	f.s.files[f.path] = f.data
+	if _, ok := f.s.modes[f.path]; !ok {
+		f.s.modes[f.path] = 0644
+	}
+	return nil
+}
+
+type sftpLister []os.FileInfo
+
+func (l sftpLister) ListAt(entries []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(entries, l[offset:])
+	if offset+int64(n) >= int64(len(l)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type sftpFileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (fi sftpFileInfo) Name() string       { return fi.name }
+func (fi sftpFileInfo) Size() int64        { return fi.size }
+func (fi sftpFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi sftpFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi sftpFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi sftpFileInfo) Sys() any           { return nil }
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// DefaultTagTemplate は [docker] tag_template が未指定の場合のタグ
+const DefaultTagTemplate = "{{.Timestamp}}"
+
+// OCI のイメージラベル
+const (
+	labelRevision = "org.opencontainers.image.revision"
+	labelSource   = "org.opencontainers.image.source"
+	labelCreated  = "org.opencontainers.image.created"
+)
+
+// TagData はタグのテンプレートで参照できる値
+type TagData struct {
+	Commit    string // 短縮コミットハッシュ
+	Branch    string // ブランチ名（タグに使えない文字は - に置換）
+	Timestamp string // ビルド開始時刻 (20060102150405)
+	Version   string // git describe --tags --always の結果
+}
+
+// invalidTagChars は Docker のタグに使えない文字
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// sanitizeTag は Docker のタグに使えない文字を - に置き換え、128文字に切り詰める
+func sanitizeTag(tag string) string {
+	tag = invalidTagChars.ReplaceAllString(tag, "-")
+	tag = strings.TrimLeft(tag, ".-")
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
+}
+
+// renderTag はタグのテンプレートを展開する
+func renderTag(tmpl string, data TagData) (string, error) {
+	if tmpl == "" {
+		tmpl = DefaultTagTemplate
+	}
+	t, err := template.New("tag").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("tag_template の解析に失敗: %w", err)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("tag_template の展開に失敗: %w", err)
+	}
+	tag := sanitizeTag(b.String())
+	if tag == "" {
+		return "", fmt.Errorf("tag_template %q から有効なタグを生成できません", tmpl)
+	}
+	return tag, nil
+}
+
+// releaseName は app_dir のリリースディレクトリ名を返す
+// {{.Commit}} のように再デプロイで同じになるタグでは既存のリリースを上書き・削除しないよう、ビルド開始時刻を付けてデプロイごとに一意にする
+func releaseName(tag, timestamp string) string {
+	if strings.Contains(tag, timestamp) {
+		return tag
+	}
+	return tag + "-" + timestamp
+}
+
+// sourceURL は origin の URL から認証情報を取り除いて返す
+func sourceURL(remote string) string {
+	remote = strings.TrimSpace(remote)
+	if u, err := url.Parse(remote); err == nil && u.Scheme != "" && u.User != nil {
+		u.User = nil
+		return u.String()
+	}
+	return remote
+}
+
+// ResolveImageTag は HEAD のコミットから tag_template を展開してデプロイするタグとリリース名を決定し、
+// コミット・リポジトリ・作成日時の OCI ラベルをビルドするイメージのラベルに追加する関数
+// [docker] labels で同じキーを指定した場合はそちらを優先する
+func ResolveImageTag(ctx context.Context, conf *config.Config, local LocalRunner, now time.Time) error {
+	commit, err := local.Output(ctx, "git", "rev-parse", "HEAD")
+	if err != nil {
+		return fmt.Errorf("コミットの取得に失敗: %w", err)
+	}
+	commit = strings.TrimSpace(commit)
+	short, _ := local.Output(ctx, "git", "rev-parse", "--short", "HEAD")
+	branch, _ := local.Output(ctx, "git", "rev-parse", "--abbrev-ref", "HEAD")
+	version, _ := local.Output(ctx, "git", "describe", "--tags", "--always")
+
+	timestamp := now.Format("20060102150405")
+	tag, err := renderTag(conf.Docker.TagTemplate, TagData{
+		Commit:    strings.TrimSpace(short),
+		Branch:    sanitizeTag(strings.TrimSpace(branch)),
+		Timestamp: timestamp,
+		Version:   strings.TrimSpace(version),
+	})
+	if err != nil {
+		return err
+	}
+	conf.Docker.Tag = tag
+	conf.Remote.Release = releaseName(tag, timestamp)
+
+	labels := map[string]string{
+		labelRevision: commit,
+		labelCreated:  now.UTC().Format(time.RFC3339),
+	}
+	if origin, err := local.Output(ctx, "git", "remote", "get-url", "origin"); err == nil && strings.TrimSpace(origin) != "" {
+		labels[labelSource] = sourceURL(origin)
+	}
+	for key, value := range conf.Docker.Labels {
+		labels[key] = value
+	}
+	conf.Docker.Labels = labels
+	return nil
+}
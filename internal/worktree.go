@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/linkalls/sailor/config"
+)
+
+// Worktree は sailor deploy --ref でビルドに使う一時的な git worktree
+type Worktree struct {
+	Ref    string // 指定された ref (タグ・ブランチ・コミット)
+	Commit string // ref が指すコミットの完全なハッシュ
+	Dir    string // worktree のディレクトリ
+	origin string // worktree に移動する前のカレントディレクトリ
+}
+
+// AddWorktree は ref を一時ディレクトリに git worktree として展開する関数
+// 開発者の作業ツリーやブランチには一切触れない
+func AddWorktree(ctx context.Context, local LocalRunner, ref string) (*Worktree, error) {
+	commit, err := local.Output(ctx, "git", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	commit = strings.TrimSpace(commit)
+	if err != nil || commit == "" {
+		return nil, fmt.Errorf("ref %s が見つかりません（git fetch が必要かもしれません）", ref)
+	}
+	origin, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("カレントディレクトリの取得に失敗: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "sailor-worktree-")
+	if err != nil {
+		return nil, fmt.Errorf("一時ディレクトリの作成に失敗: %w", err)
+	}
+	if err := local.Run(ctx, "git", "worktree", "add", "--detach", dir, commit); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("git worktree の作成に失敗: %w", err)
+	}
+	return &Worktree{Ref: ref, Commit: commit, Dir: dir, origin: origin}, nil
+}
+
+// CheckoutRef は ref を git worktree に展開し、カレントディレクトリを worktree に移動する関数
+// worktree 内ではリポジトリ名が一時ディレクトリ名になるため、移動する前に compose のプロジェクト名を固定し、
+// -p・状態ディレクトリ・ロック・履歴を通常のデプロイと共有する
+func CheckoutRef(ctx context.Context, conf *config.Config, local LocalRunner, ref string) (*Worktree, error) {
+	ResolveProjectName(ctx, conf, local)
+	worktree, err := AddWorktree(ctx, local, ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := worktree.Enter(ctx, *conf, local); err != nil {
+		worktree.Remove()
+		return nil, err
+	}
+	return worktree, nil
+}
+
+// worktreeSeedFiles は作業ツリーから worktree にコピーする候補のファイルを返す
+// 環境変数ファイルや追加ファイルはコミットされていないことが多いため、作業ツリーの compose ファイルからも収集する
+func worktreeSeedFiles(conf config.Config) []string {
+	if !conf.Docker.UseCompose {
+		return nil
+	}
+	conf.Compose.EnvFiles = append([]string(nil), conf.Compose.EnvFiles...)
+	conf.Compose.ExtraFiles = append([]string(nil), conf.Compose.ExtraFiles...)
+	PrepareCompose(&conf)
+
+	files := append(conf.Compose.EnvFiles, conf.Compose.ExtraFiles...)
+	if conf.Docker.ComposeEnvFile != "" {
+		files = appendMissing(files, conf.Docker.ComposeEnvFile)
+	}
+	return files
+}
+
+// Enter は ref に含まれないファイルを作業ツリーからコピーし、カレントディレクトリを worktree に移動する関数
+// サブディレクトリで実行した場合は worktree 内の同じディレクトリに移動する
+func (w *Worktree) Enter(ctx context.Context, conf config.Config, local LocalRunner) error {
+	dir := w.Dir
+	if prefix := gitPrefix(ctx, local); prefix != "" {
+		dir = filepath.Join(dir, prefix)
+	}
+	for _, file := range worktreeSeedFiles(conf) {
+		if filepath.IsAbs(file) {
+			continue
+		}
+		target := filepath.Join(dir, file)
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		if err := copyFile(file, target); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%s のコピーに失敗: %w", file, err)
+		}
+	}
+	if err := os.Chdir(dir); err != nil {
+		return fmt.Errorf("worktree への移動に失敗: %w", err)
+	}
+	return nil
+}
+
+// copyFile はファイルをパーミッションごとコピーする
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Remove はカレントディレクトリを元に戻し、worktree を削除する関数
+// nil に対して呼んでも何もしない
+func (w *Worktree) Remove() {
+	if w == nil {
+		return
+	}
+	if err := os.Chdir(w.origin); err != nil {
+		fmt.Printf("警告: カレントディレクトリを元に戻せませんでした: %v\n", err)
+	}
+	cmd := exec.Command("git", "worktree", "remove", "--force", w.Dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		fmt.Printf("警告: git worktree %s の削除に失敗しました: %v %s\n", w.Dir, err, strings.TrimSpace(string(out)))
+	}
+	os.RemoveAll(w.Dir)
+}
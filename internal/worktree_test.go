@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linkalls/sailor/config"
+)
+
+func TestWorktree(t *testing.T) {
+	chdirWithFiles(t, map[string]string{
+		"docker-compose.yml": "name: myapp\nservices:\n  web:\n    build: .\n    env_file: .env.web\n",
+		".env":               "A=1\n",
+		".env.web":           "B=2\n",
+		"nginx.conf":         "working copy\n",
+	})
+	origin, _ := os.Getwd()
+	local := &fakeLocal{}
+	local.on("git rev-parse --verify --quiet v1.4.2^{commit}", "abc1234def5678\n", nil)
+
+	worktree, err := AddWorktree(context.Background(), local, "v1.4.2")
+	if err != nil {
+		t.Fatalf("AddWorktree() error = %v", err)
+	}
+	if worktree.Commit != "abc1234def5678" {
+		t.Errorf("Commit = %s", worktree.Commit)
+	}
+	assertCommands(t, local.commands[1:], []string{"git worktree add --detach " + worktree.Dir + " abc1234def5678"})
+
+	// ref にコミットされているファイルは作業ツリーの内容で上書きしない
+	if err := os.WriteFile(filepath.Join(worktree.Dir, "nginx.conf"), []byte("v1.4.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := worktree.Enter(context.Background(), newTestComposeConfig(), local); err != nil {
+		t.Fatalf("Enter() error = %v", err)
+	}
+	if wd, _ := os.Getwd(); wd != worktree.Dir {
+		t.Errorf("カレントディレクトリ = %s, want %s", wd, worktree.Dir)
+	}
+	for file, want := range map[string]string{".env": "A=1\n", ".env.web": "B=2\n", "nginx.conf": "v1.4.2\n"} {
+		if content, err := os.ReadFile(file); err != nil || string(content) != want {
+			t.Errorf("%s = %q (%v), want %q", file, content, err, want)
+		}
+	}
+
+	worktree.Remove()
+	if wd, _ := os.Getwd(); wd != origin {
+		t.Errorf("カレントディレクトリが元に戻っていません: %s", wd)
+	}
+	if _, err := os.Stat(worktree.Dir); !os.IsNotExist(err) {
+		t.Errorf("worktree が削除されていません: %v", err)
+	}
+}
+
+func TestAddWorktreeUnknownRef(t *testing.T) {
+	local := &fakeLocal{}
+	local.on("git rev-parse", "", errors.New("exit status 1"))
+	if _, err := AddWorktree(context.Background(), local, "v9.9.9"); err == nil {
+		t.Fatal("存在しない ref でエラーが返されていません")
+	}
+	if len(local.commands) != 1 {
+		t.Errorf("worktree が作成されています: %v", local.commands)
+	}
+}
+
+func TestCheckoutRefKeepsProjectName(t *testing.T) {
+	// project_name も name: も無いため、プロジェクト名はリポジトリ名から決まる
+	chdirWithFiles(t, map[string]string{
+		"docker-compose.yml": "services:\n  web:\n    build: .\n",
+	})
+	newConf := func() config.Config {
+		conf := newTestComposeConfig()
+		conf.Compose.ProjectName = ""
+		conf.Compose.EnvFiles = nil
+		conf.Docker.ComposeEnvFile = ""
+		conf.Compose.ExtraFiles = nil
+		return conf
+	}
+
+	// 通常のデプロイ
+	local := &fakeLocal{}
+	local.on("git rev-parse --show-toplevel", "/home/dev/shop\n", nil)
+	conf := newConf()
+	ResolveProjectName(context.Background(), &conf, local)
+	wantCompose, wantStateDir := remoteCompose(conf), RemoteStateDir(conf)
+	if wantCompose != "docker-compose -p shop" {
+		t.Fatalf("remoteCompose() = %s, want docker-compose -p shop", wantCompose)
+	}
+
+	// --ref のデプロイ（worktree 内ではリポジトリのルートが一時ディレクトリになる）
+	local.on("git rev-parse --verify", "abc1234def5678\n", nil)
+	conf = newConf()
+	worktree, err := CheckoutRef(context.Background(), &conf, local, "v1.4.2")
+	if err != nil {
+		t.Fatalf("CheckoutRef() error = %v", err)
+	}
+	defer worktree.Remove()
+	local.responses = append([]fakeResponse{{prefix: "git rev-parse --show-toplevel", output: worktree.Dir + "\n"}}, local.responses...)
+	if err := os.WriteFile("docker-compose.yml", []byte("services:\n  web:\n    build: .\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PrepareCompose(&conf); err != nil {
+		t.Fatal(err)
+	}
+	ResolveProjectName(context.Background(), &conf, local)
+
+	if got := remoteCompose(conf); got != wantCompose {
+		t.Errorf("--ref の compose コマンド = %s, want %s", got, wantCompose)
+	}
+	if got := RemoteStateDir(conf); got != wantStateDir {
+		t.Errorf("--ref の状態ディレクトリ = %s, want %s", got, wantStateDir)
+	}
+}